@@ -0,0 +1,480 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// AdminSpec specifies the endpoints tweaking the fake cloud itself, such as
+// its whole state, the faults it injects, the chaos on API requests or its
+// clock, for tests to script their scenarios, and its metrics.
+// They are served apart from APISpec, see AdminHandler.
+var AdminSpec = []EndpointSpec{
+	{
+		DisplayPath: "/admin/reset",
+		Path:        mustCompileAnchored(`/admin/reset[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodPost,
+				BodySpec:    "VMs JSON",
+				Doc:         "replace all VMs with the ones loaded on startup",
+				OperationID: "reset",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					err := s.vmm.Reset()
+					s.audit(requesterOf(r), "reset", nil, "", err)
+					if err != nil {
+						writeError(w, r, err)
+						return
+					}
+					fmt.Fprint(w, s.vmm.State())
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/admin/state",
+		Path:        mustCompileAnchored(`/admin/state[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "VMs JSON",
+				Doc:         "get all VMs as stored",
+				OperationID: "getState",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, s.vmm.State())
+				},
+			},
+			{
+				Method:      http.MethodPut,
+				BodySpec:    "VMs JSON",
+				Doc:         "replace all VMs at once with a VMs JSON body",
+				OperationID: "setState",
+				Example:     `{"0":{"vcpus":1,"clock":1500,"ram":4096,"storage":128,"network":1000,"state":"Running"}}`,
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.setState(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/admin/snapshots",
+		Path:        mustCompileAnchored(`/admin/snapshots[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "Snapshots JSON",
+				Doc:         "list the snapshots of all VMs saved",
+				OperationID: "listSnapshots",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, s.vmm.Snapshots())
+				},
+			},
+			{
+				Method:      http.MethodPost,
+				BodySpec:    "Snapshot JSON",
+				Doc:         "save a snapshot of all VMs under the name of a JSON body",
+				OperationID: "createSnapshot",
+				Example:     `{"name":"all-running"}`,
+				Status:      http.StatusCreated,
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.createSnapshot(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/admin/snapshots/{name}/restore",
+		Path:        mustCompileAnchored(`/admin/snapshots/[^/]+/restore[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodPost,
+				BodySpec:    "VMs JSON",
+				Doc:         "replace all VMs with the ones of a snapshot by name",
+				OperationID: "restoreSnapshot",
+				Errors:      []ErrorCode{NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					name := strings.Split(r.URL.Path, "/")[3]
+					err := s.vmm.Restore(name)
+					s.audit(requesterOf(r), "restore", nil, "", err)
+					if err != nil {
+						writeError(w, r, err)
+						return
+					}
+					fmt.Fprint(w, s.vmm.State())
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/admin/faults",
+		Path:        mustCompileAnchored(`/admin/faults[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "FaultRules JSON",
+				Doc:         "list the rules making transitions fail",
+				OperationID: "listFaults",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, s.vmm.Faults())
+				},
+			},
+			{
+				Method:      http.MethodPut,
+				BodySpec:    "FaultRules JSON",
+				Doc:         "replace all fault rules with a FaultRules JSON body",
+				OperationID: "setFaults",
+				Example:     `[{"vm":2,"action":"launch","probability":1,"outcome":"error"}]`,
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.setFaults(w, r)
+				},
+			},
+			{
+				Method:      http.MethodPost,
+				BodySpec:    "FaultRules JSON",
+				Doc:         "add a fault rule from a FaultRule JSON body",
+				OperationID: "addFault",
+				Example:     `{"action":"stop","probability":0.5,"outcome":"rollback","count":1}`,
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.addFault(w, r)
+				},
+			},
+			{
+				Method:      http.MethodDelete,
+				Doc:         "remove all fault rules",
+				OperationID: "clearFaults",
+				Status:      http.StatusNoContent,
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.audit(requesterOf(r), "clear-faults", nil, "", s.vmm.SetFaults(nil))
+					w.WriteHeader(http.StatusNoContent)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/admin/chaos",
+		Path:        mustCompileAnchored(`/admin/chaos[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "ChaosRules JSON",
+				Doc:         "list the rules making API requests go wrong",
+				OperationID: "listChaos",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, s.chaos.list())
+				},
+			},
+			{
+				Method:      http.MethodPut,
+				BodySpec:    "ChaosRules JSON",
+				Doc:         "replace all chaos rules with a ChaosRules JSON body",
+				OperationID: "setChaos",
+				Example:     `[{"endpoint":"/vms","method":"GET","fault":"throttle","probability":0.2}]`,
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.setChaos(w, r)
+				},
+			},
+			{
+				Method:      http.MethodPost,
+				BodySpec:    "ChaosRules JSON",
+				Doc:         "add a chaos rule from a ChaosRule JSON body",
+				OperationID: "addChaos",
+				Example:     `{"fault":"latency","probability":1,"latency":"2s"}`,
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.addChaos(w, r)
+				},
+			},
+			{
+				Method:      http.MethodDelete,
+				Doc:         "remove all chaos rules",
+				OperationID: "clearChaos",
+				Status:      http.StatusNoContent,
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.audit(requesterOf(r), "clear-chaos", nil, "", s.chaos.set(nil))
+					w.WriteHeader(http.StatusNoContent)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/admin/clock",
+		Path:        mustCompileAnchored(`/admin/clock[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "ClockStatus JSON",
+				Doc:         "inspect the clock running the transitions",
+				OperationID: "inspectClock",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, s.vmm.ClockStatus())
+				},
+			},
+			{
+				Method:      http.MethodPut,
+				BodySpec:    "ClockStatus JSON",
+				Doc:         "change the timeScale of transition delays from a JSON body",
+				OperationID: "setTimeScale",
+				Example:     `{"timeScale":0.1}`,
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.setTimeScale(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/admin/clock/advance",
+		Path:        mustCompileAnchored(`/admin/clock/advance[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodPost,
+				BodySpec:    "ClockStatus JSON",
+				Doc:         "move a virtual clock forward by ?d=, firing the transitions due",
+				OperationID: "advanceClock",
+				Errors:      []ErrorCode{BadRequest, ValidationFailed, Conflict},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.advanceClock(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/metrics",
+		Path:        mustCompileAnchored(`/metrics[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "Prometheus text",
+				Doc:         "get the request, VM and transition metrics in the Prometheus text format",
+				OperationID: "getMetrics",
+				Response:    stringSchema,
+				ContentType: MetricsContentType,
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.metrics(w, r)
+				},
+			},
+		},
+	},
+}
+
+// AdminTokenEnv is the environment variable holding the admin API token,
+// unless set by flag
+const AdminTokenEnv = "TEST_VM_BACKEND_ADMIN_TOKEN"
+
+// adminHandler is a http.Handler of admin API requests, only served to
+// requests with the bearer token
+type adminHandler struct {
+	mux   *http.ServeMux
+	token string
+}
+
+// AdminHandler returns the handler of the admin API, serving AdminSpec and
+// the Go profiler under /debug/pprof/ to requests with an
+// "Authorization: Bearer <token>" header
+func (s *VMServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s.dispatch(w, r, AdminSpec)
+	})
+	return &adminHandler{mux: mux, token: token}
+}
+
+// WriteAdminAPIDoc dumps the admin API simple doc onto the given writer
+func (s *VMServer) WriteAdminAPIDoc(w io.Writer) {
+	fmt.Fprintln(w, "Admin API:")
+	writeEndpointsDoc(w, AdminSpec)
+}
+
+// ServeHTTP checks the token of the request, then dispatches it to the
+// correct method following the admin API schema.
+// Preflight requests carry no credentials, so they need no token.
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("<- admin %v %v", r.Method, r.URL.Path)
+	prepareCORSHeaders(w, r)
+	ensureRequestID(w, r)
+	if r.Method != http.MethodOptions && !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, r, newError(Unauthorized, "admin API requires an Authorization: Bearer token"))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorized tells whether the request carries the admin token
+func (h *adminHandler) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(h.token)) == 1
+}
+
+// newAdminToken returns a random token, for when none is given
+func newAdminToken() string {
+	token := make([]byte, 16)
+	_, err := cryptorand.Read(token)
+	dieOnError(err, "Can't generate admin token")
+	return hex.EncodeToString(token)
+}
+
+func (s *VMServer) setState(w http.ResponseWriter, r *http.Request) {
+	var vms VMs
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&vms); err != nil {
+		writeError(w, r, newError(BadRequest, "invalid VMs JSON: %v", err))
+		return
+	}
+	err := s.vmm.SetState(vms)
+	s.audit(requesterOf(r), "set-state", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, s.vmm.State())
+}
+
+func (s *VMServer) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, r, newError(BadRequest, "invalid snapshot JSON: %v", err))
+		return
+	}
+	snapshot, err := s.vmm.Snapshot(request.Name)
+	s.audit(requesterOf(r), "snapshot", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, snapshot)
+}
+
+func (s *VMServer) setTimeScale(w http.ResponseWriter, r *http.Request) {
+	var settings struct {
+		TimeScale float64 `json:"timeScale"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		writeError(w, r, newError(BadRequest, "invalid time scale JSON: %v", err))
+		return
+	}
+	err := s.vmm.SetTimeScale(settings.TimeScale)
+	s.audit(requesterOf(r), "set-time-scale", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, s.vmm.ClockStatus())
+}
+
+func (s *VMServer) advanceClock(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.URL.Query().Get("d"))
+	if err != nil {
+		writeError(w, r, newError(BadRequest, "invalid duration d: %v", err))
+		return
+	}
+	status, err := s.vmm.AdvanceClock(d)
+	s.audit(requesterOf(r), "advance-clock", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, status)
+}
+
+func (s *VMServer) setFaults(w http.ResponseWriter, r *http.Request) {
+	var rules FaultRules
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		writeError(w, r, newError(BadRequest, "invalid FaultRules JSON: %v", err))
+		return
+	}
+	err := s.vmm.SetFaults(rules)
+	s.audit(requesterOf(r), "set-faults", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, s.vmm.Faults())
+}
+
+func (s *VMServer) addFault(w http.ResponseWriter, r *http.Request) {
+	var rule FaultRule
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		writeError(w, r, newError(BadRequest, "invalid FaultRule JSON: %v", err))
+		return
+	}
+	err := s.vmm.AddFault(rule)
+	s.audit(requesterOf(r), "add-fault", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, s.vmm.Faults())
+}
+
+func (s *VMServer) setChaos(w http.ResponseWriter, r *http.Request) {
+	var rules ChaosRules
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		writeError(w, r, newError(BadRequest, "invalid ChaosRules JSON: %v", err))
+		return
+	}
+	err := s.chaos.set(rules)
+	s.audit(requesterOf(r), "set-chaos", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, s.chaos.list())
+}
+
+func (s *VMServer) addChaos(w http.ResponseWriter, r *http.Request) {
+	var rule ChaosRule
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		writeError(w, r, newError(BadRequest, "invalid ChaosRule JSON: %v", err))
+		return
+	}
+	err := s.chaos.add(rule)
+	s.audit(requesterOf(r), "add-chaos", nil, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, s.chaos.list())
+}
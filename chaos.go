@@ -0,0 +1,377 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChaosFault is what goes wrong with a request hit by chaos
+type ChaosFault string
+
+const (
+	// LATENCY requests are served after a random delay, up to the rule latency
+	LATENCY ChaosFault = "latency"
+
+	// SERVERERROR requests get a 500 error reply
+	SERVERERROR ChaosFault = "error"
+
+	// UNAVAILABLE requests get a 503 error reply, with a Retry-After header
+	UNAVAILABLE ChaosFault = "unavailable"
+
+	// THROTTLED requests get a 429 error reply, with a Retry-After header
+	THROTTLED ChaosFault = "throttle"
+
+	// TRUNCATED requests get their reply body cut short, then the connection closed
+	TRUNCATED ChaosFault = "truncate"
+
+	// DROPPED requests get their connection closed with no reply at all
+	DROPPED ChaosFault = "drop"
+)
+
+// chaosFaults lists all known chaos faults
+var chaosFaults = []ChaosFault{LATENCY, SERVERERROR, UNAVAILABLE, THROTTLED, TRUNCATED, DROPPED}
+
+// ChaosRule makes a share of the matching API requests go wrong
+type ChaosRule struct {
+	Endpoint    string     `json:"endpoint,omitempty"`   // APISpec DisplayPath, such as /vms/{vm_id}, any endpoint if unset
+	Method      string     `json:"method,omitempty"`     // HTTP method, any method if unset
+	Fault       ChaosFault `json:"fault"`                // Value within [latency, error, unavailable, throttle, truncate, drop]
+	Probability float64    `json:"probability"`          // Share of the matching requests hit, within [0, 1]
+	Latency     string     `json:"latency,omitempty"`    // Max delay of latency faults, such as 500ms
+	RetryAfter  int        `json:"retryAfter,omitempty"` // Seconds to wait on throttle and unavailable faults, 1 if unset
+}
+
+// String on a ChaosRule dumps it in JSON format
+func (rule ChaosRule) String() string {
+	ruleJSON, err := json.Marshal(rule)
+	dieOnError(err, "Can't generate JSON for ChaosRule object %#v", rule)
+	return string(ruleJSON)
+}
+
+// Validate checks the rule makes sense and targets an existing endpoint
+func (rule ChaosRule) Validate() error {
+	if rule.Probability < 0 || rule.Probability > 1 {
+		return newError(ValidationFailed, "invalid chaos rule: probability must be within [0, 1]")
+	}
+	known := false
+	for _, fault := range chaosFaults {
+		known = known || rule.Fault == fault
+	}
+	if !known {
+		return newError(ValidationFailed, "invalid chaos rule: fault must be within %v", chaosFaults)
+	}
+	if rule.Fault == LATENCY {
+		if latency, err := time.ParseDuration(rule.Latency); err != nil || latency < 0 {
+			return newError(ValidationFailed, "invalid chaos rule: bad latency %q, want a duration such as 500ms", rule.Latency)
+		}
+	}
+	if rule.RetryAfter < 0 {
+		return newError(ValidationFailed, "invalid chaos rule: retryAfter can't be negative")
+	}
+	if rule.Endpoint == "" {
+		return nil
+	}
+	for _, endpoint := range APISpec {
+		if endpoint.DisplayPath == rule.Endpoint {
+			return nil
+		}
+	}
+	return newError(ValidationFailed, "invalid chaos rule: unknown endpoint %q", rule.Endpoint)
+}
+
+// matches tells whether the rule applies to a request on the given endpoint
+func (rule ChaosRule) matches(endpoint EndpointSpec, method string) bool {
+	return (rule.Endpoint == "" || rule.Endpoint == endpoint.DisplayPath) && (rule.Method == "" || rule.Method == method)
+}
+
+// ChaosRules defines a list of ChaosRules with attached methods
+type ChaosRules []ChaosRule
+
+// String on ChaosRules dumps the list in JSON format
+func (rules ChaosRules) String() string {
+	rulesJSON, err := json.Marshal(rules)
+	dieOnError(err, "Can't generate JSON for ChaosRule objects %#v", rules)
+	return string(rulesJSON)
+}
+
+// Validate checks all rules
+func (rules ChaosRules) Validate() error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseChaosRule parses a chaos rule from a comma separated list of
+// key=value settings, such as "fault=throttle,endpoint=/vms,method=GET".
+// Probability is 1 unless set. The rule is not validated, as its endpoint
+// may belong to a lifecycle yet to be loaded.
+func ParseChaosRule(s string) (ChaosRule, error) {
+	rule := ChaosRule{Probability: 1}
+	settings, err := parseSettings(s)
+	if err != nil {
+		return ChaosRule{}, fmt.Errorf("bad chaos rule: %v", err)
+	}
+	for _, setting := range settings {
+		key, value := setting[0], setting[1]
+		switch key {
+		case "endpoint":
+			rule.Endpoint = value
+		case "method":
+			rule.Method = value
+		case "fault":
+			rule.Fault = ChaosFault(value)
+		case "probability":
+			rule.Probability, err = strconv.ParseFloat(value, 64)
+		case "latency":
+			rule.Latency = value
+		case "retryAfter":
+			rule.RetryAfter, err = strconv.Atoi(value)
+		default:
+			return ChaosRule{}, fmt.Errorf("unknown chaos rule setting %q", key)
+		}
+		if err != nil {
+			return ChaosRule{}, fmt.Errorf("bad chaos rule %s %q: %v", key, value, err)
+		}
+	}
+	return rule, nil
+}
+
+// chaosRuleList is a repeatable flag.Value adding a chaos rule each time
+type chaosRuleList struct {
+	rules *ChaosRules
+}
+
+func (l chaosRuleList) String() string {
+	if l.rules == nil {
+		return ""
+	}
+	return l.rules.String()
+}
+
+func (l chaosRuleList) Set(s string) error {
+	rule, err := ParseChaosRule(s)
+	if err != nil {
+		return err
+	}
+	*l.rules = append(*l.rules, rule)
+	return nil
+}
+
+// chaosMonkey makes API requests go wrong following a list of rules.
+// The zero value lets all requests through.
+type chaosMonkey struct {
+	lock  sync.Mutex
+	rules ChaosRules
+	rand  *rand.Rand // own source, so that other random draws don't change the rolls
+}
+
+// seed restarts the rolls from the given seed
+func (c *chaosMonkey) seed(seed int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rand = rand.New(rand.NewSource(seed))
+}
+
+// source returns the source of the rolls, seeding it at random if unset.
+// Must be called holding the lock.
+func (c *chaosMonkey) source() *rand.Rand {
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(rand.Int63()))
+	}
+	return c.rand
+}
+
+// set validates and replaces all rules
+func (c *chaosMonkey) set(rules ChaosRules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rules = append(ChaosRules{}, rules...)
+	return nil
+}
+
+// add validates and appends a rule
+func (c *chaosMonkey) add(rule ChaosRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rules = append(c.rules, rule)
+	return nil
+}
+
+// list returns a copy of the rules
+func (c *chaosMonkey) list() ChaosRules {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append(ChaosRules{}, c.rules...)
+}
+
+// strike tells whether a request on the given endpoint goes wrong, and how.
+// The first rule matching the request decides.
+func (c *chaosMonkey) strike(endpoint EndpointSpec, method string) (ChaosRule, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, rule := range c.rules {
+		if rule.matches(endpoint, method) {
+			return rule, c.source().Float64() < rule.Probability
+		}
+	}
+	return ChaosRule{}, false
+}
+
+// random returns a random number within [0, n), drawn from the rolls of
+// the rules
+func (c *chaosMonkey) random(n int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.source().Intn(n)
+}
+
+// serve lets next serve the request, unless a rule makes it go wrong.
+// Only requests to the API endpoints are hit, so that the admin API
+// stays reachable to turn chaos off.
+func (c *chaosMonkey) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	endpoint, m, found := findMethod(APISpec, r)
+	if !found {
+		next(w, r)
+		return
+	}
+	rule, hit := c.strike(endpoint, m.Method)
+	if !hit {
+		next(w, r)
+		return
+	}
+	log.Printf("Injecting chaos %s on %v %v", rule.Fault, r.Method, r.URL.Path)
+	retryAfter := rule.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = 1
+	}
+	switch rule.Fault {
+	case LATENCY:
+		latency, _ := time.ParseDuration(rule.Latency)
+		timer := time.NewTimer(time.Duration(c.random(int(latency) + 1)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			next(w, r)
+		case <-r.Context().Done():
+		}
+	case SERVERERROR:
+		writeError(w, r, newError(Internal, "injected server error"))
+	case UNAVAILABLE:
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, r, newError(Unavailable, "injected unavailability, retry in %d seconds", retryAfter))
+	case THROTTLED:
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, r, newError(TooManyRequests, "injected throttling, retry in %d seconds", retryAfter))
+	case TRUNCATED:
+		if isStream(m, r) {
+			next(w, r) // streams can't be buffered to be cut short
+			return
+		}
+		c.truncate(w, r, next)
+	case DROPPED:
+		dropConnection(w)
+	}
+}
+
+// findMethod returns the first endpoint and method of spec matching the request
+func findMethod(spec []EndpointSpec, r *http.Request) (EndpointSpec, MethodSpec, bool) {
+	for _, endpoint := range spec {
+		if !endpoint.Path.MatchString(r.URL.Path) {
+			continue
+		}
+		for _, m := range endpoint.Methods {
+			if r.Method == m.Method {
+				return endpoint, m, true
+			}
+		}
+	}
+	return EndpointSpec{}, MethodSpec{}, false
+}
+
+// isStream tells whether the reply to the request is a stream: an event
+// stream, whether the method always streams or was asked to, or a
+// connection upgrade
+func isStream(m MethodSpec, r *http.Request) bool {
+	return m.ContentType == "text/event-stream" || m.Status == http.StatusSwitchingProtocols ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// bufferedWriter keeps the reply of a handler to send it later
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (bw *bufferedWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+func (bw *bufferedWriter) Write(data []byte) (int, error) {
+	bw.WriteHeader(http.StatusOK)
+	return bw.body.Write(data)
+}
+
+// truncate replies what next would, but announcing the whole body length
+// and sending just a random part of it, so that clients see the connection
+// closed early
+func (c *chaosMonkey) truncate(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	bw := &bufferedWriter{ResponseWriter: w}
+	next(bw, r)
+	if bw.body.Len() == 0 {
+		dropConnection(w)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(bw.body.Len()))
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	w.WriteHeader(bw.status)
+	w.Write(bw.body.Bytes()[:c.random(bw.body.Len())])
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	dropConnection(w)
+}
+
+// dropConnection closes the connection of the request right away,
+// aborting the handler if the connection can't be hijacked
+func dropConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
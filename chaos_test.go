@@ -0,0 +1,102 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChaosRuleValidate(t *testing.T) {
+	for _, rule := range []ChaosRule{
+		{Fault: SERVERERROR, Probability: -1},
+		{Fault: "explode", Probability: 1},
+		{Fault: LATENCY, Probability: 1, Latency: "soon"},
+		{Fault: THROTTLED, Probability: 1, RetryAfter: -1},
+		{Fault: DROPPED, Probability: 1, Endpoint: "/nowhere"},
+	} {
+		if err := rule.Validate(); errorCode(err) != ValidationFailed {
+			t.Fatalf("%v: got: %v, want a %v error", rule, err, ValidationFailed)
+		}
+	}
+	rule, err := ParseChaosRule("fault=latency,latency=1ms,endpoint=/vms/{vm_id},method=GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	server := NewVMServer(defaultVMs.clone())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	for _, tc := range []struct {
+		rule           ChaosRule
+		wantStatus     int
+		wantRetryAfter string
+		wantErr        bool
+	}{
+		{rule: ChaosRule{Fault: LATENCY, Latency: "10ms"}, wantStatus: http.StatusOK},
+		{rule: ChaosRule{Fault: SERVERERROR}, wantStatus: http.StatusInternalServerError},
+		{rule: ChaosRule{Fault: UNAVAILABLE, RetryAfter: 5}, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "5"},
+		{rule: ChaosRule{Fault: THROTTLED}, wantStatus: http.StatusTooManyRequests, wantRetryAfter: "1"},
+		{rule: ChaosRule{Fault: TRUNCATED}, wantStatus: http.StatusOK, wantErr: true},
+		{rule: ChaosRule{Fault: DROPPED}, wantErr: true},
+		{rule: ChaosRule{Fault: SERVERERROR, Endpoint: "/vms/{vm_id}"}, wantStatus: http.StatusOK},
+		{rule: ChaosRule{Fault: SERVERERROR, Method: http.MethodPost}, wantStatus: http.StatusOK},
+	} {
+		tc.rule.Probability = 1
+		if err := server.chaos.set(ChaosRules{tc.rule}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get(ts.URL + "/vms")
+		if err != nil {
+			if !tc.wantErr {
+				t.Fatalf("%v: got: %v, want no error", tc.rule, err)
+			}
+			continue
+		}
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Fatalf("%v: got body error: %v, want one: %v", tc.rule, err, tc.wantErr)
+		}
+		if resp.StatusCode != tc.wantStatus {
+			t.Fatalf("%v: got status: %d, want: %d", tc.rule, resp.StatusCode, tc.wantStatus)
+		}
+		if got := resp.Header.Get("Retry-After"); got != tc.wantRetryAfter {
+			t.Fatalf("%v: got Retry-After: %q, want: %q", tc.rule, got, tc.wantRetryAfter)
+		}
+	}
+	// Streams asked for by the Accept header are not cut short either
+	server.chaos.set(ChaosRules{{Fault: TRUNCATED, Endpoint: "/vms/{vm_id}/console", Probability: 1}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/vms/1/console", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || got != "text/event-stream" {
+		t.Fatalf("got: %d %q, want the console streamed", resp.StatusCode, got)
+	}
+	cancel()
+	resp.Body.Close()
+
+	// Only the API is hit, so chaos can always be turned off on the admin API
+	server.chaos.set(ChaosRules{{Fault: DROPPED, Probability: 1}})
+	r := httptest.NewRequest(http.MethodDelete, "/admin/chaos", nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	server.AdminHandler(testAdminToken).ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || len(server.chaos.list()) > 0 {
+		t.Fatalf("got status: %d, rules: %v, want: %d and none", w.Code, server.chaos.list(), http.StatusNoContent)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and runs functions after a delay, so that the Cloud
+// can run on the system clock or on a VirtualClock driven by tests
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function call scheduled by a Clock
+type Timer interface {
+	// Stop prevents the call, returning false if it already happened or
+	// was stopped before
+	Stop() bool
+}
+
+// systemClock is the Clock of the real world
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// clockOrSystem returns the given clock, or the system clock if nil
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return systemClock{}
+	}
+	return clock
+}
+
+// VirtualClock is a Clock that only moves forward when told to, firing
+// the timers due on the way. Tests use it to drive transitions instantly
+// and reproducibly.
+type VirtualClock struct {
+	advancing sync.Mutex // serializes Advance calls
+	lock      sync.Mutex
+	now       time.Time
+	seq       int // number of timers created, to fire timers due at once in order
+	timers    []*virtualTimer
+}
+
+// virtualTimer is a function call scheduled on a VirtualClock
+type virtualTimer struct {
+	clock *VirtualClock
+	due   time.Time
+	seq   int
+	f     func()
+}
+
+// NewVirtualClock returns a VirtualClock set to the given time
+func NewVirtualClock(now time.Time) *VirtualClock {
+	return &VirtualClock{now: now}
+}
+
+// Now returns the virtual time
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// AfterFunc schedules f to be called once the clock advanced by d
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.seq++
+	t := &virtualTimer{clock: c, due: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	sort.Slice(c.timers, func(i, j int) bool {
+		a, b := c.timers[i], c.timers[j]
+		return a.due.Before(b.due) || (a.due.Equal(b.due) && a.seq < b.seq)
+	})
+	return t
+}
+
+// Stop removes the timer from its clock
+func (t *virtualTimer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, calling the functions of the timers
+// due on the way in order, at their due time. Timers set up by those calls
+// fire too if they are due before the end. Returns the number of timers fired.
+func (c *VirtualClock) Advance(d time.Duration) int {
+	c.advancing.Lock()
+	defer c.advancing.Unlock()
+
+	c.lock.Lock()
+	end := c.now.Add(d)
+	fired := 0
+	for len(c.timers) > 0 && !c.timers[0].due.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.due
+		c.lock.Unlock()
+		t.f() // without the lock, as it may set up or stop timers
+		fired++
+		c.lock.Lock()
+	}
+	c.now = end
+	c.lock.Unlock()
+	return fired
+}
+
+// Pending returns the number of timers yet to fire
+func (c *VirtualClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.timers)
+}
+
+// ClockStatus describes the clock of the Cloud
+type ClockStatus struct {
+	Now       time.Time `json:"now"`
+	TimeScale float64   `json:"timeScale"`       // Factor applied to all transition delays
+	Virtual   bool      `json:"virtual"`         // Whether time only moves on /admin/clock/advance
+	Pending   int       `json:"pending"`         // Timers yet to fire on a virtual clock
+	Fired     int       `json:"fired,omitempty"` // Timers fired by the last advance
+}
+
+// String on a ClockStatus dumps it in JSON format
+func (status ClockStatus) String() string {
+	statusJSON, err := json.Marshal(status)
+	dieOnError(err, "Can't generate JSON for ClockStatus object %#v", status)
+	return string(statusJSON)
+}
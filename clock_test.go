@@ -0,0 +1,46 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	clock := newTestClock()
+	var fired []string
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name+"@"+clock.Now().Sub(testStart).String())
+		}
+	}
+	clock.AfterFunc(2*time.Second, record("b"))
+	clock.AfterFunc(time.Second, func() {
+		record("a")()
+		clock.AfterFunc(time.Second, record("c")) // due along with b, but set up later
+	})
+	stopped := clock.AfterFunc(time.Second, record("never"))
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatalf("want Stop to be true only the first time")
+	}
+	clock.AfterFunc(time.Minute, record("late"))
+
+	if n := clock.Advance(500 * time.Millisecond); n != 0 {
+		t.Fatalf("got %d timers fired, want none", n)
+	}
+	if n := clock.Advance(2 * time.Second); n != 3 {
+		t.Fatalf("got %d timers fired, want: 3", n)
+	}
+	if want := []string{"a@1s", "b@2s", "c@2s"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("got: %v, want: %v", fired, want)
+	}
+	if got, want := clock.Now(), testStart.Add(2500*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("got now: %v, want: %v", got, want)
+	}
+	if got := clock.Pending(); got != 1 {
+		t.Fatalf("got %d pending timers, want: 1", got)
+	}
+}
@@ -4,8 +4,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"regexp"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,8 +17,109 @@ import (
 // Cloud can perform concurrent-safe operations on a bunch of VMs:
 // List all VMs, inspect a VM, start/stop a VM or remove it from the list
 type Cloud struct {
-	lock sync.RWMutex
-	vms  VMs
+	lock   sync.RWMutex
+	vms    VMs
+	nextID int    // next id handed out by Create, ids are never reused
+	limits Limits // bounds for VM hardware specs on Create and Resize
+
+	// persist is called within the lock on every mutation when set
+	persist func(vms VMs, nextID int) error
+
+	// events get published within the lock on every mutation
+	events eventBroker
+
+	// ops tracks the operations performing lifecycle actions
+	ops operationRegistry
+
+	// pending transitions in progress by VM id
+	pending map[int]*transition
+
+	// faults decides which transitions fail
+	faults faultInjector
+
+	// transitions completed, for metrics
+	transitions transitionMetrics
+
+	// telemetry of the VMs, as their guests would report it
+	telemetry telemetryGenerator
+
+	// console output of the VMs, as their guests would write it
+	console consoleRecorder
+
+	// journal audits the API mutations and the VM transitions
+	journal journal
+
+	// clock runs the delayed transitions
+	clock Clock
+
+	// timeScale multiplies all transition delays
+	timeScale float64
+
+	// delays override the lifecycle ones by action kind, for all VMs
+	delays map[OperationKind]DelayRange
+
+	// initial VMs the Cloud was created with, for Reset
+	initial VMs
+
+	// snapshots of the VMs saved by name
+	snapshots map[string]Snapshot
+}
+
+// Snapshot is a copy of all VMs saved under a name, to restore later on
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	VMs     VMs       `json:"vms"`
+}
+
+// String on a Snapshot dumps it in JSON format
+func (snapshot Snapshot) String() string {
+	snapshotJSON, err := json.Marshal(snapshot)
+	dieOnError(err, "Can't generate JSON for Snapshot object %#v", snapshot)
+	return string(snapshotJSON)
+}
+
+// Snapshots defines a list of Snapshots with attached methods
+type Snapshots []Snapshot
+
+// String on Snapshots dumps the list in JSON format
+func (snapshots Snapshots) String() string {
+	snapshotsJSON, err := json.Marshal(snapshots)
+	dieOnError(err, "Can't generate JSON for Snapshot objects %#v", snapshots)
+	return string(snapshotsJSON)
+}
+
+// snapshotName is what snapshot names look like, as they go in paths
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// transition is a delayed transition in progress on a VM
+type transition struct {
+	op      *Operation
+	from    VMState // stable state to roll back to on cancellation, if any
+	to      VMState // final state once the delay passes
+	timer   Timer
+	started time.Time // when the transition started
+	due     time.Time // when the timer fires
+}
+
+// NewCloud returns a Cloud handling the given VMs
+func NewCloud(vms VMs) *Cloud {
+	c := &Cloud{
+		vms:       vms,
+		limits:    DefaultLimits,
+		pending:   make(map[int]*transition),
+		clock:     systemClock{},
+		timeScale: 1,
+		initial:   vms.clone(),
+		snapshots: make(map[string]Snapshot),
+	}
+	for id := range vms {
+		if id >= c.nextID {
+			c.nextID = id + 1
+		}
+	}
+	c.telemetry.reset(vms, c.clock.Now())
+	return c
 }
 
 // List the VMs handled under this Cloud
@@ -22,7 +127,13 @@ func (c *Cloud) List() VMs {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	return c.vms.clone()
+	vms := c.vms.clone()
+	for id, t := range c.pending {
+		if vm, found := vms[id]; found {
+			vms[id] = t.report(vm)
+		}
+	}
+	return vms
 }
 
 // Inspect a VM data by id (might not find it and return nil)
@@ -31,27 +142,528 @@ func (c *Cloud) Inspect(id int) (VM, bool) {
 	defer c.lock.RUnlock()
 
 	vm, found := c.vms[id]
+	if t, pending := c.pending[id]; found && pending {
+		vm = t.report(vm)
+	}
 	return vm, found
 }
 
+// SetLimits changes the bounds for VM hardware specs on Create and Resize
+func (c *Cloud) SetLimits(limits Limits) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.limits = limits
+}
+
+// UseClock makes the Cloud run its delayed transitions, and stamp its
+// operations and events, with the given clock.
+// Must be called before any transition starts.
+func (c *Cloud) UseClock(clock Clock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clock = clock
+	c.ops.useClock(clock)
+	c.events.useClock(clock)
+	c.journal.useClock(clock)
+	c.telemetry.reset(c.vms, clock.Now())
+	c.console.reset()
+}
+
+// Now returns the time on the clock of the Cloud
+func (c *Cloud) Now() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.clock.Now()
+}
+
+// ClockStatus describes the clock the Cloud runs on
+func (c *Cloud) ClockStatus() ClockStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	status := ClockStatus{Now: c.clock.Now(), TimeScale: c.timeScale}
+	if virtual, ok := c.clock.(*VirtualClock); ok {
+		status.Virtual = true
+		status.Pending = virtual.Pending()
+	}
+	return status
+}
+
+// SetDelays overrides the delays of the lifecycle actions for all VMs,
+// by action kind. The delays set on a VM itself still win.
+func (c *Cloud) SetDelays(delays map[OperationKind]DelayRange) error {
+	for kind, delay := range delays {
+		if _, found := currentRules().actions[kind]; !found {
+			return newError(ValidationFailed, "delays error: unknown action %q", kind)
+		}
+		if !delay.valid() {
+			return newError(ValidationFailed, "delays error: bad %s delay range [%v, %v]", kind, delay.Min, delay.Max)
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.delays = delays
+	return nil
+}
+
+// delayFor picks a random delay for the action of the given kind on the VM,
+// within the range set on the VM, the overrides for all VMs or the
+// lifecycle, in that order.
+// Must be called holding the lock.
+func (c *Cloud) delayFor(vm VM, kind OperationKind, action Action) time.Duration {
+	if delay := vm.delayFor(kind); delay != nil {
+		return delay.Duration()
+	}
+	if delay, found := c.delays[kind]; found {
+		return delay.Duration()
+	}
+	return action.Delay.Duration()
+}
+
+// SetTimeScale makes all transition delays last scale times their nominal
+// duration, such as 0.01 for fast demos or 10 to debug UIs in slow motion.
+// The transitions in progress are rescheduled, keeping the share of their
+// delay already elapsed.
+func (c *Cloud) SetTimeScale(scale float64) error {
+	if scale <= 0 {
+		return newError(ValidationFailed, "clock error: time scale must be a positive number")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.clock.Now()
+	for _, id := range c.vms.ids() { // in order, so that timers due together fire alike on every run
+		t, found := c.pending[id]
+		if !found {
+			continue
+		}
+		if !t.timer.Stop() {
+			continue // about to complete, waiting for the lock
+		}
+		left := t.due.Sub(now)
+		if left < 0 {
+			left = 0
+		}
+		c.schedule(t, time.Duration(float64(left)*scale/c.timeScale))
+	}
+	c.timeScale = scale
+	return nil
+}
+
+// AdvanceClock moves a virtual clock forward by d, completing the
+// transitions due on the way.
+// An error is returned if the Cloud runs on the system clock.
+func (c *Cloud) AdvanceClock(d time.Duration) (ClockStatus, error) {
+	c.lock.RLock()
+	virtual, ok := c.clock.(*VirtualClock)
+	c.lock.RUnlock()
+	if !ok {
+		return ClockStatus{}, newError(Conflict, "clock error: can't advance the system clock, use a virtual clock")
+	}
+	if d < 0 {
+		return ClockStatus{}, newError(ValidationFailed, "clock error: can't go back in time by %v", d)
+	}
+	fired := virtual.Advance(d) // without the lock, as transitions complete
+	status := c.ClockStatus()
+	status.Fired = fired
+	return status, nil
+}
+
+// PersistWith makes the Cloud call save with the whole VM list, and the
+// next id to hand out, after every mutation, so that its state survives
+// restarts. The current state is saved right away.
+func (c *Cloud) PersistWith(save func(vms VMs, nextID int) error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.persist = save
+	return c.persist(c.vms, c.nextID)
+}
+
+// ReserveIDs makes the Cloud hand out ids from nextID on, unless it is past
+// it already, such as when restoring the next id persisted before a restart
+// along with the VMs.
+func (c *Cloud) ReserveIDs(nextID int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if nextID > c.nextID {
+		c.nextID = nextID
+	}
+}
+
+// ResumeTransitions settles VMs caught in the middle of a transition,
+// for instance when the process died while they were Starting or Stopping.
+// The policy is to resume them: each one gets a fresh delay to reach the
+// state it was transitioning to, as if the operation was just requested.
+func (c *Cloud) ResumeTransitions() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.resumeTransitions()
+}
+
+// resumeTransitions resumes the transitions of VMs in transitional states
+// with no transition pending, by VM id then in lifecycle order, so that
+// runs with the same seed resume them alike.
+// Must be called holding the write lock.
+func (c *Cloud) resumeTransitions() {
+	r := currentRules()
+	kinds := append([]OperationKind{PROVISION}, r.kinds...)
+	for _, id := range c.vms.ids() {
+		vm := c.vms[id]
+		if _, found := c.pending[id]; found {
+			continue
+		}
+		for _, kind := range kinds {
+			action := r.actions[kind]
+			if vm.State != action.Via || action.Via == action.To {
+				continue // not in the middle of this action, if it has any
+			}
+			var from VMState
+			if len(action.From) > 0 {
+				from = action.From[0]
+			}
+			log.Printf("Resuming %s of VM %d", kind, id)
+			c.delayedTransition(c.ops.start(id, kind), from, action.To, c.delayFor(vm, kind, action))
+			break
+		}
+	}
+}
+
+// State returns all VMs as they are stored, with nothing but their specs
+// and states
+func (c *Cloud) State() VMs {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.vms.clone()
+}
+
+// StateCounts returns the number of VMs in each state
+func (c *Cloud) StateCounts() map[VMState]int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	counts := make(map[VMState]int)
+	for _, vm := range c.vms {
+		counts[vm.State]++
+	}
+	return counts
+}
+
+// SetState replaces all VMs at once after validating them, cancelling the
+// transitions in progress. VMs in transitional states get their transitions
+// resumed, as on restarts.
+func (c *Cloud) SetState(vms VMs) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for id, vm := range vms {
+		if err := vm.validateSpecs(); err != nil {
+			return newError(ValidationFailed, "invalid state: VM %d: %v", id, err)
+		}
+		if err := vm.validateDelays(); err != nil {
+			return newError(ValidationFailed, "invalid state: VM %d: %v", id, err)
+		}
+		if err := c.limits.Check(vm); err != nil {
+			return newError(ValidationFailed, "invalid state: VM %d: %v", id, err)
+		}
+	}
+	if err := checkStates(vms); err != nil {
+		return newError(ValidationFailed, "invalid state: %v", err)
+	}
+	return c.replace(vms)
+}
+
+// Reset replaces all VMs with the ones the Cloud was created with,
+// as SetState does
+func (c *Cloud) Reset() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.replace(c.initial)
+}
+
+// Snapshot saves a copy of all VMs under the given name, replacing any
+// snapshot with the same name
+func (c *Cloud) Snapshot(name string) (Snapshot, error) {
+	if !snapshotName.MatchString(name) {
+		return Snapshot{}, newError(ValidationFailed, "invalid snapshot name %q, want letters, digits, '.', '_' or '-'", name)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	snapshot := Snapshot{Name: name, Created: c.clock.Now(), VMs: c.vms.clone()}
+	c.snapshots[name] = snapshot
+	return snapshot, nil
+}
+
+// Snapshots lists the snapshots saved, sorted by name
+func (c *Cloud) Snapshots() Snapshots {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	snapshots := make(Snapshots, 0, len(c.snapshots))
+	for _, snapshot := range c.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots
+}
+
+// Restore replaces all VMs with the ones saved in the named snapshot,
+// as SetState does
+func (c *Cloud) Restore(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	snapshot, found := c.snapshots[name]
+	if !found {
+		return newError(NotFound, "not found snapshot %q", name)
+	}
+	return c.replace(snapshot.VMs)
+}
+
+// replace cancels all transitions in progress and replaces all VMs with
+// the given ones, publishing their deletion and creation, then resumes the
+// transitions of the VMs in transitional states.
+// Ids are still never reused for new VMs.
+// Nothing changes if the new VMs can't be persisted.
+// Must be called holding the write lock.
+func (c *Cloud) replace(vms VMs) error {
+	old, oldNextID := c.vms, c.nextID
+	c.vms = make(VMs, len(vms))
+	for id, vm := range vms {
+		vm.Due = nil
+		c.vms[id] = vm
+		if id >= c.nextID {
+			c.nextID = id + 1
+		}
+	}
+	if err := c.commit(); err != nil {
+		c.vms, c.nextID = old, oldNextID
+		return err
+	}
+	for id, t := range c.pending {
+		t.timer.Stop()
+		delete(c.pending, id)
+		c.ops.cancel(t.op)
+	}
+	for _, id := range old.ids() {
+		c.publish(Event{Type: DELETED, VMID: id, OldState: old[id].State})
+	}
+	for _, id := range c.vms.ids() {
+		c.publish(Event{Type: CREATED, VMID: id, NewState: c.vms[id].State})
+	}
+	c.resumeTransitions()
+	return nil
+}
+
+// Create adds a new VM after validating its specs.
+// Returns the newly allocated id, which is never handed out again
+// even if the VM gets deleted later on.
+// The VM is Provisioning until it gets Stopped after a while.
+func (c *Cloud) Create(vm VM) (int, VM, error) {
+	op, vm, err := c.CreateOperation(vm)
+	return op.VMID, vm, err
+}
+
+// CreateOperation adds a new VM like Create does.
+// Returns the provision operation tracking the new VM id, and the VM.
+func (c *Cloud) CreateOperation(vm VM) (Operation, VM, error) {
+	if err := vm.Validate(); err != nil {
+		return Operation{}, VM{}, err
+	}
+	provision := currentRules().actions[PROVISION]
+	vm.State = provision.Via
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.limits.Check(vm); err != nil {
+		return Operation{}, VM{}, err
+	}
+	id := c.nextID
+	c.nextID++
+	c.vms[id] = vm
+	if err := c.commit(); err != nil {
+		delete(c.vms, id)
+		c.nextID--
+		return Operation{}, VM{}, err
+	}
+	c.publish(Event{Type: CREATED, VMID: id, NewState: vm.State})
+	op := c.ops.start(id, PROVISION)
+	c.delayedTransition(op, "", provision.To, c.delayFor(vm, PROVISION, provision))
+	return *op, c.pending[id].report(vm), nil
+}
+
+// Resize changes the hardware specs of a VM by id, as long as the patch
+// follows the rules of VM.WithPatch.
+// Returns the resized VM.
+func (c *Cloud) Resize(id int, patch VMPatch) (VM, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	vm, found := c.vms[id]
+	if !found {
+		return VM{}, newError(NotFound, "not found VM with id %d", id)
+	}
+	resizedVM, err := vm.WithPatch(patch, c.limits)
+	if err != nil {
+		return VM{}, err
+	}
+	c.vms[id] = resizedVM
+	if err := c.commit(); err != nil {
+		c.vms[id] = vm
+		return VM{}, err
+	}
+	c.publish(Event{Type: RESIZED, VMID: id, OldState: vm.State, NewState: vm.State})
+	return resizedVM, nil
+}
+
 // Launch a VM by id.
 // The return includes a channel to optionally check completion of the launch
 // process, apart from a possible error.
-func (c *Cloud) Launch(id int) (chan struct{}, error) {
-	if err := c.setVMState(id, STARTING); err != nil {
+func (c *Cloud) Launch(id int) (<-chan struct{}, error) {
+	op, err := c.LaunchOperation(id)
+	if err != nil {
 		return nil, err
 	}
-	return c.delayedTransition(id, RUNNING, StartDelay()), nil
+	return op.Done(), nil
+}
+
+// LaunchOperation launches a VM by id.
+// Returns the operation tracking the launch process.
+func (c *Cloud) LaunchOperation(id int) (Operation, error) {
+	return c.StartOperation(id, LAUNCH)
 }
 
 // Stop a VM by id.
 // The return includes a channel to optionally check completion of the stop
 // process, apart from a possible error.
-func (c *Cloud) Stop(id int) (chan struct{}, error) {
-	if err := c.setVMState(id, STOPPING); err != nil {
+func (c *Cloud) Stop(id int) (<-chan struct{}, error) {
+	op, err := c.StopOperation(id)
+	if err != nil {
 		return nil, err
 	}
-	return c.delayedTransition(id, STOPPED, StopDelay()), nil
+	return op.Done(), nil
+}
+
+// StopOperation stops a VM by id.
+// Returns the operation tracking the stop process.
+func (c *Cloud) StopOperation(id int) (Operation, error) {
+	return c.StartOperation(id, STOP)
+}
+
+// StartOperation performs the lifecycle action of the given kind on a VM
+// by id, such as suspending, resuming or rebooting it.
+// Returns the operation tracking the transition.
+func (c *Cloud) StartOperation(id int, kind OperationKind) (Operation, error) {
+	action, found := currentRules().actions[kind]
+	if !found || kind == PROVISION {
+		return Operation{}, newError(BadRequest, "unknown operation kind %q", kind)
+	}
+	return c.startTransition(id, kind, action)
+}
+
+// Cancel aborts the transition in progress on a VM by id, rolling the VM
+// back to the stable state it was in before the transition started.
+// Returns the cancelled operation.
+func (c *Cloud) Cancel(id int) (Operation, error) {
+	c.lock.Lock()
+	if _, found := c.vms[id]; !found {
+		c.lock.Unlock()
+		return Operation{}, newError(NotFound, "not found VM with id %d", id)
+	}
+	t, found := c.pending[id]
+	if !found {
+		c.lock.Unlock()
+		return Operation{}, newError(Conflict, "cancel error: VM %d has no transition in progress", id)
+	}
+	if t.from == "" {
+		c.lock.Unlock()
+		return Operation{}, newError(Conflict, "cancel error: %s of VM %d can't be cancelled", t.op.Kind, id)
+	}
+	if err := c.rollback(t); err != nil {
+		c.lock.Unlock()
+		return Operation{}, err
+	}
+	c.lock.Unlock()
+
+	return c.ops.cancel(t.op), nil
+}
+
+// CancelOperation aborts an operation in progress by id, rolling its VM
+// back to the stable state it was in before the operation started.
+// Returns the cancelled operation.
+func (c *Cloud) CancelOperation(opID int) (Operation, error) {
+	op, found := c.ops.get(opID)
+	if !found {
+		return Operation{}, newError(NotFound, "not found operation with id %d", opID)
+	}
+	c.lock.Lock()
+	t, found := c.pending[op.VMID]
+	if !found || t.op.ID != opID {
+		c.lock.Unlock()
+		return Operation{}, newError(Conflict, "cancel error: operation %d is not in progress", opID)
+	}
+	if t.from == "" {
+		c.lock.Unlock()
+		return Operation{}, newError(Conflict, "cancel error: %s operation %d can't be cancelled", t.op.Kind, opID)
+	}
+	if err := c.rollback(t); err != nil {
+		c.lock.Unlock()
+		return Operation{}, err
+	}
+	c.lock.Unlock()
+
+	return c.ops.cancel(t.op), nil
+}
+
+// SetFaults validates and replaces all the rules making transitions fail
+func (c *Cloud) SetFaults(rules FaultRules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	c.faults.set(rules)
+	return nil
+}
+
+// AddFault validates and appends a rule making transitions fail
+func (c *Cloud) AddFault(rule FaultRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	c.faults.add(rule)
+	return nil
+}
+
+// Faults lists the rules making transitions fail, in the order they apply
+func (c *Cloud) Faults() FaultRules {
+	return c.faults.list()
+}
+
+// SeedFaults restarts the rolls deciding which transitions fail from the
+// given seed, so that runs with the same seed fail the same transitions
+func (c *Cloud) SeedFaults(seed int64) {
+	c.faults.seed(seed)
+}
+
+// Operations lists all operations still tracked
+func (c *Cloud) Operations() Operations {
+	return c.ops.list()
+}
+
+// Operation inspects an operation by id
+func (c *Cloud) Operation(id int) (Operation, bool) {
+	return c.ops.get(id)
 }
 
 // Delete VM by id.
@@ -62,27 +674,222 @@ func (c *Cloud) Delete(id int) error {
 
 	vm, found := c.vms[id]
 	if !found {
-		return fmt.Errorf("delete error: not found VM %d", id)
+		return newError(NotFound, "delete error: not found VM %d", id)
 	}
 	if vm.State != STOPPED {
-		return fmt.Errorf("delete error: VM %d must be in state %v for deletion but it is %v", id, STOPPED, vm.State)
+		return newError(Conflict, "delete error: VM %d must be in state %v for deletion but it is %v", id, STOPPED, vm.State)
 	}
 	delete(c.vms, id)
+	if err := c.commit(); err != nil {
+		c.vms[id] = vm
+		return err
+	}
+	if t, found := c.pending[id]; found {
+		// Only a forced state could leave one behind, make sure it goes away
+		t.timer.Stop()
+		delete(c.pending, id)
+		c.ops.finish(t.op, newError(Conflict, "VM %d was deleted", id))
+	}
+	c.publish(Event{Type: DELETED, VMID: id, OldState: vm.State})
 	return nil
 }
 
+// Telemetry returns the telemetry samples of a VM by id within [from, to],
+// oldest first
+func (c *Cloud) Telemetry(id int, from, to time.Time) (TelemetrySamples, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	samples, found := c.telemetry.between(id, from, to, c.clock.Now())
+	if !found {
+		return nil, newError(NotFound, "not found VM with id %d", id)
+	}
+	return samples, nil
+}
+
+// Console returns up to limit bytes of the serial console output of a VM by
+// id from the given byte offset on, all of it if limit is 0
+func (c *Cloud) Console(id, offset, limit int) (ConsoleOutput, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if _, found := c.vms[id]; !found {
+		return ConsoleOutput{}, newError(NotFound, "not found VM with id %d", id)
+	}
+	return c.console.read(id, offset, limit, c.clock.Now()), nil
+}
+
+// Audit records an entry in the journal of the Cloud
+func (c *Cloud) Audit(e AuditEntry) {
+	c.journal.record(e)
+}
+
+// AuditLog returns the entries kept in the journal matching the filter,
+// oldest first
+func (c *Cloud) AuditLog(filter auditFilter) AuditEntries {
+	return c.journal.query(filter)
+}
+
+// MirrorAudit writes every entry recorded in the journal from now on to w,
+// as JSON lines, in the background
+func (c *Cloud) MirrorAudit(w io.Writer) {
+	c.journal.mirrorTo(w)
+}
+
+// FlushAudit waits for the entries recorded so far to be written to the
+// writer given to MirrorAudit
+func (c *Cloud) FlushAudit() {
+	c.journal.flush()
+}
+
+// Subscribe to the stream of changes on VMs, returning a channel of events,
+// the past events after sequence number since still kept in history,
+// and a function to cancel the subscription.
+// The channel gets closed if the subscriber can't keep up with the events.
+func (c *Cloud) Subscribe(since uint64) (<-chan Event, []Event, func()) {
+	return c.events.subscribe(since)
+}
+
+// startTransition moves the VM identified by id to the Via state of the
+// action and sets up a delayed transition to its To state, tracked by a
+// new operation.
+func (c *Cloud) startTransition(id int, kind OperationKind, action Action) (Operation, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	vm, found := c.vms[id]
+	if !found {
+		return Operation{}, newError(NotFound, "not found VM with id %d", id)
+	}
+	if !action.startsFrom(vm.State) {
+		return Operation{}, newError(IllegalTransition, "illegal transition from %q to %q", vm.State, action.Via)
+	}
+	if err := c.applyVMState(id, action.Via); err != nil {
+		return Operation{}, err
+	}
+	op := c.ops.start(id, kind)
+	c.delayedTransition(op, vm.State, action.To, c.delayFor(vm, kind, action))
+	// The operation can't finish before the lock is released
+	return *op, nil
+}
+
 // delayedTransition set ups a timer in the background to move the VM
-// identified by the given id to state after the given delay has passed.
-// Uses setVMState internally to handle a safe concurrent delayed transition.
-func (c *Cloud) delayedTransition(id int, state VMState, delay time.Duration) chan struct{} {
-	done := make(chan struct{})
-	time.AfterFunc(delay, func() {
-		if err := c.setVMState(id, state); err != nil {
-			log.Println(err)
-		}
-		close(done) // signal delayed transition completion
+// of the given operation to state to after the given delay has passed,
+// with the time scale applied.
+// The transition remains pending, and cancellable, until then.
+// The operation is finished once the transition is done.
+// Must be called holding the write lock.
+func (c *Cloud) delayedTransition(op *Operation, from, to VMState, delay time.Duration) {
+	t := &transition{op: op, from: from, to: to, started: c.clock.Now()}
+	c.pending[op.VMID] = t
+	c.schedule(t, time.Duration(float64(delay)*c.timeScale))
+}
+
+// schedule sets up the timer completing the transition after the given
+// effective delay, reporting when it is due on its operation.
+// Must be called holding the write lock.
+func (c *Cloud) schedule(t *transition, delay time.Duration) {
+	now := c.clock.Now()
+	t.due = now.Add(delay)
+	c.ops.schedule(t.op, t.due)
+	c.console.plan(t.op.VMID, c.vms[t.op.VMID], now, t.due)
+	t.timer = c.clock.AfterFunc(delay, func() {
+		c.completeTransition(t)
 	})
-	return done
+}
+
+// report returns the VM of the transition telling when it is due
+func (t *transition) report(vm VM) VM {
+	due := t.due
+	vm.Due = &due
+	return vm
+}
+
+// completeTransition moves the VM to the final state of the transition.
+// Uses the lock to handle a safe concurrent delayed transition, which is
+// a no-op if the transition is stale: cancelled or replaced by a newer one.
+func (c *Cloud) completeTransition(t *transition) {
+	c.lock.Lock()
+	if c.pending[t.op.VMID] != t {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.pending, t.op.VMID)
+	id := t.op.VMID
+	from := c.vms[id].State
+	var err error
+	if outcome, failed := c.faults.strike(id, t.op.Kind); failed {
+		err = c.fail(t, outcome)
+	}
+	if err == nil {
+		err = c.applyVMState(id, t.to)
+	}
+	if err != nil {
+		c.journal.record(AuditEntry{VMID: &id, Actor: SystemActor, Action: string(t.op.Kind), OldState: from, NewState: c.vms[id].State, Outcome: FAILURE, Error: err.Error()})
+	}
+	c.lock.Unlock()
+
+	c.transitions.observe(t.op.Kind, c.clock.Now().Sub(t.started), err != nil)
+
+	if err != nil {
+		log.Println(err)
+	}
+	c.ops.finish(t.op, err) // signal delayed transition completion
+}
+
+// fail ends a transition hit by a fault with the given outcome: its VM goes
+// to the failure state of the lifecycle, or back to the state it came from.
+// The other outcome is used when the lifecycle does not allow the one given.
+// Returns the error failing the operation, or nil if the transition can't
+// fail at all.
+// Must be called holding the write lock.
+func (c *Cloud) fail(t *transition, outcome FaultOutcome) error {
+	id := t.op.VMID
+	failure, canFail := currentRules().failures[c.vms[id].State]
+	canRollback := t.from != ""
+	switch {
+	case canFail && (outcome == ERRORED || !canRollback):
+		if err := c.applyVMState(id, failure); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s of VM %d failed: injected fault", t.op.Kind, id)
+	case canRollback:
+		if err := c.forceVMState(id, t.from); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s of VM %d failed and rolled back to %v: injected fault", t.op.Kind, id, t.from)
+	}
+	return nil
+}
+
+// rollback cancels a pending transition and moves its VM back to the state
+// it was in before, no matter what the allowed transitions are.
+// The transition goes on if the VM state can't be persisted.
+// Must be called holding the write lock.
+func (c *Cloud) rollback(t *transition) error {
+	if err := c.forceVMState(t.op.VMID, t.from); err != nil {
+		return err
+	}
+	t.timer.Stop()
+	delete(c.pending, t.op.VMID)
+	return nil
+}
+
+// forceVMState sets the VM identified by the given id to the given state,
+// no matter what the allowed transitions are.
+// Must be called holding the write lock.
+func (c *Cloud) forceVMState(id int, state VMState) error {
+	vm := c.vms[id]
+	oldState := vm.State
+	vm.State = state
+	c.vms[id] = vm
+	if err := c.commit(); err != nil {
+		vm.State = oldState
+		c.vms[id] = vm
+		return err
+	}
+	c.publish(Event{Type: TRANSITIONED, VMID: id, OldState: oldState, NewState: vm.State})
+	return nil
 }
 
 // setVMState sets the VM identified by the given id to the given state.
@@ -92,14 +899,64 @@ func (c *Cloud) setVMState(id int, state VMState) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	return c.applyVMState(id, state)
+}
+
+// applyVMState does the work of setVMState.
+// Must be called holding the write lock.
+func (c *Cloud) applyVMState(id int, state VMState) error {
 	vm, found := c.vms[id]
 	if !found {
-		return fmt.Errorf("not found VM with id %d", id)
+		return newError(NotFound, "not found VM with id %d", id)
 	}
 	mutatedVM, err := vm.WithState(state)
 	if err != nil {
 		return err
 	}
+	if mutatedVM.State == vm.State {
+		return nil // NOP
+	}
 	c.vms[id] = mutatedVM
+	if err := c.commit(); err != nil {
+		c.vms[id] = vm
+		return err
+	}
+	c.publish(Event{Type: TRANSITIONED, VMID: id, OldState: vm.State, NewState: mutatedVM.State})
+	return nil
+}
+
+// publish sends the event to the subscribers, after bringing the telemetry
+// and console of the VM that changed up to date.
+// Must be called holding the write lock, right after each mutation.
+func (c *Cloud) publish(e Event) {
+	now := c.clock.Now()
+	if vm, found := c.vms[e.VMID]; found {
+		c.telemetry.update(e.VMID, &vm, now)
+		c.console.update(e.VMID, &vm, e.OldState, now)
+	} else {
+		c.telemetry.update(e.VMID, nil, now)
+		c.console.update(e.VMID, nil, e.OldState, now)
+	}
+	if action, found := eventActions[e.Type]; found {
+		id := e.VMID
+		c.journal.record(AuditEntry{VMID: &id, Actor: SystemActor, Action: action, OldState: e.OldState, NewState: e.NewState, Outcome: SUCCESS})
+	}
+	c.events.publish(e)
+}
+
+// commit persists the VMs list, if persistence was requested.
+// Callers undo their mutation on error, so that clients never see a change
+// that would not survive a restart. This is why the write happens holding
+// the lock, making every request wait on the disk with --persist: the
+// change can't be seen before it is known to be written.
+// Must be called holding the write lock, right after each mutation.
+func (c *Cloud) commit() error {
+	if c.persist == nil {
+		return nil
+	}
+	if err := c.persist(c.vms, c.nextID); err != nil {
+		log.Printf("error persisting VMs state: %v", err)
+		return newError(Internal, "error persisting VMs state: %v", err)
+	}
 	return nil
 }
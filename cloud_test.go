@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
@@ -29,8 +30,8 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func NewDefaultCloud() Cloud {
-	return Cloud{vms: defaultVMs.clone()}
+func NewDefaultCloud() *Cloud {
+	return NewCloud(defaultVMs.clone())
 }
 
 // copyInState gets a copy of the VM identified by id from cloud,
@@ -54,13 +55,32 @@ func forceState(cloud *Cloud, id int, state VMState) error {
 	return nil
 }
 
+// inTransition tells whether got is want, along with when its transition
+// in progress is due
+func inTransition(got, want VM) bool {
+	due := got.Due
+	got.Due = nil
+	return due != nil && got == want
+}
+
 // shrinkTime sets up shorter delays time units so that test can go faster
 func shrinkTime() {
 	timeUnit = time.Millisecond
 }
 
+// testVM holds the specs of a small VM, to be created in tests
+var testVM = VM{VCPUS: 1, Clock: 1500, RAM: 4096, Storage: 128, Network: 1000}
+
+// testStart is the time virtual clocks of tests start at
+var testStart = time.Date(2020, 11, 10, 9, 0, 0, 0, time.UTC)
+
+// newTestClock returns a virtual clock set to testStart
+func newTestClock() *VirtualClock {
+	return NewVirtualClock(testStart)
+}
+
 // waitDone waits for a done channel to finish or a timeout to occur
-func waitDone(done chan struct{}, timeout time.Duration) error {
+func waitDone(done <-chan struct{}, timeout time.Duration) error {
 	timeoutChannel := time.After(timeout)
 	select {
 	case <-done:
@@ -99,7 +119,7 @@ func TestLaunch(t *testing.T) {
 	shrinkTime()
 	c := NewDefaultCloud()
 	// Test 1st transition
-	want, err := copyInState(&c, GoodID, STARTING)
+	want, err := copyInState(c, GoodID, STARTING)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -107,14 +127,14 @@ func TestLaunch(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to Launch VM %d: %v", GoodID, err)
 	}
-	if got, _ := c.Inspect(GoodID); got != want {
-		t.Fatalf("got: %s, want: %s", got, want)
+	if got, _ := c.Inspect(GoodID); !inTransition(got, want) {
+		t.Fatalf("got: %s, want: %s in transition", got, want)
 	}
 	// Wait and test 2nd transition
 	if err := waitDone(done, 10*DefaultStartDelay*timeUnit); err != nil {
 		t.Fatal(err)
 	}
-	want2, err := copyInState(&c, GoodID, RUNNING)
+	want2, err := copyInState(c, GoodID, RUNNING)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,7 +154,7 @@ func TestBadVMLaunch(t *testing.T) {
 func TestBadStateLaunch(t *testing.T) {
 	c := NewDefaultCloud()
 	var badState VMState = RUNNING
-	if err := forceState(&c, GoodID, badState); err != nil {
+	if err := forceState(c, GoodID, badState); err != nil {
 		t.Fatal(err)
 	}
 	want := fmt.Sprintf("illegal transition from %q to %q", badState, STARTING)
@@ -146,9 +166,9 @@ func TestBadStateLaunch(t *testing.T) {
 func TestStop(t *testing.T) {
 	shrinkTime()
 	c := NewDefaultCloud()
-	forceState(&c, GoodID, RUNNING)
+	forceState(c, GoodID, RUNNING)
 	// Test 1st transition
-	want, err := copyInState(&c, GoodID, STOPPING)
+	want, err := copyInState(c, GoodID, STOPPING)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -156,14 +176,14 @@ func TestStop(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to Stop VM %d: %v", GoodID, err)
 	}
-	if got, _ := c.Inspect(GoodID); got != want {
-		t.Fatalf("got: %v, want: %v", got, want)
+	if got, _ := c.Inspect(GoodID); !inTransition(got, want) {
+		t.Fatalf("got: %v, want: %v in transition", got, want)
 	}
 	// Wait and test 2nd transition
 	if err := waitDone(done, 10*DefaultStopDelay*timeUnit); err != nil {
 		t.Fatal(err)
 	}
-	want2, err := copyInState(&c, GoodID, STOPPED)
+	want2, err := copyInState(c, GoodID, STOPPED)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -219,9 +239,654 @@ func TestReDelete(t *testing.T) {
 func TestBadStateDelete(t *testing.T) {
 	c := NewDefaultCloud()
 	badState := RUNNING // not allowed to delete in this state
-	forceState(&c, GoodID, badState)
+	forceState(c, GoodID, badState)
 	want := fmt.Sprintf("delete error: VM %d must be in state %v for deletion but it is %v", GoodID, STOPPED, badState)
 	if got := c.Delete(GoodID); got == nil || got.Error() != want {
 		t.Fatalf("got: %q, want: %q", got, want)
 	}
 }
+
+func TestCreate(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	newVM := *VMInState("")
+	op, got, err := c.CreateOperation(newVM)
+	if err != nil {
+		t.Fatalf("Failed to Create VM %v: %v", newVM, err)
+	}
+	id := op.VMID
+	if want := len(defaultVMs); id != want {
+		t.Fatalf("got id: %d, want: %d", id, want)
+	}
+	if op.Kind != PROVISION || op.Status != PENDING {
+		t.Fatalf("got: %v, want a pending provision of VM %d", op, id)
+	}
+	want := *VMInState(PROVISIONING)
+	if !inTransition(got, want) {
+		t.Fatalf("got: %v, want: %v in transition", got, want)
+	}
+	if inspected, _ := c.Inspect(id); !inTransition(inspected, want) {
+		t.Fatalf("got: %v, want: %v in transition", inspected, want)
+	}
+	if err := waitDone(op.Done(), 10*DefaultProvisionDelay*timeUnit); err != nil {
+		t.Fatal(err)
+	}
+	if inspected, _ := c.Inspect(id); inspected != *VMInState(STOPPED) {
+		t.Fatalf("got: %v, want: %v", inspected, *VMInState(STOPPED))
+	}
+}
+
+func TestCancelProvision(t *testing.T) {
+	c := NewDefaultCloud()
+	op, _, err := c.CreateOperation(*VMInState(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("cancel error: provision of VM %d can't be cancelled", op.VMID)
+	if _, got := c.Cancel(op.VMID); got == nil || got.Error() != want {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+	want = fmt.Sprintf("cancel error: provision operation %d can't be cancelled", op.ID)
+	if _, got := c.CancelOperation(op.ID); got == nil || got.Error() != want {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+}
+
+func TestCreateNeverReusesIDs(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	op, _, err := c.CreateOperation(*VMInState(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := op.VMID
+	if err := waitDone(op.Done(), 10*DefaultProvisionDelay*timeUnit); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	newID, _, err := c.Create(*VMInState(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == id {
+		t.Fatalf("got reused id: %d, want a new one", newID)
+	}
+}
+
+func TestBadCreate(t *testing.T) {
+	c := NewDefaultCloud()
+	badVM := *VMInState(STOPPED)
+	badVM.RAM = 0
+	want := "invalid VM: ram must be a positive number"
+	if _, _, got := c.Create(badVM); got == nil || got.Error() != want {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+	if got := len(c.List()); got != len(defaultVMs) {
+		t.Fatalf("got %d VMs, want: %d", got, len(defaultVMs))
+	}
+}
+
+func TestPersistWith(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	var saved []VMs
+	if err := c.PersistWith(func(vms VMs, nextID int) error {
+		saved = append(saved, vms.clone())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	done, err := c.Launch(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(done, 10*DefaultStartDelay*timeUnit); err != nil {
+		t.Fatal(err)
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	wantStates := []VMState{STOPPED, STARTING, RUNNING}
+	if len(saved) != len(wantStates) {
+		t.Fatalf("got %d saves, want: %d", len(saved), len(wantStates))
+	}
+	for i, want := range wantStates {
+		if got := saved[i][GoodID].State; got != want {
+			t.Fatalf("save #%d got: %v, want: %v", i, got, want)
+		}
+	}
+}
+
+func TestPersistedIDsSurviveRestarts(t *testing.T) {
+	var saved []byte
+	save := func(vms VMs, nextID int) error {
+		var err error
+		saved, err = json.Marshal(Fixture{VMs: vms, NextID: nextID})
+		return err
+	}
+	restart := func() *Cloud {
+		var fixture Fixture
+		if err := json.Unmarshal(saved, &fixture); err != nil {
+			t.Fatal(err)
+		}
+		c := NewCloud(fixture.VMs)
+		c.UseClock(newTestClock())
+		c.ReserveIDs(fixture.NextID)
+		if err := c.PersistWith(save); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c := NewDefaultCloud()
+	c.UseClock(newTestClock())
+	if err := c.PersistWith(save); err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := c.Create(testVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AdvanceClock(time.Duration(10*DefaultProvisionDelay) * timeUnit)
+	if err := c.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	c = restart()
+	got, _, err := c.Create(testVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id+1 {
+		t.Fatalf("got id: %d after a restart, want: %d, not reusing the deleted %d", got, id+1, id)
+	}
+}
+
+func TestPersistFailuresUndoMutations(t *testing.T) {
+	c := NewDefaultCloud()
+	c.UseClock(newTestClock())
+	broken := false
+	if err := c.PersistWith(func(vms VMs, nextID int) error {
+		if broken {
+			return fmt.Errorf("disk full")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	broken = true
+	newVM := testVM
+	storage := 1024
+	for name, mutate := range map[string]func() error{
+		"create": func() error { _, _, err := c.Create(newVM); return err },
+		"launch": func() error { _, err := c.LaunchOperation(GoodID); return err },
+		"resize": func() error { _, err := c.Resize(GoodID, VMPatch{Storage: &storage}); return err },
+		"delete": func() error { return c.Delete(GoodID) },
+		"reset":  func() error { return c.Reset() },
+	} {
+		if err := mutate(); errorCode(err) != Internal {
+			t.Errorf("%s: got: %v, want a %v error", name, err, Internal)
+		}
+		if got := c.State(); got.String() != defaultVMs.String() {
+			t.Fatalf("%s: got: %v, want the VMs unchanged: %v", name, got, defaultVMs)
+		}
+	}
+	if got := c.Operations(); len(got) != 0 {
+		t.Fatalf("got operations: %v, want none started", got)
+	}
+}
+
+func TestResumeTransitions(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	forceState(c, 0, STARTING)
+	forceState(c, GoodID, STOPPING)
+	forceState(c, 2, SUSPENDING)
+	c.ResumeTransitions()
+	if ops := c.Operations(); len(ops) != 3 || ops[0].VMID != 0 || ops[1].VMID != GoodID || ops[2].VMID != 2 {
+		t.Fatalf("got operations: %v, want one per VM, by id", ops)
+	}
+	deadline := time.Now().Add(10 * DefaultStartDelay * timeUnit)
+	for time.Now().Before(deadline) {
+		vm0, _ := c.Inspect(0)
+		vm1, _ := c.Inspect(GoodID)
+		vm2, _ := c.Inspect(2)
+		if vm0.State == RUNNING && vm1.State == STOPPED && vm2.State == SUSPENDED {
+			return
+		}
+		time.Sleep(timeUnit)
+	}
+	t.Fatalf("transitions were not resumed: %v", c.List())
+}
+
+var startOperationCases = []struct {
+	kind          OperationKind
+	from, via, to VMState
+	delay         time.Duration
+}{
+	{kind: LAUNCH, from: STOPPED, via: STARTING, to: RUNNING, delay: DefaultStartDelay},
+	{kind: STOP, from: RUNNING, via: STOPPING, to: STOPPED, delay: DefaultStopDelay},
+	{kind: STOP, from: SUSPENDED, via: STOPPING, to: STOPPED, delay: DefaultStopDelay},
+	{kind: STOP, from: ERROR, via: STOPPING, to: STOPPED, delay: DefaultStopDelay},
+	{kind: SUSPEND, from: RUNNING, via: SUSPENDING, to: SUSPENDED, delay: DefaultSuspendDelay},
+	{kind: RESUME, from: SUSPENDED, via: RESUMING, to: RUNNING, delay: DefaultResumeDelay},
+	{kind: REBOOT, from: RUNNING, via: REBOOTING, to: RUNNING, delay: DefaultRebootDelay},
+}
+
+func TestStartOperation(t *testing.T) {
+	shrinkTime()
+	for _, tc := range startOperationCases {
+		c := NewDefaultCloud()
+		forceState(c, GoodID, tc.from)
+		op, err := c.StartOperation(GoodID, tc.kind)
+		if err != nil {
+			t.Fatalf("%s from %v: %v", tc.kind, tc.from, err)
+		}
+		if got, _ := c.Inspect(GoodID); got.State != tc.via {
+			t.Fatalf("%s from %v got: %v, want: %v", tc.kind, tc.from, got.State, tc.via)
+		}
+		if err := waitDone(op.Done(), 10*tc.delay*timeUnit); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := c.Inspect(GoodID); got.State != tc.to {
+			t.Fatalf("%s from %v got: %v, want: %v", tc.kind, tc.from, got.State, tc.to)
+		}
+	}
+}
+
+var startOperationErrors = []struct {
+	kind OperationKind
+	from VMState
+	want string
+}{
+	{kind: SUSPEND, from: STOPPED, want: `illegal transition from "Stopped" to "Suspending"`},
+	{kind: RESUME, from: RUNNING, want: `illegal transition from "Running" to "Resuming"`},
+	{kind: REBOOT, from: SUSPENDED, want: `illegal transition from "Suspended" to "Rebooting"`},
+	{kind: LAUNCH, from: ERROR, want: `illegal transition from "Error" to "Starting"`},
+	{kind: PROVISION, from: STOPPED, want: `unknown operation kind "provision"`},
+	{kind: "explode", from: RUNNING, want: `unknown operation kind "explode"`},
+}
+
+func TestStartOperationErrors(t *testing.T) {
+	for _, tc := range startOperationErrors {
+		c := NewDefaultCloud()
+		forceState(c, GoodID, tc.from)
+		if _, got := c.StartOperation(GoodID, tc.kind); got == nil || got.Error() != tc.want {
+			t.Fatalf("got: %v, want: %q", got, tc.want)
+		}
+	}
+}
+
+func TestCancelReboot(t *testing.T) {
+	c := NewDefaultCloud()
+	forceState(c, GoodID, RUNNING)
+	if _, err := c.StartOperation(GoodID, REBOOT); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Cancel(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.Inspect(GoodID); got.State != RUNNING {
+		t.Fatalf("got: %v, want: %v", got.State, RUNNING)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	events, _, cancel := c.Subscribe(0)
+	defer cancel()
+	done, err := c.Launch(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(done, 10*DefaultStartDelay*timeUnit); err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Seq: 1, Type: TRANSITIONED, VMID: GoodID, OldState: STOPPED, NewState: STARTING},
+		{Seq: 2, Type: TRANSITIONED, VMID: GoodID, OldState: STARTING, NewState: RUNNING},
+	}
+	for _, w := range want {
+		got := <-events
+		got.Time = time.Time{}
+		if got != w {
+			t.Fatalf("got: %v, want: %v", got, w)
+		}
+	}
+}
+
+func TestLaunchOperation(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	op, err := c.LaunchOperation(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.VMID != GoodID || op.Kind != LAUNCH || op.Status != PENDING || op.Finished != nil {
+		t.Fatalf("got: %v, want a pending launch of VM %d", op, GoodID)
+	}
+	if err := waitDone(op.Done(), 10*DefaultStartDelay*timeUnit); err != nil {
+		t.Fatal(err)
+	}
+	got, found := c.Operation(op.ID)
+	if !found {
+		t.Fatalf("operation %d not found", op.ID)
+	}
+	if got.Status != DONE || got.Finished == nil || got.Error != "" {
+		t.Fatalf("got: %v, want a done operation", got)
+	}
+	if ops := c.Operations(); len(ops) != 1 || ops[0].ID != op.ID {
+		t.Fatalf("got: %v, want just operation %d", ops, op.ID)
+	}
+}
+
+func TestBadOperation(t *testing.T) {
+	c := NewDefaultCloud()
+	if _, err := c.StopOperation(GoodID); err == nil {
+		t.Fatalf("got no error stopping a stopped VM")
+	}
+	if _, found := c.Operation(BadID); found {
+		t.Fatalf("found: %v, want: false", found)
+	}
+	if ops := c.Operations(); len(ops) != 0 {
+		t.Fatalf("got: %v, want no operations", ops)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	c := NewDefaultCloud()
+	op, err := c.LaunchOperation(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := c.Cancel(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.ID != op.ID || cancelled.Status != CANCELLED || cancelled.Finished == nil {
+		t.Fatalf("got: %v, want operation %d cancelled", cancelled, op.ID)
+	}
+	if err := waitDone(op.Done(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.Inspect(GoodID); got.State != STOPPED {
+		t.Fatalf("got: %v, want: %v", got.State, STOPPED)
+	}
+	want := fmt.Sprintf("cancel error: VM %d has no transition in progress", GoodID)
+	if _, got := c.Cancel(GoodID); got == nil || got.Error() != want {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+}
+
+func TestCancelOperation(t *testing.T) {
+	c := NewDefaultCloud()
+	forceState(c, GoodID, RUNNING)
+	op, err := c.StopOperation(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CancelOperation(op.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.Inspect(GoodID); got.State != RUNNING {
+		t.Fatalf("got: %v, want: %v", got.State, RUNNING)
+	}
+	want := fmt.Sprintf("cancel error: operation %d is not in progress", op.ID)
+	if _, got := c.CancelOperation(op.ID); got == nil || got.Error() != want {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+}
+
+func TestStaleTransition(t *testing.T) {
+	c := NewDefaultCloud()
+	if _, err := c.LaunchOperation(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	c.lock.RLock()
+	stale := c.pending[GoodID]
+	c.lock.RUnlock()
+	if _, err := c.Cancel(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	op, err := c.LaunchOperation(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.completeTransition(stale) // as if the old timer fired anyway
+	if got, _ := c.Inspect(GoodID); got.State != STARTING {
+		t.Fatalf("got: %v, want: %v", got.State, STARTING)
+	}
+	if got, _ := c.Operation(op.ID); got.Status != PENDING {
+		t.Fatalf("got: %v, want operation %d still pending", got, op.ID)
+	}
+}
+
+func TestResize(t *testing.T) {
+	c := NewDefaultCloud()
+	want := defaultVMs[GoodID]
+	want.Storage *= 2
+	got, err := c.Resize(GoodID, VMPatch{Storage: &want.Storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspected, _ := c.Inspect(GoodID); got != want || inspected != want {
+		t.Fatalf("got: %v, inspected: %v, want: %v", got, inspected, want)
+	}
+	c.SetLimits(Limits{VCPUS: 1, Clock: 1, RAM: 1, Storage: 1, Network: 1})
+	if _, err := c.Resize(GoodID, VMPatch{}); errorCode(err) != ValidationFailed {
+		t.Fatalf("got: %v, want a validation error over limits", err)
+	}
+	if _, err := c.Resize(BadID, VMPatch{}); errorCode(err) != NotFound {
+		t.Fatalf("got: %v, want a not found error", err)
+	}
+}
+
+func TestInjectedFaults(t *testing.T) {
+	shrinkTime()
+	for _, tc := range []struct {
+		rule      FaultRule
+		wantState VMState
+	}{
+		{rule: FaultRule{Action: LAUNCH, Probability: 1}, wantState: ERROR},
+		{rule: FaultRule{Action: LAUNCH, Probability: 1, Outcome: ROLLEDBACK}, wantState: STOPPED},
+	} {
+		c := NewDefaultCloud()
+		if err := c.SetFaults(FaultRules{tc.rule}); err != nil {
+			t.Fatal(err)
+		}
+		op, err := c.LaunchOperation(GoodID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := waitDone(op.Done(), 10*DefaultStartDelay*timeUnit); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := c.Operation(op.ID); got.Status != FAILED || got.Error == "" {
+			t.Fatalf("%v: got: %v, want a failed operation", tc.rule, got)
+		}
+		if vm, _ := c.Inspect(GoodID); vm.State != tc.wantState {
+			t.Fatalf("%v: got: %v, want: %v", tc.rule, vm.State, tc.wantState)
+		}
+	}
+}
+
+func TestAdvanceClock(t *testing.T) {
+	c := NewDefaultCloud()
+	if _, err := c.AdvanceClock(time.Second); errorCode(err) != Conflict {
+		t.Fatalf("got: %v, want a %v error advancing the system clock", err, Conflict)
+	}
+	c.UseClock(newTestClock())
+	op, err := c.LaunchOperation(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !op.Created.Equal(testStart) {
+		t.Fatalf("got created: %v, want: %v", op.Created, testStart)
+	}
+	if status, err := c.AdvanceClock(0); err != nil || status.Fired != 0 || status.Pending != 1 {
+		t.Fatalf("got: %v, %v, want just a pending transition", status, err)
+	}
+	max := time.Duration(2*DefaultStartDelay-1) * timeUnit
+	status, err := c.AdvanceClock(max)
+	if err != nil || status.Fired != 1 || status.Pending != 0 || !status.Now.Equal(testStart.Add(max)) {
+		t.Fatalf("got: %v, %v, want the transition fired", status, err)
+	}
+	if vm, _ := c.Inspect(GoodID); vm.State != RUNNING {
+		t.Fatalf("got: %v, want: %v", vm.State, RUNNING)
+	}
+	if got, _ := c.Operation(op.ID); got.Status != DONE || got.Finished.Before(testStart) || got.Finished.After(testStart.Add(max)) {
+		t.Fatalf("got: %v, want done within the advanced time", got)
+	}
+	if _, err := c.AdvanceClock(-time.Second); errorCode(err) != ValidationFailed {
+		t.Fatalf("got: %v, want a %v error going back in time", err, ValidationFailed)
+	}
+}
+
+func TestSetTimeScale(t *testing.T) {
+	clock := newTestClock()
+	c := NewDefaultCloud()
+	c.UseClock(clock)
+	if err := c.SetTimeScale(0); errorCode(err) != ValidationFailed {
+		t.Fatalf("got: %v, want a %v error", err, ValidationFailed)
+	}
+	if err := c.SetTimeScale(2); err != nil {
+		t.Fatal(err)
+	}
+	op, err := c.LaunchOperation(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay := op.Due.Sub(testStart)
+	if min, max := 2*timeUnit, time.Duration(2*(2*DefaultStartDelay-1))*timeUnit; delay < min || delay > max {
+		t.Fatalf("got delay: %v, want it within [%v, %v]", delay, min, max)
+	}
+	if op.Delay != delay.Seconds() {
+		t.Fatalf("got delay: %v, want: %v", op.Delay, delay.Seconds())
+	}
+	// Half way through, going twice as fast halves the time left
+	clock.Advance(delay / 2)
+	if err := c.SetTimeScale(1); err != nil {
+		t.Fatal(err)
+	}
+	wantDue := testStart.Add(delay / 2).Add(delay / 4)
+	vm, _ := c.Inspect(GoodID)
+	if got, _ := c.Operation(op.ID); !got.Due.Equal(wantDue) || !vm.Due.Equal(wantDue) {
+		t.Fatalf("got due: %v and %v, want: %v", got.Due, vm.Due, wantDue)
+	}
+	if clock.Advance(wantDue.Sub(clock.Now())) != 1 {
+		t.Fatalf("want the transition fired on its new due time")
+	}
+	if vm, _ := c.Inspect(GoodID); vm.State != RUNNING || vm.Due != nil {
+		t.Fatalf("got: %v, want %v with nothing due", vm, RUNNING)
+	}
+}
+
+func TestDelayOverrides(t *testing.T) {
+	vms := defaultVMs.clone()
+	fast := vms[0]
+	fast.StartDelay = &DelayRange{Min: 1, Max: 1}
+	vms[0] = fast
+	c := NewCloud(vms)
+	c.UseClock(newTestClock())
+	if err := c.SetDelays(map[OperationKind]DelayRange{"teleport": {}}); errorCode(err) != ValidationFailed {
+		t.Fatalf("got: %v, want a %v error", err, ValidationFailed)
+	}
+	if err := c.SetDelays(map[OperationKind]DelayRange{LAUNCH: {Min: 60, Max: 60}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id   int
+		want time.Duration
+	}{
+		{id: 0, want: timeUnit},      // its own delay
+		{id: 2, want: 60 * timeUnit}, // the delay of all VMs
+	} {
+		op, err := c.LaunchOperation(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := op.Due.Sub(testStart); got != tc.want {
+			t.Fatalf("VM %d: got delay: %v, want: %v", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestSetState(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	op, err := c.LaunchOperation(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _, cancel := c.Subscribe(0)
+	defer cancel()
+	if err := c.SetState(VMs{7: *VMInState("Lost")}); errorCode(err) != ValidationFailed {
+		t.Fatalf("got: %v, want a %v error", err, ValidationFailed)
+	}
+	if err := c.SetState(VMs{7: *VMInState(STARTING)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.Operation(op.ID); got.Status != CANCELLED {
+		t.Fatalf("got: %v, want the launch of VM %d cancelled", got, GoodID)
+	}
+	for i, want := range []Event{
+		{Type: DELETED, VMID: 0}, {Type: DELETED, VMID: 1}, {Type: DELETED, VMID: 2},
+		{Type: CREATED, VMID: 7, NewState: STARTING},
+	} {
+		if got := <-events; got.Type != want.Type || got.VMID != want.VMID {
+			t.Fatalf("event #%d: got: %v, want: %s of VM %d", i, got, want.Type, want.VMID)
+		}
+	}
+	// VM 7 resumes its launch
+	ops := c.Operations()
+	resumed := ops[len(ops)-1]
+	if resumed.VMID != 7 || resumed.Kind != LAUNCH {
+		t.Fatalf("got: %v, want a launch of VM 7", resumed)
+	}
+	if err := waitDone(resumed.Done(), 10*DefaultStartDelay*timeUnit); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, err := c.Create(*VMInState("")); err != nil || id != 8 {
+		t.Fatalf("got: %d, %v, want new VM 8", id, err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	c := NewDefaultCloud()
+	if _, err := c.Snapshot("no/slashes"); errorCode(err) != ValidationFailed {
+		t.Fatalf("got: %v, want a %v error", err, ValidationFailed)
+	}
+	if _, err := c.Snapshot("initial"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Snapshot("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Restore("initial"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.State(); got.String() != defaultVMs.String() {
+		t.Fatalf("got: %v, want: %v", got, defaultVMs)
+	}
+	if err := c.Restore("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := c.Inspect(0); found {
+		t.Fatalf("found VM 0, want it deleted in the snapshot")
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.State(); got.String() != defaultVMs.String() {
+		t.Fatalf("got: %v, want: %v", got, defaultVMs)
+	}
+	if err := c.Restore("missing"); errorCode(err) != NotFound {
+		t.Fatalf("got: %v, want a %v error", err, NotFound)
+	}
+	if got := c.Snapshots(); len(got) != 2 || got[0].Name != "deleted" || got[1].Name != "initial" {
+		t.Fatalf("got: %v, want snapshots deleted and initial", got)
+	}
+}
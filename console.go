@@ -0,0 +1,383 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxConsoleBytes is how much of the console output is kept per VM
+const MaxConsoleBytes = 64 * 1024
+
+// ConsoleOutput is a chunk of the serial console output of a VM
+type ConsoleOutput struct {
+	Contents string `json:"contents"` // Output from start on
+	Start    int    `json:"start"`    // Byte offset of the contents, later than the one asked for if it was dropped
+	Next     int    `json:"next"`     // Byte offset to ask for next time
+}
+
+// String on a ConsoleOutput dumps it in JSON format
+func (output ConsoleOutput) String() string {
+	outputJSON, err := json.Marshal(output)
+	dieOnError(err, "Can't generate JSON for ConsoleOutput object %#v", output)
+	return string(outputJSON)
+}
+
+// writeSSE writes the output in text/event-stream format
+func (output ConsoleOutput) writeSSE(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: output\ndata: %s\n\n", output.Next, output)
+	return err
+}
+
+// consoleLine is a line due to show up on the console at some point
+type consoleLine struct {
+	at     time.Time
+	text   string
+	kernel bool // prefixed with the time since boot, as kernel messages are
+}
+
+// vmConsole is the serial console of a single VM: the output shown so far,
+// and the lines of the transition in progress yet to show up
+type vmConsole struct {
+	output  []byte        // last MaxConsoleBytes of output
+	start   int           // byte offset of output[0]
+	lines   []consoleLine // yet to show up, by time
+	started time.Time     // when the VM last booted
+	planned VMState       // state whose transition lines are planned, if any
+	due     time.Time     // when the planned transition is due
+}
+
+// flush writes the lines due by now onto the output
+func (vc *vmConsole) flush(now time.Time) {
+	for len(vc.lines) > 0 && !vc.lines[0].at.After(now) {
+		line := vc.lines[0]
+		vc.lines = vc.lines[1:]
+		if line.kernel {
+			vc.write(vc.kernelLine(line.at, line.text))
+		} else {
+			vc.write(line.text + "\n")
+		}
+	}
+}
+
+// retime moves the lines left, and the boot if yet to come, from within
+// [now, vc.due] to within [now, due], keeping their relative timing
+func (vc *vmConsole) retime(now, due time.Time) {
+	scale := 1.0
+	if left := vc.due.Sub(now); left > 0 {
+		scale = float64(due.Sub(now)) / float64(left)
+	}
+	move := func(at time.Time) time.Time {
+		return now.Add(time.Duration(float64(at.Sub(now)) * scale))
+	}
+	for i := range vc.lines {
+		vc.lines[i].at = move(vc.lines[i].at)
+	}
+	if vc.started.After(now) {
+		vc.started = move(vc.started)
+	}
+	vc.due = due
+}
+
+// kernelLine returns the text prefixed with the time since boot, as kernel
+// messages are
+func (vc *vmConsole) kernelLine(at time.Time, text string) string {
+	uptime := 0.0
+	if !vc.started.IsZero() {
+		uptime = at.Sub(vc.started).Seconds()
+	}
+	return fmt.Sprintf("[%12.6f] %s\n", uptime, text)
+}
+
+func (vc *vmConsole) write(text string) {
+	vc.output = append(vc.output, text...)
+	if extra := len(vc.output) - MaxConsoleBytes; extra > 0 {
+		vc.output = append([]byte{}, vc.output[extra:]...)
+		vc.start += extra
+	}
+}
+
+// read returns up to limit bytes of output from offset on
+func (vc *vmConsole) read(offset, limit int) ConsoleOutput {
+	end := vc.start + len(vc.output)
+	if offset < vc.start {
+		offset = vc.start
+	}
+	if offset > end {
+		offset = end
+	}
+	next := end
+	if limit > 0 && offset+limit < end {
+		next = offset + limit
+	}
+	return ConsoleOutput{Contents: string(vc.output[offset-vc.start : next-vc.start]), Start: offset, Next: next}
+}
+
+// spread returns the texts as lines evenly spread within [from, to)
+func spread(texts []string, kernel bool, from, to time.Time) []consoleLine {
+	lines := make([]consoleLine, len(texts))
+	step := to.Sub(from) / time.Duration(len(texts))
+	for i, text := range texts {
+		lines[i] = consoleLine{at: from.Add(time.Duration(i) * step), text: text, kernel: kernel}
+	}
+	return lines
+}
+
+// bootLines returns the kernel messages of a VM booting
+func bootLines(id int, vm VM) []string {
+	return []string{
+		"Linux version 5.4.0-58-generic (buildd@lcy01-amd64-004) (gcc version 9.3.0 (Ubuntu 9.3.0-17ubuntu1~20.04)) #64-Ubuntu SMP",
+		fmt.Sprintf("Command line: BOOT_IMAGE=/boot/vmlinuz-5.4.0-58-generic root=LABEL=cloudimg-rootfs ro console=ttyS0 hostname=vm-%d", id),
+		"BIOS-provided physical RAM map:",
+		"Hypervisor detected: KVM",
+		fmt.Sprintf("smpboot: Allowing %d CPUs, 0 hotplug CPUs", vm.VCPUS),
+		fmt.Sprintf("tsc: Detected %.3f MHz processor", vm.Clock),
+		fmt.Sprintf("Memory: %dK available", vm.RAM*1024),
+		"Console: colour dummy device 80x25",
+		"printk: console [ttyS0] enabled",
+		fmt.Sprintf("smp: Brought up 1 node, %d CPUs", vm.VCPUS),
+		"virtio_blk virtio2: [vda] 512-byte logical blocks",
+		fmt.Sprintf("virtio_blk virtio2: [vda] %d GB disk", vm.Storage),
+		fmt.Sprintf("virtio_net virtio1 ens4: link up, %d Mbps", vm.Network),
+		"EXT4-fs (vda1): mounted filesystem with ordered data mode. Opts: (null)",
+		"systemd[1]: systemd 245.4-4ubuntu3.3 running in system mode.",
+	}
+}
+
+// serviceLines returns the messages of the services of a VM starting
+func serviceLines(id int) []string {
+	return []string{
+		"[  OK  ] Started Journal Service.",
+		"[  OK  ] Started Network Name Resolution.",
+		"[  OK  ] Reached target Network.",
+		"[  OK  ] Started OpenBSD Secure Shell server.",
+		"[  OK  ] Started Regular background program processing daemon.",
+		fmt.Sprintf("[  OK  ] Finished Initial cloud-init job (metadata service crawler) for vm-%d.", id),
+		"[  OK  ] Reached target Multi-User System.",
+		"",
+		fmt.Sprintf("Ubuntu 20.04.1 LTS vm-%d ttyS0", id),
+		"",
+	}
+}
+
+// shutdownLines returns the messages of a VM shutting down
+func shutdownLines() []string {
+	return []string{
+		"[  OK  ] Stopped target Multi-User System.",
+		"         Stopping OpenBSD Secure Shell server...",
+		"[  OK  ] Stopped OpenBSD Secure Shell server.",
+		"[  OK  ] Stopped Network Name Resolution.",
+		"[  OK  ] Reached target Shutdown.",
+		"[  OK  ] Finished Power-Off.",
+	}
+}
+
+// consoleRecorder writes the serial console of all VMs, timing the lines of
+// each transition to its delay. Lines are only written when asked for, or
+// when VMs change.
+// The zero value is ready to use.
+type consoleRecorder struct {
+	lock sync.Mutex
+	vms  map[int]*vmConsole
+}
+
+// reset forgets all consoles
+func (r *consoleRecorder) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.vms = nil
+}
+
+// get returns the console of the VM, creating it if needed.
+// Must be called holding the lock.
+func (r *consoleRecorder) get(id int) *vmConsole {
+	if r.vms == nil {
+		r.vms = make(map[int]*vmConsole)
+	}
+	vc, found := r.vms[id]
+	if !found {
+		vc = &vmConsole{}
+		r.vms[id] = vc
+	}
+	return vc
+}
+
+// plan times the lines of the transition of the VM from now until due.
+// A transition already planned, but rescheduled, only gets its lines left
+// retimed to the new delay.
+func (r *consoleRecorder) plan(id int, vm VM, now, due time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	vc := r.get(id)
+	vc.flush(now)
+	if vc.planned == vm.State {
+		vc.retime(now, due)
+		return
+	}
+	vc.planned, vc.due = vm.State, due
+	halfway := now.Add(due.Sub(now) / 2)
+	switch vm.State {
+	case STARTING:
+		vc.started = now
+		vc.lines = append(spread(bootLines(id, vm), true, now, halfway), spread(serviceLines(id), false, halfway, due)...)
+	case STOPPING:
+		vc.lines = spread(shutdownLines(), false, now, due)
+	case REBOOTING:
+		vc.lines = spread(shutdownLines(), false, now, halfway)
+		vc.started = halfway
+		vc.lines = append(vc.lines, spread(bootLines(id, vm), true, halfway, due)...)
+	case SUSPENDING:
+		vc.lines = []consoleLine{{at: now, text: "PM: suspend entry (s2idle)", kernel: true}}
+	case RESUMING:
+		vc.lines = []consoleLine{{at: now, text: "PM: suspend exit", kernel: true}}
+	}
+}
+
+// update writes the lines due up to now for the VM, dropping the ones of a
+// transition that ended, then the line telling the state the VM moved to.
+// Consoles of VMs gone (nil) are forgotten.
+func (r *consoleRecorder) update(id int, vm *VM, old VMState, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if vm == nil {
+		delete(r.vms, id)
+		return
+	}
+	vc := r.get(id)
+	vc.flush(now)
+	if vm.State == old {
+		return
+	}
+	vc.lines, vc.planned = nil, ""
+	switch {
+	case vm.State == RUNNING && (old == STARTING || old == REBOOTING):
+		vc.write(fmt.Sprintf("vm-%d login: \n", id))
+	case vm.State == STOPPED && old != PROVISIONING:
+		vc.write(vc.kernelLine(now, "reboot: Power down"))
+	case vm.State == ERROR:
+		vc.write(vc.kernelLine(now, "Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000009"))
+	}
+}
+
+// read returns up to limit bytes of output of the VM from offset on,
+// written up to now
+func (r *consoleRecorder) read(id int, offset, limit int, now time.Time) ConsoleOutput {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	vc := r.get(id)
+	vc.flush(now)
+	return vc.read(offset, limit)
+}
+
+// console replies with the serial console output of a VM from ?offset= on,
+// up to ?limit= bytes, or streams it as server sent events when asked for
+// text/event-stream
+func (s *VMServer) console(id int, w http.ResponseWriter, r *http.Request) {
+	offset, err := intParam(r, "offset", 0)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	limit, err := intParam(r, "limit", 0)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.streamConsole(id, offset, w, r)
+		return
+	}
+	output, err := s.vmm.Console(id, offset, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, output)
+}
+
+// intParam returns the non negative integer of the named query parameter,
+// or the given default if unset
+func intParam(r *http.Request, name string, defaultValue int) (int, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(param)
+	if err != nil || value < 0 {
+		return 0, newError(BadRequest, "bad %s %q, want a non negative integer", name, param)
+	}
+	return value, nil
+}
+
+// streamConsole writes the console output of a VM as a text/event-stream as
+// it gets written. Clients resume from the byte offset given by the
+// Last-Event-ID header, or start from the offset given.
+func (s *VMServer) streamConsole(id, offset int, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, newError(Internal, "streaming unsupported"))
+		return
+	}
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		var err error
+		if offset, err = strconv.Atoi(lastEventID); err != nil {
+			writeError(w, r, newError(BadRequest, "bad Last-Event-ID: %v", err))
+			return
+		}
+	}
+	if _, err := s.vmm.Console(id, offset, 0); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	send := func() bool {
+		output, err := s.vmm.Console(id, offset, 0)
+		if err != nil {
+			return false // the VM is gone
+		}
+		if output.Contents != "" {
+			if err := output.writeSSE(w); err != nil {
+				return false
+			}
+			flusher.Flush()
+		}
+		offset = output.Next
+		return true
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	if !send() {
+		return
+	}
+
+	poll := time.NewTicker(streamPoll)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+			if !send() {
+				return
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsole(t *testing.T) {
+	c := NewDefaultCloud()
+	c.UseClock(newTestClock())
+	contents := func() string {
+		output, err := c.Console(GoodID, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output.Contents
+	}
+	if got := contents(); got != "" {
+		t.Fatalf("got: %q, want no output before booting", got)
+	}
+
+	op, _ := c.LaunchOperation(GoodID)
+	delay := op.Due.Sub(testStart)
+	c.AdvanceClock(delay / 4)
+	if got := contents(); !strings.HasPrefix(got, "[    0.000000] Linux version") || strings.Contains(got, "[  OK  ]") {
+		t.Fatalf("got: %q, want just kernel lines a quarter into the boot", got)
+	}
+	// Slowing down keeps the lines left spread over the longer delay
+	c.SetTimeScale(2)
+	c.AdvanceClock(delay)
+	if got := contents(); !strings.Contains(got, "[  OK  ] Started Journal Service.") || strings.Contains(got, "login:") {
+		t.Fatalf("got: %q, want services starting, still not booted", got)
+	}
+	c.AdvanceClock(delay)
+	if got := contents(); strings.Count(got, "Linux version") != 1 || !strings.HasSuffix(got, "vm-1 login: \n") {
+		t.Fatalf("got: %q, want a single boot ending with a login prompt", got)
+	}
+
+	c.StopOperation(GoodID)
+	c.AdvanceClock(time.Minute)
+	got := contents()
+	if !strings.Contains(got, "[  OK  ] Reached target Shutdown.") || !strings.HasSuffix(got, "] reboot: Power down\n") {
+		t.Fatalf("got: %q, want a shutdown ending with a power down", got)
+	}
+
+	if output, _ := c.Console(GoodID, 10, 5); output.Contents != got[10:15] || output.Start != 10 || output.Next != 15 {
+		t.Fatalf("got: %v, want bytes 10 to 15 of %q", output, got)
+	}
+	if output, _ := c.Console(GoodID, len(got)+100, 0); output.Contents != "" || output.Next != len(got) {
+		t.Fatalf("got: %v, want no output past the end, at %d", output, len(got))
+	}
+	if _, err := c.Console(BadID, 0, 0); errorCode(err) != NotFound {
+		t.Fatalf("got: %v, want a %v error", err, NotFound)
+	}
+}
+
+func TestConsoleRescheduled(t *testing.T) {
+	c := NewDefaultCloud()
+	c.UseClock(newTestClock())
+	forceState(c, GoodID, RUNNING)
+	contents := func() string {
+		output, err := c.Console(GoodID, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output.Contents
+	}
+	// Rescheduling once all the lines are written writes none again
+	op, err := c.StartOperation(GoodID, SUSPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AdvanceClock(op.Due.Sub(c.Now()) / 2)
+	c.SetTimeScale(2)
+	c.AdvanceClock(time.Minute)
+	c.SetTimeScale(1)
+	if got := contents(); strings.Count(got, "PM: suspend entry") != 1 {
+		t.Fatalf("got: %q, want a single suspend entry", got)
+	}
+	forceState(c, GoodID, RUNNING)
+
+	// Slowing down keeps the boot half way through the reboot
+	op, err = c.StartOperation(GoodID, REBOOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay := op.Due.Sub(c.Now())
+	c.AdvanceClock(delay / 4)
+	c.SetTimeScale(2)
+	c.AdvanceClock(delay * 45 / 100)
+	if got := contents(); !strings.Contains(got, "Stopped OpenBSD Secure Shell server") || strings.Contains(got, "Linux version") {
+		t.Fatalf("got: %q, want still shutting down", got)
+	}
+	if op, _ = c.Operation(op.ID); op.Due.Sub(c.Now()) < time.Millisecond {
+		t.Fatalf("got the reboot due at %v, want it after %v", op.Due, c.Now())
+	}
+	c.AdvanceClock(op.Due.Sub(c.Now()) - time.Millisecond)
+	c.SetTimeScale(4)
+	c.AdvanceClock(time.Minute)
+	got := contents()
+	for _, line := range []string{"Reached target Shutdown", "] Linux version", "vm-1 login:"} {
+		if strings.Count(got, line) != 1 {
+			t.Fatalf("got: %q, want %q once", got, line)
+		}
+	}
+	if !strings.Contains(got, "[    0.000000] Linux version") {
+		t.Fatalf("got: %q, want the kernel to boot at uptime 0", got)
+	}
+}
+
+func TestConsoleDropsOldOutput(t *testing.T) {
+	vc := &vmConsole{}
+	line := strings.Repeat("x", 1023) + "\n"
+	for i := 0; i < 100; i++ {
+		vc.write(line)
+	}
+	output := vc.read(0, 0)
+	if want := 100*len(line) - MaxConsoleBytes; output.Start != want || len(output.Contents) != MaxConsoleBytes || output.Next != 100*len(line) {
+		t.Fatalf("got start %d, %d bytes, next %d, want the last %d bytes from %d", output.Start, len(output.Contents), output.Next, MaxConsoleBytes, want)
+	}
+}
+
+func TestConsoleStream(t *testing.T) {
+	server := NewVMServer(defaultVMs.clone())
+	server.vmm.UseClock(newTestClock())
+	server.vmm.LaunchOperation(GoodID)
+	server.vmm.AdvanceClock(time.Minute)
+	all, _ := server.vmm.Console(GoodID, 0, 0)
+	for _, lastEventID := range []string{"", "100"} {
+		r := httptest.NewRequest(http.MethodGet, "/vms/1/console", nil)
+		r.Header.Set("Accept", "text/event-stream")
+		want := ConsoleOutput{Contents: all.Contents, Next: all.Next}
+		if lastEventID != "" {
+			r.Header.Set("Last-Event-ID", lastEventID)
+			want = ConsoleOutput{Contents: all.Contents[100:], Start: 100, Next: all.Next}
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		cancel()
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r.WithContext(ctx))
+		if got := w.Body.String(); !strings.Contains(got, "event: output\ndata: "+want.String()+"\n\n") {
+			t.Fatalf("Last-Event-ID %q: got: %q, want: %v", lastEventID, got, want)
+		}
+	}
+}
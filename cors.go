@@ -11,6 +11,7 @@ import (
 func prepareCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	if origin := r.Header.Get("Origin"); origin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Operation-Location, X-Request-Id, Link, X-Total-Count")
 	}
 }
 
@@ -0,0 +1,240 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+)
+
+// explorerMethod is the view of a MethodSpec the API explorer page needs
+type explorerMethod struct {
+	Method      string      `json:"method"`
+	Path        string      `json:"path"`
+	Doc         string      `json:"doc"`
+	OperationID string      `json:"operationId"`
+	Params      []ParamSpec `json:"params"`
+	Query       []ParamSpec `json:"query"`
+	Example     string      `json:"example"`
+	ContentType string      `json:"contentType"`
+}
+
+// explorerField documents a VM JSON field
+type explorerField struct {
+	Name string
+	Type string
+	Doc  string
+}
+
+type explorerPage struct {
+	Version string
+	Methods []explorerMethod
+	Fields  []explorerField
+}
+
+func newExplorerPage(endpoints []EndpointSpec) explorerPage {
+	page := explorerPage{Version: Version}
+	for _, endpoint := range endpoints {
+		for _, m := range endpoint.Methods {
+			page.Methods = append(page.Methods, explorerMethod{
+				Method:      m.Method,
+				Path:        endpoint.DisplayPath,
+				Doc:         m.Doc,
+				OperationID: m.OperationID,
+				Params:      endpoint.Params,
+				Query:       m.Query,
+				Example:     m.Example,
+				ContentType: m.ContentType,
+			})
+		}
+	}
+	vmSchema := openAPIComponents()["VM"]
+	for name, property := range vmSchema.Properties {
+		fieldType := property.Type
+		if fieldType == "" {
+			fieldType = path.Base(property.Ref) // such as Delay
+		}
+		page.Fields = append(page.Fields, explorerField{Name: name, Type: fieldType, Doc: property.Description})
+	}
+	sort.Slice(page.Fields, func(i, j int) bool {
+		return page.Fields[i].Name < page.Fields[j].Name
+	})
+	return page
+}
+
+func (s *VMServer) docs(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := explorerTemplate.Execute(&buf, newExplorerPage(APISpec)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// explorerTemplate is a self contained page, with no external dependencies,
+// to try the API from the browser
+var explorerTemplate = template.Must(template.New("docs").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>Test VM Backend API</title>
+<style>
+  body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+  code, pre, textarea, input { font-family: monospace; }
+  table { border-collapse: collapse; }
+  td, th { border: 1px solid #ccc; padding: .3em .6em; text-align: left; }
+  details { border: 1px solid #ccc; border-radius: 4px; margin: .5em 0; padding: .5em; }
+  summary { cursor: pointer; }
+  .method { display: inline-block; width: 5em; font-weight: bold; }
+  .GET { color: #2a7; } .POST { color: #27c; } .PUT { color: #c80; } .PATCH { color: #85c; } .DELETE { color: #c33; }
+  label { display: block; margin: .3em 0; }
+  textarea { width: 100%; height: 6em; }
+  pre { background: #f4f4f4; padding: .5em; max-height: 20em; overflow: auto; white-space: pre-wrap; }
+  .status { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Test VM Backend API <small>{{.Version}}</small></h1>
+<p>
+  Try the API of this server right from the browser.
+  The full description is also available as <a href="/openapi.json">OpenAPI JSON</a>
+  or <a href="/openapi.yaml">YAML</a>.
+</p>
+
+<h2>VM data &amp; units</h2>
+<table>
+  <tr><th>Field</th><th>Type</th><th>Description</th></tr>
+  {{range .Fields}}<tr><td><code>{{.Name}}</code></td><td>{{.Type}}</td><td>{{.Doc}}</td></tr>
+  {{end}}
+</table>
+
+<h2>Endpoints</h2>
+<div id="endpoints">
+{{range $i, $m := .Methods}}
+<details>
+  <summary><span class="method {{$m.Method}}">{{$m.Method}}</span> <code>{{$m.Path}}</code> &mdash; {{$m.Doc}}</summary>
+  <form data-index="{{$i}}">
+    {{range $m.Params}}<label>{{.Name}} <input name="path:{{.Name}}" value="0" required> <small>{{.Doc}}</small></label>
+    {{end}}
+    {{range $m.Query}}<label>{{.Name}} <input name="query:{{.Name}}"> <small>{{.Doc}}</small></label>
+    {{end}}
+    {{if $m.Example}}<label>Body <textarea name="body">{{$m.Example}}</textarea></label>{{end}}
+    <button type="submit">Send</button>
+    <button type="button" class="stop" hidden>Stop</button>
+  </form>
+  <p class="status"></p>
+  <pre class="response" hidden></pre>
+</details>
+{{end}}
+</div>
+
+<script>
+"use strict";
+const methods = {{.Methods}};
+
+function buildURL(m, form) {
+  let path = m.path;
+  for (const p of m.params || []) {
+    path = path.replace("{" + p.Name + "}", encodeURIComponent(form.elements["path:" + p.Name].value));
+  }
+  const query = new URLSearchParams();
+  for (const q of m.query || []) {
+    const value = form.elements["query:" + q.Name].value;
+    if (value !== "") {
+      query.set(q.Name, value);
+    }
+  }
+  const qs = query.toString();
+  return qs ? path + "?" + qs : path;
+}
+
+function show(details, status, text) {
+  details.querySelector(".status").textContent = status;
+  const out = details.querySelector(".response");
+  out.hidden = false;
+  out.textContent = text;
+}
+
+function pretty(text) {
+  try {
+    return JSON.stringify(JSON.parse(text), null, 2);
+  } catch (e) {
+    return text;
+  }
+}
+
+function streamEvents(m, form, details) {
+  const source = new EventSource(buildURL(m, form));
+  const stop = form.querySelector(".stop");
+  let log = "";
+  const append = (line) => { log += line + "\n"; show(details, "Streaming...", log); };
+  source.onopen = () => append("# connected");
+  source.onerror = () => append("# disconnected, retrying...");
+  for (const type of ["created", "transitioned", "deleted", "resized"]) {
+    source.addEventListener(type, (e) => append(type + " " + e.data));
+  }
+  stop.hidden = false;
+  stop.onclick = () => { source.close(); stop.hidden = true; append("# closed"); };
+}
+
+function openWebSocket(m, form, details) {
+  const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  const socket = new WebSocket(scheme + location.host + buildURL(m, form));
+  const stop = form.querySelector(".stop");
+  let log = "";
+  const append = (line) => { log += line + "\n"; show(details, "Connected", log); };
+  socket.onopen = () => {
+    append("# connected, subscribing");
+    socket.send(JSON.stringify({id: "explorer", action: "subscribe"}));
+  };
+  socket.onmessage = (e) => append("<- " + e.data);
+  socket.onclose = () => { append("# closed"); stop.hidden = true; };
+  stop.hidden = false;
+  stop.onclick = () => socket.close();
+}
+
+async function send(m, form, details) {
+  const init = {method: m.method, headers: {}};
+  if (form.elements.body) {
+    init.body = form.elements.body.value;
+    init.headers["Content-Type"] = "application/json";
+  }
+  details.querySelector(".status").textContent = "Waiting...";
+  try {
+    const response = await fetch(buildURL(m, form), init);
+    let head = "";
+    for (const name of ["Location", "Allow"]) {
+      if (response.headers.has(name)) {
+        head += name + ": " + response.headers.get(name) + "\n";
+      }
+    }
+    const text = await response.text();
+    show(details, response.status + " " + response.statusText, head + (head ? "\n" : "") + pretty(text));
+  } catch (e) {
+    show(details, "Request failed", String(e));
+  }
+}
+
+for (const form of document.querySelectorAll("#endpoints form")) {
+  form.addEventListener("submit", (e) => {
+    e.preventDefault();
+    const m = methods[form.dataset.index];
+    const details = form.closest("details");
+    if (m.contentType === "text/event-stream") {
+      streamEvents(m, form, details);
+    } else if (m.operationId === "webSocket") {
+      openWebSocket(m, form, details);
+    } else {
+      send(m, form, details);
+    }
+  });
+}
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,131 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is a machine readable error type, for clients to branch on
+type ErrorCode string
+
+const (
+	// NotFound VM or operation does not exist
+	NotFound ErrorCode = "not_found"
+
+	// IllegalTransition VM can't go from its current state to the requested one
+	IllegalTransition ErrorCode = "illegal_transition"
+
+	// Conflict request can't be done in the current state of the resource
+	Conflict ErrorCode = "conflict"
+
+	// ValidationFailed request is well formed but its values are not acceptable
+	ValidationFailed ErrorCode = "validation_failed"
+
+	// BadRequest request is malformed
+	BadRequest ErrorCode = "bad_request"
+
+	// MethodNotAllowed endpoint exists but does not support the method
+	MethodNotAllowed ErrorCode = "method_not_allowed"
+
+	// Unauthorized request lacks the right credentials, see the WWW-Authenticate header
+	Unauthorized ErrorCode = "unauthorized"
+
+	// UpgradeRequired endpoint needs a protocol upgrade, such as WebSockets
+	UpgradeRequired ErrorCode = "upgrade_required"
+
+	// TooManyRequests client must slow down, see the Retry-After header
+	TooManyRequests ErrorCode = "too_many_requests"
+
+	// Internal error on the server side
+	Internal ErrorCode = "internal"
+
+	// Unavailable server can't handle requests for now, see the Retry-After header
+	Unavailable ErrorCode = "unavailable"
+)
+
+// errorStatus maps error codes to HTTP status codes
+var errorStatus = map[ErrorCode]int{
+	NotFound:          http.StatusNotFound,
+	IllegalTransition: http.StatusConflict,
+	Conflict:          http.StatusConflict,
+	ValidationFailed:  http.StatusUnprocessableEntity,
+	BadRequest:        http.StatusBadRequest,
+	MethodNotAllowed:  http.StatusMethodNotAllowed,
+	Unauthorized:      http.StatusUnauthorized,
+	UpgradeRequired:   http.StatusUpgradeRequired,
+	TooManyRequests:   http.StatusTooManyRequests,
+	Internal:          http.StatusInternalServerError,
+	Unavailable:       http.StatusServiceUnavailable,
+}
+
+// CloudError is an error with a machine readable code
+type CloudError struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *CloudError) Error() string {
+	return e.Msg
+}
+
+// newError returns a CloudError with the given code and formatted message
+func newError(code ErrorCode, format string, args ...interface{}) *CloudError {
+	return &CloudError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the code of err, Internal if it has none
+func errorCode(err error) ErrorCode {
+	var cloudErr *CloudError
+	if errors.As(err, &cloudErr) {
+		return cloudErr.Code
+	}
+	return Internal
+}
+
+// statusFor returns the HTTP status code err maps to
+func statusFor(err error) int {
+	return errorStatus[errorCode(err)]
+}
+
+// Problem is an error reply body, following RFC 7807
+type Problem struct {
+	Type     string    `json:"type"`               // Always about:blank, see code instead
+	Title    string    `json:"title"`              // HTTP status text
+	Status   int       `json:"status"`             // HTTP status code
+	Detail   string    `json:"detail,omitempty"`   // Error message
+	Instance string    `json:"instance,omitempty"` // Request path
+	Code     ErrorCode `json:"code"`               // Machine readable error type
+}
+
+// ProblemContentType is the media type of Problem replies
+const ProblemContentType = "application/problem+json"
+
+// problemFor returns the Problem describing err for a request on path
+func problemFor(err error, path string) Problem {
+	code := errorCode(err)
+	status := errorStatus[code]
+	return Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   err.Error(),
+		Instance: path,
+		Code:     code,
+	}
+}
+
+// writeError replies to the request with err as a Problem
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := problemFor(err, r.URL.Path)
+	problemJSON, jsonErr := json.Marshal(problem)
+	dieOnError(jsonErr, "Can't generate JSON for Problem object %#v", problem)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	w.Write(problemJSON)
+}
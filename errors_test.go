@@ -0,0 +1,61 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	c := NewDefaultCloud()
+	forceState(c, 0, RUNNING)
+	cases := []struct {
+		name string
+		err  error
+		want ErrorCode
+	}{
+		{name: "launch missing VM", err: func() error { _, err := c.Launch(BadID); return err }(), want: NotFound},
+		{name: "stop stopped VM", err: func() error { _, err := c.Stop(GoodID); return err }(), want: IllegalTransition},
+		{name: "delete running VM", err: c.Delete(0), want: Conflict},
+		{name: "cancel stable VM", err: func() error { _, err := c.Cancel(GoodID); return err }(), want: Conflict},
+		{name: "create bad VM", err: func() error { _, _, err := c.Create(VM{}); return err }(), want: ValidationFailed},
+		{name: "untyped error", err: errors.New("boom"), want: Internal},
+	}
+	for _, tc := range cases {
+		if got := errorCode(tc.err); got != tc.want {
+			t.Fatalf("%s: got: %q, want: %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/vms/1/stop", nil)
+	writeError(w, r, newError(IllegalTransition, "illegal transition from %q to %q", STOPPED, STOPPING))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusConflict)
+	}
+	if got := w.Header().Get("Content-Type"); got != ProblemContentType {
+		t.Fatalf("got content type: %q, want: %q", got, ProblemContentType)
+	}
+	var got Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := Problem{
+		Type:     "about:blank",
+		Title:    "Conflict",
+		Status:   http.StatusConflict,
+		Detail:   `illegal transition from "Stopped" to "Stopping"`,
+		Instance: "/vms/1/stop",
+		Code:     IllegalTransition,
+	}
+	if got != want {
+		t.Fatalf("got: %#v, want: %#v", got, want)
+	}
+}
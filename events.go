@@ -0,0 +1,133 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventType tells what kind of change an Event records
+type EventType string
+
+const (
+	// CREATED VM was added to the Cloud
+	CREATED EventType = "created"
+
+	// TRANSITIONED VM changed its state
+	TRANSITIONED EventType = "transitioned"
+
+	// DELETED VM was removed from the Cloud
+	DELETED EventType = "deleted"
+
+	// RESIZED VM had its hardware specs changed
+	RESIZED EventType = "resized"
+)
+
+const (
+	// maxEventHistory is how many past events are kept to resume streams
+	maxEventHistory = 1024
+
+	// subscriberBuffer is how many events a subscriber can lag behind
+	// before being disconnected
+	subscriberBuffer = 64
+)
+
+// Event records a single change on a VM
+type Event struct {
+	Seq      uint64    `json:"seq"`                // Sequence number, increases by 1 on each event
+	Type     EventType `json:"type"`               // Value within [created, transitioned, deleted, resized]
+	VMID     int       `json:"vm"`                 // Id of the VM that changed
+	OldState VMState   `json:"oldState,omitempty"` // State before the change, empty on creation
+	NewState VMState   `json:"newState,omitempty"` // State after the change, empty on deletion
+	Time     time.Time `json:"time"`               // When the change happened
+}
+
+// String on an Event dumps it in JSON format
+func (e Event) String() string {
+	eventJSON, err := json.Marshal(e)
+	dieOnError(err, "Can't generate JSON for Event object %#v", e)
+	return string(eventJSON)
+}
+
+// writeSSE writes the event in text/event-stream format
+func (e Event) writeSSE(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, e)
+	return err
+}
+
+// eventBroker fans out events to all its subscribers.
+// It keeps a bounded history so that subscribers can resume from the
+// last event they saw. The zero value is ready to use.
+type eventBroker struct {
+	lock        sync.Mutex
+	seq         uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+	clock       Clock // stamps events, the system clock if nil
+}
+
+// useClock makes the broker stamp events with the given clock
+func (b *eventBroker) useClock(clock Clock) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.clock = clock
+}
+
+// publish stamps the event with the next sequence number and the current
+// time and sends it to every subscriber. Subscribers too slow to keep up
+// are dropped, closing their channel, so that they can resume later on.
+func (b *eventBroker) publish(e Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	e.Time = clockOrSystem(b.clock).Now()
+	b.history = append(b.history, e)
+	if len(b.history) > maxEventHistory {
+		b.history = b.history[len(b.history)-maxEventHistory:]
+	}
+	for sub := range b.subscribers {
+		select {
+		case sub <- e:
+		default:
+			delete(b.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+// subscribe returns a channel receiving every event published from now on,
+// the past events still in history with a sequence number after since,
+// and a function to cancel the subscription.
+func (b *eventBroker) subscribe(since uint64) (<-chan Event, []Event, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var backlog []Event
+	for _, e := range b.history {
+		if e.Seq > since {
+			backlog = append(backlog, e)
+		}
+	}
+	sub := make(chan Event, subscriberBuffer)
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]struct{})
+	}
+	b.subscribers[sub] = struct{}{}
+	cancel := func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, found := b.subscribers[sub]; found {
+			delete(b.subscribers, sub)
+			close(sub)
+		}
+	}
+	return sub, backlog, cancel
+}
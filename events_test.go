@@ -0,0 +1,39 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"testing"
+)
+
+func TestEventsResume(t *testing.T) {
+	var b eventBroker
+	for i := 0; i < 3; i++ {
+		b.publish(Event{Type: TRANSITIONED, VMID: i})
+	}
+	events, backlog, cancel := b.subscribe(1)
+	defer cancel()
+	if len(backlog) != 2 || backlog[0].Seq != 2 || backlog[1].Seq != 3 {
+		t.Fatalf("got backlog: %v, want events 2 and 3", backlog)
+	}
+	b.publish(Event{Type: DELETED, VMID: GoodID})
+	if got := <-events; got.Seq != 4 || got.Type != DELETED || got.VMID != GoodID {
+		t.Fatalf("got: %v, want event 4 deleting VM %d", got, GoodID)
+	}
+}
+
+func TestEventsSlowSubscriber(t *testing.T) {
+	var b eventBroker
+	events, _, cancel := b.subscribe(0)
+	defer cancel()
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.publish(Event{Type: TRANSITIONED, VMID: GoodID})
+	}
+	for i := 0; i < subscriberBuffer; i++ {
+		<-events
+	}
+	if _, ok := <-events; ok {
+		t.Fatalf("slow subscriber channel still open, want it closed")
+	}
+}
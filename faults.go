@@ -0,0 +1,244 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FaultOutcome is how a transition hit by a fault ends
+type FaultOutcome string
+
+const (
+	// ERRORED transitions leave the VM in the failure state of the lifecycle,
+	// Error by default
+	ERRORED FaultOutcome = "error"
+
+	// ROLLEDBACK transitions move the VM back to the state it came from
+	ROLLEDBACK FaultOutcome = "rollback"
+)
+
+// FaultRule makes a share of the matching transitions fail
+type FaultRule struct {
+	VM          *int          `json:"vm,omitempty"`     // VM id, any VM if unset
+	Action      OperationKind `json:"action,omitempty"` // Action of the transition, such as launch, any action if unset
+	Probability float64       `json:"probability"`      // Share of the matching transitions failing, within [0, 1]
+	Outcome     FaultOutcome  `json:"outcome"`          // Value within [error, rollback]
+	Count       int           `json:"count,omitempty"`  // Faults left before the rule expires, unlimited if unset
+}
+
+// String on a FaultRule dumps it in JSON format
+func (rule FaultRule) String() string {
+	ruleJSON, err := json.Marshal(rule)
+	dieOnError(err, "Can't generate JSON for FaultRule object %#v", rule)
+	return string(ruleJSON)
+}
+
+// Validate checks the rule makes sense, filling in the default outcome
+func (rule *FaultRule) Validate() error {
+	if rule.Probability < 0 || rule.Probability > 1 {
+		return newError(ValidationFailed, "invalid fault rule: probability must be within [0, 1]")
+	}
+	if rule.Outcome == "" {
+		rule.Outcome = ERRORED
+	}
+	if rule.Outcome != ERRORED && rule.Outcome != ROLLEDBACK {
+		return newError(ValidationFailed, "invalid fault rule: outcome must be %v or %v", ERRORED, ROLLEDBACK)
+	}
+	if _, found := currentRules().actions[rule.Action]; rule.Action != "" && !found {
+		return newError(ValidationFailed, "invalid fault rule: unknown action %q", rule.Action)
+	}
+	if rule.Count < 0 {
+		return newError(ValidationFailed, "invalid fault rule: count can't be negative")
+	}
+	return nil
+}
+
+// matches tells whether the rule applies to the transition of a VM
+func (rule FaultRule) matches(vmID int, kind OperationKind) bool {
+	return (rule.VM == nil || *rule.VM == vmID) && (rule.Action == "" || rule.Action == kind)
+}
+
+// FaultRules defines a list of FaultRules with attached methods
+type FaultRules []FaultRule
+
+// String on FaultRules dumps the list in JSON format
+func (rules FaultRules) String() string {
+	rulesJSON, err := json.Marshal(rules)
+	dieOnError(err, "Can't generate JSON for FaultRule objects %#v", rules)
+	return string(rulesJSON)
+}
+
+// Validate checks all rules, filling in their default outcomes
+func (rules FaultRules) Validate() error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseFaultRule parses a fault rule from a comma separated list of
+// key=value settings, such as "vm=2,action=launch,probability=0.5".
+// Probability is 1 unless set. The rule is not validated, as its action
+// may belong to a lifecycle yet to be loaded.
+func ParseFaultRule(s string) (FaultRule, error) {
+	rule := FaultRule{Probability: 1}
+	settings, err := parseSettings(s)
+	if err != nil {
+		return FaultRule{}, fmt.Errorf("bad fault rule: %v", err)
+	}
+	for _, setting := range settings {
+		key, value := setting[0], setting[1]
+		switch key {
+		case "vm":
+			var id int
+			id, err = strconv.Atoi(value)
+			rule.VM = &id
+		case "action":
+			rule.Action = OperationKind(value)
+		case "probability":
+			rule.Probability, err = strconv.ParseFloat(value, 64)
+		case "outcome":
+			rule.Outcome = FaultOutcome(value)
+		case "count":
+			rule.Count, err = strconv.Atoi(value)
+		default:
+			return FaultRule{}, fmt.Errorf("unknown fault rule setting %q", key)
+		}
+		if err != nil {
+			return FaultRule{}, fmt.Errorf("bad fault rule %s %q: %v", key, value, err)
+		}
+	}
+	return rule, nil
+}
+
+// parseSettings splits a comma separated list of key=value settings
+// into key and value pairs, in order
+func parseSettings(s string) ([][2]string, error) {
+	var settings [][2]string
+	for _, setting := range strings.Split(s, ",") {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad setting %q, want key=value", setting)
+		}
+		settings = append(settings, [2]string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])})
+	}
+	return settings, nil
+}
+
+// LoadFaultRules reads a list of fault rules from a JSON file
+func LoadFaultRules(filename string) (FaultRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %v", filename, err)
+	}
+	var rules FaultRules
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("error JSON-parsing %q: %v", filename, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("error in %q: %v", filename, err)
+	}
+	return rules, nil
+}
+
+// faultRuleList is a repeatable flag.Value adding a fault rule each time
+type faultRuleList struct {
+	rules *FaultRules
+}
+
+func (l faultRuleList) String() string {
+	if l.rules == nil {
+		return ""
+	}
+	return l.rules.String()
+}
+
+func (l faultRuleList) Set(s string) error {
+	rule, err := ParseFaultRule(s)
+	if err != nil {
+		return err
+	}
+	*l.rules = append(*l.rules, rule)
+	return nil
+}
+
+// faultInjector decides which transitions fail following a list of rules.
+// The zero value injects no faults.
+type faultInjector struct {
+	lock  sync.Mutex
+	rules FaultRules
+	rand  *rand.Rand // own source, so that other random draws don't change the rolls
+}
+
+// seed restarts the rolls from the given seed
+func (f *faultInjector) seed(seed int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rand = rand.New(rand.NewSource(seed))
+}
+
+// set replaces all rules
+func (f *faultInjector) set(rules FaultRules) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rules = append(FaultRules{}, rules...)
+}
+
+// add appends a rule
+func (f *faultInjector) add(rule FaultRule) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rules = append(f.rules, rule)
+}
+
+// list returns a copy of the rules
+func (f *faultInjector) list() FaultRules {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append(FaultRules{}, f.rules...)
+}
+
+// strike tells whether the transition of the VM fails, and how.
+// The first rule matching the transition decides, using up its count
+// if the transition fails.
+func (f *faultInjector) strike(vmID int, kind OperationKind) (FaultOutcome, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, rule := range f.rules {
+		if !rule.matches(vmID, kind) {
+			continue
+		}
+		if f.rand == nil {
+			f.rand = rand.New(rand.NewSource(rand.Int63()))
+		}
+		if f.rand.Float64() >= rule.Probability {
+			return "", false
+		}
+		if rule.Count > 0 {
+			f.rules[i].Count--
+			if f.rules[i].Count == 0 {
+				f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			}
+		}
+		return rule.Outcome, true
+	}
+	return "", false
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseFaultRule(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{spec: "action=launch", want: `{"action":"launch","probability":1,"outcome":""}`},
+		{spec: "vm=2, action=stop, probability=0.5, outcome=rollback, count=1",
+			want: `{"vm":2,"action":"stop","probability":0.5,"outcome":"rollback","count":1}`},
+	} {
+		rule, err := ParseFaultRule(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.String(); got != tc.want {
+			t.Fatalf("%q: got: %s, want: %s", tc.spec, got, tc.want)
+		}
+	}
+	for _, spec := range []string{"vm=two", "probability=high", "launch", "when=now"} {
+		if _, err := ParseFaultRule(spec); err == nil {
+			t.Fatalf("%q: got no error", spec)
+		}
+	}
+}
+
+func TestFaultRuleValidate(t *testing.T) {
+	for _, rule := range []FaultRule{
+		{Probability: 1.5},
+		{Probability: 1, Outcome: "explode"},
+		{Probability: 1, Action: "teleport"},
+		{Probability: 1, Count: -1},
+	} {
+		if err := rule.Validate(); errorCode(err) != ValidationFailed {
+			t.Fatalf("%v: got: %v, want a %v error", rule, err, ValidationFailed)
+		}
+	}
+	rule := FaultRule{Probability: 1}
+	if err := rule.Validate(); err != nil || rule.Outcome != ERRORED {
+		t.Fatalf("got: %v, %v, want outcome %v by default", rule, err, ERRORED)
+	}
+}
+
+func TestFaultInjectorStrike(t *testing.T) {
+	vm := GoodID
+	var f faultInjector
+	f.set(FaultRules{
+		{VM: &vm, Action: LAUNCH, Probability: 1, Outcome: ROLLEDBACK, Count: 1},
+		{Action: LAUNCH, Probability: 0, Outcome: ERRORED},
+		{Probability: 1, Outcome: ERRORED},
+	})
+	for _, tc := range []struct {
+		vm      int
+		kind    OperationKind
+		want    FaultOutcome
+		wantHit bool
+	}{
+		{vm: GoodID, kind: LAUNCH, want: ROLLEDBACK, wantHit: true},
+		{vm: GoodID, kind: LAUNCH}, // the count ran out, next rule never fails
+		{vm: 0, kind: STOP, want: ERRORED, wantHit: true},
+	} {
+		if got, hit := f.strike(tc.vm, tc.kind); got != tc.want || hit != tc.wantHit {
+			t.Fatalf("%s of VM %d: got: %q, %v, want: %q, %v", tc.kind, tc.vm, got, hit, tc.want, tc.wantHit)
+		}
+	}
+	if got := len(f.list()); got != 2 {
+		t.Fatalf("got %d rules left, want: 2", got)
+	}
+}
+
+func TestSeededStrikes(t *testing.T) {
+	strikes := func() (faults, chaos []bool) {
+		var f faultInjector
+		f.seed(42)
+		f.set(FaultRules{{Probability: 0.5, Outcome: ERRORED}})
+		var c chaosMonkey
+		c.seed(42)
+		if err := c.set(ChaosRules{{Fault: SERVERERROR, Probability: 0.5}}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 32; i++ {
+			_, hit := f.strike(0, LAUNCH)
+			faults = append(faults, hit)
+			rand.Int63() // other draws don't change the rolls
+			_, hit = c.strike(APISpec[0], http.MethodGet)
+			chaos = append(chaos, hit)
+		}
+		return faults, chaos
+	}
+	faults, chaos := strikes()
+	againFaults, againChaos := strikes()
+	if !reflect.DeepEqual(faults, againFaults) || !reflect.DeepEqual(chaos, againChaos) {
+		t.Fatalf("got different strikes with the same seed: %v, %v then %v, %v", faults, chaos, againFaults, againChaos)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditOutcome tells whether what an AuditEntry records went well
+type AuditOutcome string
+
+const (
+	// SUCCESS request or transition did what it was meant to
+	SUCCESS AuditOutcome = "success"
+
+	// FAILURE request or transition failed, see the entry error
+	FAILURE AuditOutcome = "failure"
+)
+
+const (
+	// maxJournalEntries is how many entries the journal keeps in memory
+	maxJournalEntries = 4096
+
+	// SystemActor is the actor of the changes the Cloud makes on its own,
+	// such as transitions completing after their delay
+	SystemActor = "system"
+
+	// TransitionAction is the action of audit entries recording a VM
+	// changing its state
+	TransitionAction = "transition"
+
+	// CreatedAction is the action of audit entries recording a VM showing
+	// up, whether created through the API or by the admin API
+	CreatedAction = "created"
+
+	// DeletedAction is the action of audit entries recording a VM going
+	// away, whether deleted through the API or by the admin API
+	DeletedAction = "deleted"
+)
+
+// eventActions are the actions of the audit entries recording events
+var eventActions = map[EventType]string{
+	TRANSITIONED: TransitionAction,
+	CREATED:      CreatedAction,
+	DELETED:      DeletedAction,
+}
+
+// AuditEntry records an API request changing a VM, an admin request changing
+// the backend, or a VM changing state, showing up or going away
+type AuditEntry struct {
+	Seq       uint64       `json:"seq"`                 // Sequence number, increases by 1 on each entry
+	Time      time.Time    `json:"time"`                // When it happened
+	VMID      *int         `json:"vm,omitempty"`        // Id of the VM, unless the request found none or is an admin one
+	Actor     string       `json:"actor"`               // Who did it: the X-Actor request header, the client address, or system
+	RequestID string       `json:"requestId,omitempty"` // X-Request-Id of the API request, if any
+	Action    string       `json:"action"`              // Such as create, launch, delete, reset, or transition, created and deleted for events
+	OldState  VMState      `json:"oldState,omitempty"`  // State before, empty on creation
+	NewState  VMState      `json:"newState,omitempty"`  // State after, empty on deletion
+	Outcome   AuditOutcome `json:"outcome"`             // Value within [success, failure]
+	Error     string       `json:"error,omitempty"`     // Why it failed, if it did
+}
+
+// String on an AuditEntry dumps it in JSON format
+func (e AuditEntry) String() string {
+	entryJSON, err := json.Marshal(e)
+	dieOnError(err, "Can't generate JSON for AuditEntry object %#v", e)
+	return string(entryJSON)
+}
+
+// AuditEntries defines a list of AuditEntries with attached methods
+type AuditEntries []AuditEntry
+
+// String on AuditEntries dumps the list in JSON format
+func (entries AuditEntries) String() string {
+	entriesJSON, err := json.Marshal(entries)
+	dieOnError(err, "Can't generate JSON for AuditEntry objects %#v", entries)
+	return string(entriesJSON)
+}
+
+// auditFilter selects audit entries, all of them if zero
+type auditFilter struct {
+	seq    uint64    // entries after this sequence number
+	since  time.Time // entries at or after this time
+	vm     *int      // entries of this VM
+	action string    // entries of this action
+}
+
+func (f auditFilter) matches(e AuditEntry) bool {
+	return e.Seq > f.seq && !e.Time.Before(f.since) &&
+		(f.vm == nil || (e.VMID != nil && *e.VMID == *f.vm)) &&
+		(f.action == "" || e.Action == f.action)
+}
+
+// journal keeps the last audit entries, mirroring them all to a writer
+// if set. Entries are mirrored in the background, so that a slow writer
+// never holds up the changes being recorded.
+// The zero value is ready to use.
+type journal struct {
+	lock     sync.Mutex
+	seq      uint64
+	entries  []AuditEntry
+	mirror   io.Writer    // gets every entry as a JSON line, if set
+	queue    []AuditEntry // entries yet to be mirrored
+	writing  bool         // whether a goroutine is mirroring the queue
+	mirrored *sync.Cond   // broadcast once the queue is mirrored
+	clock    Clock        // stamps entries, the system clock if nil
+}
+
+// useClock makes the journal stamp entries with the given clock
+func (j *journal) useClock(clock Clock) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.clock = clock
+}
+
+// mirrorTo makes the journal write every entry from now on as a JSON line
+func (j *journal) mirrorTo(w io.Writer) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.mirror = w
+}
+
+// record stamps the entry with the next sequence number and the current
+// time, then keeps it
+func (j *journal) record(e AuditEntry) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.seq++
+	e.Seq = j.seq
+	e.Time = clockOrSystem(j.clock).Now()
+	j.entries = append(j.entries, e)
+	if len(j.entries) > maxJournalEntries {
+		j.entries = j.entries[len(j.entries)-maxJournalEntries:]
+	}
+	if j.mirror != nil {
+		j.queue = append(j.queue, e)
+		if !j.writing {
+			j.writing = true
+			go j.writeMirror()
+		}
+	}
+}
+
+// writeMirror writes the queued entries to the mirror until none is left,
+// without holding the lock while writing
+func (j *journal) writeMirror() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for len(j.queue) > 0 {
+		queue, mirror := j.queue, j.mirror
+		j.queue = nil
+		j.lock.Unlock()
+		for _, e := range queue {
+			if _, err := fmt.Fprintln(mirror, e); err != nil {
+				log.Printf("error mirroring audit entry: %v", err)
+			}
+		}
+		j.lock.Lock()
+	}
+	j.writing = false
+	j.mirroredCond().Broadcast()
+}
+
+// flush waits for the entries recorded so far to be mirrored
+func (j *journal) flush() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for j.writing {
+		j.mirroredCond().Wait()
+	}
+}
+
+// mirroredCond returns the condition broadcast once the queue is mirrored,
+// creating it if needed.
+// Must be called holding the lock.
+func (j *journal) mirroredCond() *sync.Cond {
+	if j.mirrored == nil {
+		j.mirrored = sync.NewCond(&j.lock)
+	}
+	return j.mirrored
+}
+
+// query returns the entries kept matching the filter, oldest first
+func (j *journal) query(filter auditFilter) AuditEntries {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entries := AuditEntries{}
+	for _, e := range j.entries {
+		if filter.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// requester tells who sent an API request, for the audit log
+type requester struct {
+	actor     string
+	requestID string
+}
+
+// requestSeq numbers the requests with no X-Request-Id header
+var requestSeq uint64
+
+// ensureRequestID gives the request an X-Request-Id header unless it has
+// one, and replies with it
+func ensureRequestID(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = fmt.Sprintf("req-%d", atomic.AddUint64(&requestSeq, 1))
+		r.Header.Set("X-Request-Id", requestID)
+	}
+	w.Header().Set("X-Request-Id", requestID)
+}
+
+// requesterOf returns who sent the request: the X-Actor header, or the
+// client address if unset
+func requesterOf(r *http.Request) requester {
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		actor = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			actor = host
+		}
+	}
+	return requester{actor: actor, requestID: r.Header.Get("X-Request-Id")}
+}
+
+// audit records an API request changing the VM with the given id, if
+// any, which was in the given state before, along with its outcome
+func (s *VMServer) audit(req requester, action string, id *int, old VMState, err error) {
+	e := AuditEntry{VMID: id, Actor: req.actor, RequestID: req.requestID, Action: action, OldState: old, Outcome: SUCCESS}
+	if id != nil {
+		if vm, found := s.vmm.Inspect(*id); found {
+			e.NewState = vm.State
+		}
+	}
+	if err != nil {
+		e.Outcome = FAILURE
+		e.Error = err.Error()
+	}
+	s.vmm.Audit(e)
+}
+
+// auditTarget returns the id of the VM for its audit entries along with
+// its state, nil and empty if not found
+func (s *VMServer) auditTarget(id int) (*int, VMState) {
+	vm, found := s.vmm.Inspect(id)
+	if !found {
+		return nil, ""
+	}
+	return &id, vm.State
+}
+
+// history replies with the audit entries of a VM, even if it was deleted
+func (s *VMServer) history(id int, w http.ResponseWriter, r *http.Request) {
+	entries := s.vmm.AuditLog(auditFilter{vm: &id})
+	if _, found := s.vmm.Inspect(id); !found && len(entries) == 0 {
+		writeError(w, r, newError(NotFound, "not found VM with id %d", id))
+		return
+	}
+	fmt.Fprint(w, entries)
+}
+
+// auditLog replies with the audit entries after ?since=, of ?vm= and of
+// ?action=, if set
+func (s *VMServer) auditLog(w http.ResponseWriter, r *http.Request) {
+	var filter auditFilter
+	query := r.URL.Query()
+	if since := query.Get("since"); since != "" {
+		var err error
+		if filter.seq, err = strconv.ParseUint(since, 10, 64); err != nil {
+			if filter.since, err = time.Parse(time.RFC3339, since); err != nil {
+				writeError(w, r, newError(BadRequest, "bad since %q, want a sequence number or a RFC 3339 time", since))
+				return
+			}
+		}
+	}
+	if vm := query.Get("vm"); vm != "" {
+		id, err := strconv.Atoi(vm)
+		if err != nil {
+			writeError(w, r, newError(BadRequest, "bad vm %q: %v", vm, err))
+			return
+		}
+		filter.vm = &id
+	}
+	filter.action = query.Get("action")
+	fmt.Fprint(w, s.vmm.AuditLog(filter))
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	server := NewVMServer(defaultVMs.clone())
+	server.vmm.UseClock(newTestClock())
+	var mirror bytes.Buffer
+	server.vmm.MirrorAudit(&mirror)
+	for _, tc := range []struct {
+		path    string
+		advance time.Duration
+	}{
+		{path: "/vms/1/launch"},
+		{path: "/vms/1/stop", advance: time.Duration(2*DefaultStartDelay) * timeUnit},
+		{path: "/vms/1/stop", advance: time.Duration(2*DefaultStopDelay) * timeUnit},
+	} {
+		r := httptest.NewRequest(http.MethodPut, tc.path, nil)
+		r.Header.Set("X-Actor", "alice")
+		r.Header.Set("X-Request-Id", fmt.Sprint("req-", tc.advance))
+		server.ServeHTTP(httptest.NewRecorder(), r)
+		server.vmm.AdvanceClock(tc.advance)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/vms/1", nil))
+	if got := w.Header().Get("X-Request-Id"); got == "" {
+		t.Fatalf("got no X-Request-Id reply header")
+	}
+
+	id := GoodID
+	history := server.vmm.AuditLog(auditFilter{vm: &id})
+	startRequest := fmt.Sprint("req-", time.Duration(2*DefaultStartDelay)*timeUnit)
+	want := []AuditEntry{
+		{Actor: SystemActor, Action: TransitionAction, OldState: STOPPED, NewState: STARTING, Outcome: SUCCESS},
+		{Actor: "alice", RequestID: "req-0s", Action: "launch", OldState: STOPPED, NewState: STARTING, Outcome: SUCCESS},
+		{Actor: "alice", RequestID: startRequest, Action: "stop", OldState: STARTING, NewState: STARTING, Outcome: FAILURE},
+		{Actor: SystemActor, Action: TransitionAction, OldState: STARTING, NewState: RUNNING, Outcome: SUCCESS},
+		{Actor: SystemActor, Action: TransitionAction, OldState: RUNNING, NewState: STOPPING, Outcome: SUCCESS},
+		{Actor: "alice", RequestID: fmt.Sprint("req-", time.Duration(2*DefaultStopDelay)*timeUnit), Action: "stop", OldState: RUNNING, NewState: STOPPING, Outcome: SUCCESS},
+		{Actor: SystemActor, Action: TransitionAction, OldState: STOPPING, NewState: STOPPED, Outcome: SUCCESS},
+		{Actor: SystemActor, Action: DeletedAction, OldState: STOPPED, Outcome: SUCCESS},
+		{Actor: "192.0.2.1", RequestID: w.Header().Get("X-Request-Id"), Action: "delete", OldState: STOPPED, Outcome: SUCCESS},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("got history: %v, want %d entries", history, len(want))
+	}
+	for i, e := range history {
+		if e.VMID == nil || *e.VMID != GoodID || e.Time.Before(testStart) {
+			t.Fatalf("entry #%d: got: %v, want one of VM %d stamped after %v", i, e, GoodID, testStart)
+		}
+		want[i].Seq, want[i].Time, want[i].VMID, want[i].Error = e.Seq, e.Time, e.VMID, e.Error
+		if e != want[i] {
+			t.Errorf("entry #%d: got: %v, want: %v", i, e, want[i])
+		}
+	}
+	if history[2].Error == "" {
+		t.Errorf("got: %v, want an error on the failed stop", history[2])
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/vms/1/history", nil))
+	if w.Code != http.StatusOK || w.Body.String() != history.String() {
+		t.Fatalf("got: %d %s, want the history of the deleted VM: %v", w.Code, w.Body, history)
+	}
+	server.vmm.FlushAudit()
+	if lines := strings.Split(strings.TrimSpace(mirror.String()), "\n"); len(lines) != len(history) || lines[0] != history[0].String() {
+		t.Fatalf("got mirrored: %s, want the %d entries as JSON lines", &mirror, len(history))
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{query: "", want: len(history)},
+		{query: "?action=transition", want: 4},
+		{query: fmt.Sprintf("?since=%d", history[5].Seq), want: 3},
+		{query: "?since=" + testStart.Add(time.Hour).Format(time.RFC3339), want: 0},
+		{query: "?vm=2", want: 0},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit"+tc.query, nil))
+		var got AuditEntries
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != tc.want {
+			t.Errorf("GET /audit%s: got: %s (%v), want %d entries", tc.query, w.Body, err, tc.want)
+		}
+	}
+
+	// Admin requests replacing all VMs are audited too, along with the VMs
+	// going away and showing up
+	admin := server.AdminHandler(testAdminToken)
+	requests := []struct{ method, path, body string }{
+		{method: http.MethodPost, path: "/admin/reset"},
+		{method: http.MethodPost, path: "/admin/snapshots/none/restore"},
+		{method: http.MethodDelete, path: "/admin/chaos"},
+		{method: http.MethodPut, path: "/admin/clock", body: `{"timeScale":0}`},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		r.Header.Set("X-Actor", "bob")
+		admin.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	last := history[len(history)-1].Seq
+	replaced := server.vmm.AuditLog(auditFilter{seq: last})
+	if n := len(defaultVMs) - 1 + len(defaultVMs) + len(requests); len(replaced) != n {
+		t.Fatalf("got: %v, want %d entries: the VMs deleted and created, then the requests", replaced, n)
+	}
+	got := append(server.vmm.AuditLog(auditFilter{seq: last, vm: &id}), replaced[len(replaced)-len(requests):]...)
+	want = []AuditEntry{
+		{Actor: SystemActor, Action: CreatedAction, NewState: defaultVMs[GoodID].State, Outcome: SUCCESS},
+		{Actor: "bob", Action: "reset", Outcome: SUCCESS},
+		{Actor: "bob", Action: "restore", Outcome: FAILURE, Error: `not found snapshot "none"`},
+		{Actor: "bob", Action: "clear-chaos", Outcome: SUCCESS},
+		{Actor: "bob", Action: "set-time-scale", Outcome: FAILURE, Error: "clock error: time scale must be a positive number"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got: %v, want VM %d created, then the requests", got, GoodID)
+	}
+	for i, e := range got {
+		if i > 0 && e.RequestID == "" {
+			t.Errorf("entry #%d: got: %v, want a request id", i, e)
+		}
+		if i == 0 {
+			want[i].VMID = e.VMID
+		}
+		want[i].Seq, want[i].Time, want[i].RequestID = e.Seq, e.Time, e.RequestID
+		if e != want[i] {
+			t.Errorf("entry #%d: got: %v, want: %v", i, e, want[i])
+		}
+	}
+}
+
+// blockingWriter blocks writes until unblocked
+type blockingWriter struct {
+	unblock chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(data []byte) (int, error) {
+	<-w.unblock
+	return w.buf.Write(data)
+}
+
+func TestJournalMirrorsInBackground(t *testing.T) {
+	var j journal
+	mirror := &blockingWriter{unblock: make(chan struct{})}
+	j.mirrorTo(mirror)
+	recorded := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			j.record(AuditEntry{Actor: SystemActor, Action: TransitionAction, Outcome: SUCCESS})
+		}
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Fatalf("recording waited on the mirror")
+	}
+	close(mirror.unblock)
+	j.flush()
+	if got := strings.Count(mirror.buf.String(), "\n"); got != 10 {
+		t.Fatalf("got %d entries mirrored, want 10", got)
+	}
+}
+
+func TestJournalKeepsLastEntries(t *testing.T) {
+	var j journal
+	for i := 0; i < maxJournalEntries+10; i++ {
+		j.record(AuditEntry{Actor: SystemActor, Action: TransitionAction, Outcome: SUCCESS})
+	}
+	entries := j.query(auditFilter{})
+	if len(entries) != maxJournalEntries || entries[0].Seq != 11 {
+		t.Fatalf("got %d entries from seq %d, want the last %d only", len(entries), entries[0].Seq, maxJournalEntries)
+	}
+}
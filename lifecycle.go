@@ -0,0 +1,370 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle is the state machine VMs follow: the states they can be in and
+// the transitions allowed between them.
+// Transitions happen either when an action such as launch is requested
+// through the API, or on their own after a delay. States with a delayed
+// transition out are intermediate states, VMs stay there while the
+// operation of the action leading to them is in progress.
+type Lifecycle struct {
+	Initial     VMState          `json:"initial"` // State of new VMs
+	States      []VMState        `json:"states"`
+	Transitions []TransitionSpec `json:"transitions"`
+}
+
+// TransitionSpec allows VMs to move from a state to another.
+// Transitions with neither an action nor a delay are only taken on failures,
+// the first one out of a state is where its VMs go when a fault hits them.
+type TransitionSpec struct {
+	From   VMState       `json:"from"`
+	To     VMState       `json:"to"`
+	Action OperationKind `json:"action,omitempty"` // Requested through the API, if set
+	Delay  *DelayRange   `json:"delay,omitempty"`  // Taken on its own after a delay, if set
+}
+
+// DelayRange bounds a random delay, measured in timeUnits
+type DelayRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// Duration picks a random delay within the range
+func (d DelayRange) Duration() time.Duration {
+	return randomDuration(time.Duration(d.Min*float64(timeUnit)), time.Duration(d.Max*float64(timeUnit)))
+}
+
+// delayRangeFields is a DelayRange without its JSON methods
+type delayRangeFields DelayRange
+
+// MarshalJSON dumps fixed delays as a plain number, ranges as an object
+func (d DelayRange) MarshalJSON() ([]byte, error) {
+	if d.Min == d.Max {
+		return json.Marshal(d.Min)
+	}
+	return json.Marshal(delayRangeFields(d))
+}
+
+// UnmarshalJSON reads either a plain number, for a fixed delay, or a
+// {"min":...,"max":...} range
+func (d *DelayRange) UnmarshalJSON(data []byte) error {
+	var fixed float64
+	if err := json.Unmarshal(data, &fixed); err == nil {
+		*d = DelayRange{Min: fixed, Max: fixed}
+		return nil
+	}
+	var fields delayRangeFields
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fields); err != nil {
+		return fmt.Errorf("delay must be a number or a min/max range: %v", err)
+	}
+	*d = DelayRange(fields)
+	return nil
+}
+
+// valid tells whether the range is within positive bounds, in order
+func (d DelayRange) valid() bool {
+	return d.Min >= 0 && d.Max >= d.Min
+}
+
+// delayAround returns a delay range averaging the given timeUnits
+func delayAround(units int) *DelayRange {
+	return &DelayRange{Min: 1, Max: float64(2*units - 1)}
+}
+
+// DefaultLifecycle is the lifecycle used unless another one is loaded
+var DefaultLifecycle = Lifecycle{
+	Initial: PROVISIONING,
+	States:  []VMState{PROVISIONING, STOPPED, STARTING, RUNNING, STOPPING, SUSPENDING, SUSPENDED, RESUMING, REBOOTING, ERROR},
+	Transitions: []TransitionSpec{
+		{From: PROVISIONING, To: STOPPED, Delay: delayAround(DefaultProvisionDelay)},
+		{From: STOPPED, To: STARTING, Action: LAUNCH},
+		{From: STARTING, To: RUNNING, Delay: delayAround(DefaultStartDelay)},
+		{From: RUNNING, To: STOPPING, Action: STOP},
+		{From: SUSPENDED, To: STOPPING, Action: STOP},
+		{From: ERROR, To: STOPPING, Action: STOP},
+		{From: STOPPING, To: STOPPED, Delay: delayAround(DefaultStopDelay)},
+		{From: RUNNING, To: SUSPENDING, Action: SUSPEND},
+		{From: SUSPENDING, To: SUSPENDED, Delay: delayAround(DefaultSuspendDelay)},
+		{From: SUSPENDED, To: RESUMING, Action: RESUME},
+		{From: RESUMING, To: RUNNING, Delay: delayAround(DefaultResumeDelay)},
+		{From: RUNNING, To: REBOOTING, Action: REBOOT},
+		{From: REBOOTING, To: RUNNING, Delay: delayAround(DefaultRebootDelay)},
+		{From: PROVISIONING, To: ERROR},
+		{From: STARTING, To: ERROR},
+		{From: STOPPING, To: ERROR},
+		{From: SUSPENDING, To: ERROR},
+		{From: RESUMING, To: ERROR},
+		{From: REBOOTING, To: ERROR},
+	},
+}
+
+// Action describes how an operation moves its VM: right away from any of
+// the From states to the Via state, then to the To state after a Delay.
+// Cancelling the operation rolls the VM back to the state it was in.
+type Action struct {
+	From  []VMState // the first one is assumed for operations resumed on restart
+	Via   VMState
+	To    VMState
+	Delay DelayRange
+}
+
+// startsFrom tells whether the action can be requested in the given state
+func (a Action) startsFrom(state VMState) bool {
+	for _, from := range a.From {
+		if from == state {
+			return true
+		}
+	}
+	return false
+}
+
+// lifecycleRules are the rules VMs follow, compiled from a Lifecycle
+type lifecycleRules struct {
+	states   []VMState                // all states, in lifecycle order
+	allowed  map[VMState][]VMState    // states each state can transition to
+	actions  map[OperationKind]Action // by kind of the operation performing them
+	kinds    []OperationKind          // actions requested through the API, in lifecycle order
+	failures map[VMState]VMState      // state each state moves to on failures, if any
+}
+
+// rules in use, replaced as a whole by UseLifecycle, as VM transitions in
+// progress keep reading them
+var rules atomic.Value // *lifecycleRules
+
+// currentRules returns the rules of the lifecycle in use
+func currentRules() *lifecycleRules {
+	return rules.Load().(*lifecycleRules)
+}
+
+func init() {
+	dieOnError(UseLifecycle(DefaultLifecycle), "Invalid default lifecycle")
+}
+
+// UseLifecycle validates the lifecycle and makes VMs follow it from now on,
+// serving an endpoint per action.
+// Provision is always one of the actions, but it is not requested through
+// the API, it is performed on every new VM.
+// Must be called before VMs are served.
+func UseLifecycle(l Lifecycle) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	r := &lifecycleRules{
+		states:   l.States,
+		allowed:  make(map[VMState][]VMState, len(l.States)),
+		failures: make(map[VMState]VMState),
+	}
+	for _, state := range l.States {
+		r.allowed[state] = []VMState{}
+	}
+	for _, t := range l.Transitions {
+		r.allowed[t.From] = append(r.allowed[t.From], t.To)
+		if _, found := r.failures[t.From]; !found && t.Action == "" && t.Delay == nil {
+			r.failures[t.From] = t.To
+		}
+	}
+	delayed := l.delayedTransitions()
+	provision := Action{Via: l.Initial, To: l.Initial}
+	if t, found := delayed[l.Initial]; found {
+		provision.To, provision.Delay = t.To, *t.Delay
+	}
+	r.actions = map[OperationKind]Action{PROVISION: provision}
+	for _, t := range l.Transitions {
+		if t.Action == "" {
+			continue
+		}
+		action, found := r.actions[t.Action]
+		if !found {
+			action = Action{Via: t.To, To: delayed[t.To].To, Delay: *delayed[t.To].Delay}
+			r.kinds = append(r.kinds, t.Action)
+		}
+		action.From = append(action.From, t.From)
+		r.actions[t.Action] = action
+	}
+	rules.Store(r)
+	APISpec = withActionEndpoints(baseAPISpec, r.kinds)
+	return nil
+}
+
+// LoadLifecycle reads a lifecycle from a JSON file, or a YAML one if its
+// extension is .yaml or .yml
+func LoadLifecycle(filename string) (Lifecycle, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Lifecycle{}, fmt.Errorf("error reading %q: %v", filename, err)
+	}
+	format := "JSON"
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".yaml" || ext == ".yml" {
+		format = "YAML"
+		if data, err = yamlToJSON(data); err != nil {
+			return Lifecycle{}, fmt.Errorf("error YAML-parsing %q: %v", filename, err)
+		}
+	}
+	var l Lifecycle
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&l); err != nil {
+		return Lifecycle{}, fmt.Errorf("error %s-parsing %q: %v", format, filename, err)
+	}
+	return l, nil
+}
+
+// actionName is what action names look like, as they become endpoint paths
+var actionName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// reservedActions can't be lifecycle actions, as their names are taken by
+// other endpoints or WebSocket API commands
+var reservedActions = map[OperationKind]bool{
+	PROVISION: true, "events": true, "cancel": true,
+	"list": true, "create": true, "inspect": true, "resize": true, "delete": true,
+	"subscribe": true, "unsubscribe": true, "action": true,
+}
+
+// Validate checks the lifecycle is consistent:
+// - all transitions are between known states.
+// - all states are reachable from the initial state.
+// - actions always lead to the same intermediate state.
+// - there is a Stopped state, where VMs can be resized and deleted.
+func (l Lifecycle) Validate() error {
+	known := make(map[VMState]bool, len(l.States))
+	for _, state := range l.States {
+		if state == "" {
+			return fmt.Errorf("lifecycle error: empty state name")
+		}
+		if known[state] {
+			return fmt.Errorf("lifecycle error: duplicated state %q", state)
+		}
+		known[state] = true
+	}
+	if !known[l.Initial] {
+		return fmt.Errorf("lifecycle error: unknown initial state %q", l.Initial)
+	}
+	if !known[STOPPED] {
+		return fmt.Errorf("lifecycle error: missing state %q, where VMs can be resized and deleted", STOPPED)
+	}
+	delayed := make(map[VMState]bool)
+	for _, t := range l.Transitions {
+		if !known[t.From] {
+			return fmt.Errorf("lifecycle error: transition from unknown state %q", t.From)
+		}
+		if !known[t.To] {
+			return fmt.Errorf("lifecycle error: transition from %q to unknown state %q", t.From, t.To)
+		}
+		if t.Delay == nil {
+			continue
+		}
+		if t.Action != "" {
+			return fmt.Errorf("lifecycle error: transition from %q to %q can't have both an action and a delay", t.From, t.To)
+		}
+		if delayed[t.From] {
+			return fmt.Errorf("lifecycle error: state %q has more than one delayed transition", t.From)
+		}
+		if !t.Delay.valid() {
+			return fmt.Errorf("lifecycle error: bad delay range [%v, %v] from %q to %q", t.Delay.Min, t.Delay.Max, t.From, t.To)
+		}
+		delayed[t.From] = true
+	}
+	via := make(map[OperationKind]VMState)
+	// Each transitional state belongs to a single action, so that VMs
+	// caught in one resume a single operation
+	byVia := make(map[VMState]OperationKind)
+	if delayed[l.Initial] {
+		byVia[l.Initial] = PROVISION
+	}
+	for _, t := range l.Transitions {
+		if t.Action == "" {
+			continue
+		}
+		if !actionName.MatchString(string(t.Action)) || reservedActions[t.Action] {
+			return fmt.Errorf("lifecycle error: bad action name %q", t.Action)
+		}
+		if !delayed[t.To] {
+			return fmt.Errorf("lifecycle error: action %q leads to %q, which has no delayed transition out", t.Action, t.To)
+		}
+		if delayed[t.From] {
+			return fmt.Errorf("lifecycle error: action %q starts from intermediate state %q", t.Action, t.From)
+		}
+		if state, found := via[t.Action]; found && state != t.To {
+			return fmt.Errorf("lifecycle error: action %q leads to both %q and %q", t.Action, state, t.To)
+		}
+		if kind, found := byVia[t.To]; found && kind != t.Action {
+			return fmt.Errorf("lifecycle error: actions %q and %q both lead to %q", kind, t.Action, t.To)
+		}
+		via[t.Action] = t.To
+		byVia[t.To] = t.Action
+	}
+	reached := map[VMState]bool{l.Initial: true}
+	for pending := []VMState{l.Initial}; len(pending) > 0; pending = pending[1:] {
+		for _, t := range l.Transitions {
+			if t.From == pending[0] && !reached[t.To] {
+				reached[t.To] = true
+				pending = append(pending, t.To)
+			}
+		}
+	}
+	var unreachable []string
+	for _, state := range l.States {
+		if !reached[state] {
+			unreachable = append(unreachable, string(state))
+		}
+	}
+	if len(unreachable) > 0 {
+		return fmt.Errorf("lifecycle error: unreachable states from %q: %s", l.Initial, strings.Join(unreachable, ", "))
+	}
+	return nil
+}
+
+// delayedTransitions returns the delayed transition out of each
+// intermediate state
+func (l Lifecycle) delayedTransitions() map[VMState]TransitionSpec {
+	delayed := make(map[VMState]TransitionSpec)
+	for _, t := range l.Transitions {
+		if t.Delay != nil {
+			delayed[t.From] = t
+		}
+	}
+	return delayed
+}
+
+// isAction tells whether kind is an action requested through the API
+func isAction(kind OperationKind) bool {
+	_, found := currentRules().actions[kind]
+	return found && kind != PROVISION
+}
+
+// canTransition tells whether the lifecycle in use lets from move to to
+func canTransition(from, to VMState) bool {
+	for _, allowed := range currentRules().allowed[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStates returns an error if any VM is in a state the lifecycle
+// in use does not know about
+func checkStates(vms VMs) error {
+	for id, vm := range vms {
+		if _, found := currentRules().allowed[vm.State]; !found {
+			return fmt.Errorf("VM %d has unknown state %q", id, vm.State)
+		}
+	}
+	return nil
+}
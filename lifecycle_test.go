@@ -0,0 +1,169 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDefaultLifecycle(t *testing.T) {
+	if err := DefaultLifecycle.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []OperationKind{LAUNCH, STOP, SUSPEND, RESUME, REBOOT} {
+		if !isAction(kind) {
+			t.Fatalf("missing action %q", kind)
+		}
+	}
+	if got := currentRules().actions[PROVISION]; got.Via != PROVISIONING || got.To != STOPPED {
+		t.Fatalf("got provision: %+v, want from %v to %v", got, PROVISIONING, STOPPED)
+	}
+}
+
+func lifecycleWith(transitions ...TransitionSpec) Lifecycle {
+	return Lifecycle{
+		Initial:     STOPPED,
+		States:      []VMState{STOPPED, STARTING, RUNNING},
+		Transitions: transitions,
+	}
+}
+
+var lifecycleErrors = []struct {
+	lifecycle Lifecycle
+	want      string
+}{
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: LAUNCH},
+		TransitionSpec{From: RUNNING, To: STARTING, Action: REBOOT},
+		TransitionSpec{From: STARTING, To: RUNNING, Delay: &DelayRange{Min: 1, Max: 2}}),
+		want: `lifecycle error: actions "launch" and "reboot" both lead to "Starting"`},
+	{lifecycle: Lifecycle{Initial: "Building", States: []VMState{"Building", STOPPED}, Transitions: []TransitionSpec{
+		{From: "Building", To: STOPPED, Delay: &DelayRange{Min: 1, Max: 2}},
+		{From: STOPPED, To: "Building", Action: "rebuild"},
+	}},
+		want: `lifecycle error: actions "provision" and "rebuild" both lead to "Building"`},
+	{lifecycle: Lifecycle{Initial: "Off", States: []VMState{STOPPED}},
+		want: `lifecycle error: unknown initial state "Off"`},
+	{lifecycle: Lifecycle{Initial: RUNNING, States: []VMState{RUNNING}},
+		want: `lifecycle error: missing state "Stopped", where VMs can be resized and deleted`},
+	{lifecycle: Lifecycle{Initial: STOPPED, States: []VMState{STOPPED, STOPPED}},
+		want: `lifecycle error: duplicated state "Stopped"`},
+	{lifecycle: lifecycleWith(TransitionSpec{From: STOPPED, To: "Paused"}),
+		want: `lifecycle error: transition from "Stopped" to unknown state "Paused"`},
+	{lifecycle: lifecycleWith(TransitionSpec{From: "Paused", To: STOPPED}),
+		want: `lifecycle error: transition from unknown state "Paused"`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: LAUNCH},
+		TransitionSpec{From: STARTING, To: STOPPED, Delay: &DelayRange{Min: 1, Max: 2}}),
+		want: `lifecycle error: unreachable states from "Stopped": Running`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: LAUNCH},
+		TransitionSpec{From: STARTING, To: RUNNING}),
+		want: `lifecycle error: action "launch" leads to "Starting", which has no delayed transition out`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: LAUNCH},
+		TransitionSpec{From: STARTING, To: RUNNING, Delay: &DelayRange{Min: 2, Max: 1}}),
+		want: `lifecycle error: bad delay range [2, 1] from "Starting" to "Running"`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: LAUNCH},
+		TransitionSpec{From: STARTING, To: RUNNING, Delay: &DelayRange{Min: 1, Max: 2}},
+		TransitionSpec{From: STARTING, To: STOPPED, Delay: &DelayRange{Min: 1, Max: 2}}),
+		want: `lifecycle error: state "Starting" has more than one delayed transition`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: "cancel"},
+		TransitionSpec{From: STARTING, To: RUNNING, Delay: &DelayRange{Min: 1, Max: 2}}),
+		want: `lifecycle error: bad action name "cancel"`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: "Go Now"},
+		TransitionSpec{From: STARTING, To: RUNNING, Delay: &DelayRange{Min: 1, Max: 2}}),
+		want: `lifecycle error: bad action name "Go Now"`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: LAUNCH},
+		TransitionSpec{From: STARTING, To: RUNNING, Delay: &DelayRange{Min: 1, Max: 2}},
+		TransitionSpec{From: STARTING, To: STARTING, Action: "retry"}),
+		want: `lifecycle error: action "retry" starts from intermediate state "Starting"`},
+	{lifecycle: lifecycleWith(
+		TransitionSpec{From: STOPPED, To: STARTING, Action: LAUNCH},
+		TransitionSpec{From: STARTING, To: RUNNING, Delay: &DelayRange{Min: 1, Max: 2}},
+		TransitionSpec{From: RUNNING, To: STOPPED, Action: LAUNCH, Delay: &DelayRange{Min: 1, Max: 2}}),
+		want: `lifecycle error: transition from "Running" to "Stopped" can't have both an action and a delay`},
+}
+
+func TestLifecycleErrors(t *testing.T) {
+	for _, tc := range lifecycleErrors {
+		if got := tc.lifecycle.Validate(); got == nil || got.Error() != tc.want {
+			t.Fatalf("got: %v, want: %q", got, tc.want)
+		}
+	}
+}
+
+func TestLoadLifecycleYAML(t *testing.T) {
+	want, err := LoadLifecycle("lifecycles/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadLifecycle("lifecycles/basic.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %+v, want the same as the JSON file: %+v", got, want)
+	}
+}
+
+func TestUseLifecycle(t *testing.T) {
+	shrinkTime()
+	lifecycle, err := LoadLifecycle("lifecycles/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lifecycle.States = append(lifecycle.States, "Hibernating", "Hibernated")
+	lifecycle.Transitions = append(lifecycle.Transitions,
+		TransitionSpec{From: RUNNING, To: "Hibernating", Action: "hibernate"},
+		TransitionSpec{From: "Hibernating", To: "Hibernated", Delay: &DelayRange{Min: 1, Max: 2}},
+		TransitionSpec{From: "Hibernated", To: STARTING, Action: LAUNCH},
+	)
+	if err := UseLifecycle(lifecycle); err != nil {
+		t.Fatal(err)
+	}
+	defer UseLifecycle(DefaultLifecycle)
+
+	server := NewVMServer(defaultVMs.clone())
+	op, vm, err := server.vmm.CreateOperation(*VMInState(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.State != STOPPED {
+		t.Fatalf("got: %v, want new VMs %v", vm.State, STOPPED)
+	}
+	if err := waitDone(op.Done(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	forceState(server.vmm, 0, RUNNING)
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPut, "/vms/0/hibernate", http.StatusAccepted},
+		{http.MethodPut, "/vms/1/hibernate", http.StatusConflict},
+		{http.MethodPut, "/vms/1/suspend", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.want {
+			t.Fatalf("%s %s: got status: %d, want: %d (body: %s)", tc.method, tc.path, w.Code, tc.want, w.Body)
+		}
+	}
+	// Don't let the hibernation finish on the default lifecycle
+	if _, err := server.vmm.Cancel(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentRules().actions[LAUNCH].From; len(got) != 2 || got[0] != STOPPED || got[1] != "Hibernated" {
+		t.Fatalf("got launch from: %v, want: [Stopped Hibernated]", got)
+	}
+}
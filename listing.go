@@ -0,0 +1,436 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listedVM is a VM along with its id, as listed by GET /vms
+type listedVM struct {
+	id int
+	vm VM
+}
+
+// vmField is a field of the listed VMs to filter and sort them on
+type vmField struct {
+	value func(v listedVM) interface{}        // a float64, string or time.Time
+	parse func(s string) (interface{}, error) // reads a value to compare with
+}
+
+func parseNumber(s string) (interface{}, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseString(s string) (interface{}, error) {
+	return s, nil
+}
+
+func parseTime(s string) (interface{}, error) {
+	return time.Parse(time.RFC3339, s)
+}
+
+// vmFields are the fields to filter and sort VMs on, by JSON name
+var vmFields = map[string]vmField{
+	"id":      {func(v listedVM) interface{} { return float64(v.id) }, parseNumber},
+	"vcpus":   {func(v listedVM) interface{} { return float64(v.vm.VCPUS) }, parseNumber},
+	"clock":   {func(v listedVM) interface{} { return float64(v.vm.Clock) }, parseNumber},
+	"ram":     {func(v listedVM) interface{} { return float64(v.vm.RAM) }, parseNumber},
+	"storage": {func(v listedVM) interface{} { return float64(v.vm.Storage) }, parseNumber},
+	"network": {func(v listedVM) interface{} { return float64(v.vm.Network) }, parseNumber},
+	"state":   {func(v listedVM) interface{} { return string(v.vm.State) }, parseString},
+	"due": {func(v listedVM) interface{} {
+		if v.vm.Due == nil {
+			return time.Time{}
+		}
+		return *v.vm.Due
+	}, parseTime},
+}
+
+// selectableFields are the fields to pick with ?fields=, beyond vmFields
+var selectableFields = []string{"startDelay", "stopDelay"}
+
+// compareValues returns -1, 0 or 1 as a is before, equal or after b, both
+// values of the same vmField
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+	}
+	return 0
+}
+
+// listFilter keeps the VMs whose field compares with op to any of values,
+// or none of them for !=
+type listFilter struct {
+	field  string
+	op     string
+	values []interface{}
+}
+
+func (f listFilter) keeps(v listedVM) bool {
+	value := vmFields[f.field].value(v)
+	for _, want := range f.values {
+		c := compareValues(value, want)
+		switch f.op {
+		case "=":
+			if c == 0 {
+				return true
+			}
+		case "!=":
+			if c == 0 {
+				return false
+			}
+		case ">":
+			return c > 0
+		case ">=":
+			return c >= 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		}
+	}
+	return f.op == "!="
+}
+
+// sortKey sorts VMs on a field, in descending order if desc
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// pageCursor is the contents of a page token: the last VM of the previous
+// page, and the sort it was listed with. Pages go on right after that VM
+// in the sort order, so that VMs changing or going away in between don't
+// shift the following pages.
+type pageCursor struct {
+	Sort string `json:"sort"`
+	ID   int    `json:"id"`
+	VM   VM     `json:"vm"`
+}
+
+// listQuery is how GET /vms filters, sorts, pages and shapes the VMs
+type listQuery struct {
+	filters []listFilter
+	sort    []sortKey // always ending with the id, so that no two VMs tie
+	fields  []string  // all of them if empty
+	array   bool      // reply with an array of VMs with their ids
+	limit   int       // all of them if 0
+	after   *pageCursor
+}
+
+// listOptions are the query parameters of GET /vms not filtering on a field
+var listOptions = []string{"sort", "fields", "format", "limit", "page_token"}
+
+// listParam matches a query parameter of GET /vms, such as ram>=8192
+var listParam = regexp.MustCompile(`^([A-Za-z_]+)(>=|<=|!=|=|>|<)(.*)$`)
+
+// parseListQuery reads the raw query of GET /vms. Parameters named after a
+// VM field filter the VMs on it, such as state=Running,Suspended or
+// ram>=8192. Parameters that are neither fields nor listOptions are
+// ignored, as GET /vms always did, so that clients may add their own such
+// as cache busters.
+func parseListQuery(rawQuery string) (listQuery, error) {
+	var q listQuery
+	var pageToken string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		unescaped, err := url.QueryUnescape(param)
+		if err != nil {
+			return q, newError(BadRequest, "bad query parameter %q: %v", param, err)
+		}
+		name := unescaped
+		if end := strings.IndexAny(name, "<>!="); end >= 0 {
+			name = name[:end]
+		}
+		if _, found := vmFields[name]; !found && !contains(listOptions, name) {
+			continue
+		}
+		match := listParam.FindStringSubmatch(unescaped)
+		if match == nil {
+			return q, newError(BadRequest, "bad query parameter %q, want a name, an operator such as >= and a value", unescaped)
+		}
+		op, value := match[2], match[3]
+		if contains(listOptions, name) && op != "=" {
+			return q, newError(BadRequest, "bad query parameter %q, want %s=", unescaped, name)
+		}
+		switch name {
+		case "sort":
+			if q.sort, err = parseSort(value); err != nil {
+				return q, err
+			}
+		case "fields":
+			if q.fields, err = parseFields(value); err != nil {
+				return q, err
+			}
+		case "format":
+			if value != "object" && value != "array" {
+				return q, newError(BadRequest, "bad format %q, want object or array", value)
+			}
+			q.array = value == "array"
+		case "limit":
+			if q.limit, err = strconv.Atoi(value); err != nil || q.limit <= 0 {
+				return q, newError(BadRequest, "bad limit %q, want a positive integer", value)
+			}
+		case "page_token":
+			pageToken = value
+		default:
+			filter, err := parseFilter(name, op, value)
+			if err != nil {
+				return q, err
+			}
+			q.filters = append(q.filters, filter)
+		}
+	}
+	if len(q.sort) == 0 || q.sort[len(q.sort)-1].field != "id" {
+		q.sort = append(q.sort, sortKey{field: "id"})
+	}
+	if pageToken != "" {
+		cursor, err := parsePageToken(pageToken)
+		if err != nil {
+			return q, err
+		}
+		if cursor.Sort != q.sortSpec() {
+			return q, newError(BadRequest, "page_token is for sort=%s, not sort=%s", cursor.Sort, q.sortSpec())
+		}
+		q.after = &cursor
+	}
+	return q, nil
+}
+
+func parseFilter(name, op, value string) (listFilter, error) {
+	field, found := vmFields[name]
+	if !found {
+		return listFilter{}, newError(BadRequest, "unknown field %q to filter on", name)
+	}
+	values := []string{value}
+	if op == "=" || op == "!=" {
+		values = strings.Split(value, ",")
+	}
+	filter := listFilter{field: name, op: op}
+	for _, v := range values {
+		parsed, err := field.parse(v)
+		if err != nil {
+			return listFilter{}, newError(BadRequest, "bad %s %q: %v", name, v, err)
+		}
+		filter.values = append(filter.values, parsed)
+	}
+	return filter, nil
+}
+
+// parseSort reads a list of fields, each prefixed by - for descending order
+func parseSort(value string) ([]sortKey, error) {
+	var keys []sortKey
+	for _, name := range strings.Split(value, ",") {
+		key := sortKey{field: strings.TrimPrefix(name, "-"), desc: strings.HasPrefix(name, "-")}
+		if _, found := vmFields[key.field]; !found {
+			return nil, newError(BadRequest, "unknown field %q to sort on", key.field)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseFields(value string) ([]string, error) {
+	fields := strings.Split(value, ",")
+	for _, name := range fields {
+		if _, found := vmFields[name]; !found && !contains(selectableFields, name) {
+			return nil, newError(BadRequest, "unknown field %q to select", name)
+		}
+	}
+	return fields, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePageToken(token string) (pageCursor, error) {
+	var cursor pageCursor
+	cursorJSON, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(cursorJSON, &cursor)
+	}
+	if err != nil {
+		return cursor, newError(BadRequest, "bad page_token %q", token)
+	}
+	return cursor, nil
+}
+
+// sortSpec returns the sort of the query as a sort parameter value
+func (q listQuery) sortSpec() string {
+	names := make([]string, len(q.sort))
+	for i, key := range q.sort {
+		names[i] = key.field
+		if key.desc {
+			names[i] = "-" + key.field
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// less tells whether a goes before b in the sort of the query
+func (q listQuery) less(a, b listedVM) bool {
+	for _, key := range q.sort {
+		field := vmFields[key.field]
+		c := compareValues(field.value(a), field.value(b))
+		if key.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// page returns the VMs of the page the query asks for, the number of VMs
+// passing its filters on all pages, and the token of the next page, empty
+// if this is the last one
+func (q listQuery) page(vms VMs) ([]listedVM, int, string) {
+	var listed []listedVM
+	for id, vm := range vms {
+		v := listedVM{id: id, vm: vm}
+		kept := true
+		for _, filter := range q.filters {
+			kept = kept && filter.keeps(v)
+		}
+		if kept {
+			listed = append(listed, v)
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		return q.less(listed[i], listed[j])
+	})
+	total := len(listed)
+	if q.after != nil {
+		after := listedVM{id: q.after.ID, vm: q.after.VM}
+		listed = listed[sort.Search(len(listed), func(i int) bool {
+			return q.less(after, listed[i])
+		}):]
+	}
+	if q.limit == 0 || len(listed) <= q.limit {
+		return listed, total, ""
+	}
+	listed = listed[:q.limit]
+	last := listed[len(listed)-1]
+	last.vm.StartDelay, last.vm.StopDelay = nil, nil // not needed to sort
+	cursorJSON, err := json.Marshal(pageCursor{Sort: q.sortSpec(), ID: last.id, VM: last.vm})
+	dieOnError(err, "Can't generate JSON for page cursor of VM %d", last.id)
+	return listed, total, base64.RawURLEncoding.EncodeToString(cursorJSON)
+}
+
+// itemJSON returns the VM JSON with the fields of the query only, starting
+// with the id if withID
+func (q listQuery) itemJSON(v listedVM, withID bool) json.RawMessage {
+	vmJSON := v.vm.String()
+	if len(q.fields) == 0 {
+		if !withID {
+			return json.RawMessage(vmJSON)
+		}
+		if vmJSON == "{}" {
+			return json.RawMessage(fmt.Sprintf(`{"id":%d}`, v.id))
+		}
+		return json.RawMessage(fmt.Sprintf(`{"id":%d,%s`, v.id, vmJSON[1:]))
+	}
+	var all map[string]json.RawMessage
+	dieOnError(json.Unmarshal([]byte(vmJSON), &all), "Can't read JSON of VM %d", v.id)
+	all["id"] = json.RawMessage(strconv.Itoa(v.id))
+	fields := q.fields
+	if withID && !contains(fields, "id") {
+		fields = append([]string{"id"}, fields...)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range fields {
+		value, found := all[name]
+		if !found {
+			continue // empty, as in the full VM JSON
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:%s", name, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// list replies with the VMs, all of them by id unless the query filters,
+// sorts, selects fields, pages or asks for an array of them
+func (s *VMServer) list(w http.ResponseWriter, r *http.Request) {
+	q, err := parseListQuery(r.URL.RawQuery)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	listed, total, nextPageToken := q.page(s.vmm.List())
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if nextPageToken != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r.URL, nextPageToken)))
+	}
+	var body interface{}
+	if q.array {
+		items := make([]json.RawMessage, len(listed))
+		for i, v := range listed {
+			items[i] = q.itemJSON(v, true)
+		}
+		body = items
+	} else {
+		items := make(map[int]json.RawMessage, len(listed))
+		for _, v := range listed {
+			items[v.id] = q.itemJSON(v, false)
+		}
+		body = items
+	}
+	bodyJSON, err := json.Marshal(body)
+	dieOnError(err, "Can't generate JSON for VMs list %#v", body)
+	w.Write(bodyJSON)
+}
+
+// nextPageURL returns the URL of the request with the given page token
+func nextPageURL(u *url.URL, pageToken string) string {
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param != "" && !strings.HasPrefix(param, "page_token=") {
+			params = append(params, param)
+		}
+	}
+	params = append(params, "page_token="+pageToken)
+	return u.Path + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// listingVMs returns a fleet of VMs with specs and states varying by id
+func listingVMs(n int) VMs {
+	vms := make(VMs, n)
+	for id := 0; id < n; id++ {
+		state := STOPPED
+		if id%3 == 0 {
+			state = RUNNING
+		}
+		vms[id] = VM{VCPUS: 1 + id%4, Clock: 1500, RAM: 1024 * (1 + id%8), Storage: 128, Network: 1000, State: state}
+	}
+	return vms
+}
+
+// listIDs sends GET /vms with the query, asking for an array of ids, and
+// returns them along with the reply
+func listIDs(t *testing.T, server *VMServer, query string) ([]int, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/vms?format=array&fields=id&"+query, nil))
+	if w.Code != http.StatusOK {
+		return nil, w
+	}
+	var items []struct {
+		ID *int `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+		t.Fatalf("GET /vms?%s: invalid JSON body %q: %v", query, w.Body, err)
+	}
+	ids := []int{}
+	for _, item := range items {
+		ids = append(ids, *item.ID)
+	}
+	return ids, w
+}
+
+func TestListVMs(t *testing.T) {
+	server := NewVMServer(listingVMs(12))
+	for _, tc := range []struct {
+		query      string
+		want       []int
+		wantStatus int
+	}{
+		{query: "", want: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{query: "state=Running", want: []int{0, 3, 6, 9}},
+		{query: "state=Running,Stopped&id<3", want: []int{0, 1, 2}},
+		{query: "state!=Running&ram>=6144", want: []int{5, 7}},
+		{query: "ram%3E6144&vcpus=4", want: []int{7}},
+		{query: "ram<=2048&sort=-vcpus", want: []int{1, 9, 0, 8}},
+		{query: "sort=vcpus,-ram&limit=3", want: []int{4, 0, 8}},
+		{query: "sort=-id&limit=2", want: []int{11, 10}},
+		{query: "sort=color", wantStatus: http.StatusBadRequest},
+		{query: "color=red&_=123&pretty&cache-buster>1", want: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{query: "ram", wantStatus: http.StatusBadRequest},
+		{query: "ram>=lots", wantStatus: http.StatusBadRequest},
+		{query: "limit=0", wantStatus: http.StatusBadRequest},
+		{query: "limit>=1", wantStatus: http.StatusBadRequest},
+		{query: "page_token=nope", wantStatus: http.StatusBadRequest},
+	} {
+		ids, w := listIDs(t, server, tc.query)
+		if tc.wantStatus != 0 {
+			if w.Code != tc.wantStatus {
+				t.Errorf("GET /vms?%s: got status: %d, want: %d", tc.query, w.Code, tc.wantStatus)
+			}
+			continue
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tc.want) {
+			t.Errorf("GET /vms?%s: got ids: %v, want: %v", tc.query, ids, tc.want)
+		}
+	}
+}
+
+func TestListVMsFields(t *testing.T) {
+	server := NewVMServer(listingVMs(3))
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{query: "", want: listingVMs(3).String()},
+		{query: "fields=ram,state&id=1", want: `{"1":{"ram":2048,"state":"Stopped"}}`},
+		{query: "format=array&id=1", want: `[{"id":1,"vcpus":2,"clock":1500,"ram":2048,"storage":128,"network":1000,"state":"Stopped"}]`},
+		{query: "format=array&fields=state,id&id>0", want: `[{"state":"Stopped","id":1},{"state":"Stopped","id":2}]`},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/vms?"+tc.query, nil))
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("GET /vms?%s: got: %s, want: %s", tc.query, got, tc.want)
+		}
+	}
+}
+
+// nextLink matches the Link header to the next page
+var nextLink = regexp.MustCompile(`^<(/vms\?.*)>; rel="next"$`)
+
+func TestListVMsPages(t *testing.T) {
+	server := NewVMServer(listingVMs(20))
+	seen := make(map[int]bool)
+	deleted := make(map[int]bool)
+	path := "/vms?format=array&fields=id&state=Stopped&sort=-ram&limit=4"
+	for pages := 0; path != ""; pages++ {
+		if pages > 10 {
+			t.Fatalf("got more than %d pages", pages)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var items []struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil || len(items) > 4 {
+			t.Fatalf("GET %s: got: %d %s (%v), want up to 4 VMs", path, w.Code, w.Body, err)
+		}
+		for _, item := range items {
+			if seen[item.ID] {
+				t.Fatalf("GET %s: got VM %d twice", path, item.ID)
+			}
+			seen[item.ID] = true
+		}
+		link := w.Header().Get("Link")
+		match := nextLink.FindStringSubmatch(link)
+		if link != "" && match == nil {
+			t.Fatalf("GET %s: got bad Link header: %q", path, link)
+		}
+		path = ""
+		if match != nil {
+			path = match[1]
+		}
+		// Change the fleet between pages: delete a VM not listed yet
+		// and create a new one
+		for id := range server.vmm.List() {
+			if !seen[id] && !deleted[id] {
+				if err := server.vmm.Delete(id); err == nil {
+					deleted[id] = true
+					break
+				}
+			}
+		}
+		if _, _, err := server.vmm.CreateOperation(VM{VCPUS: 1, Clock: 1500, RAM: 1024, Storage: 128, Network: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, vm := range listingVMs(20) {
+		if vm.State == STOPPED && !deleted[id] && !seen[id] {
+			t.Errorf("missed VM %d, there all along", id)
+		}
+	}
+	if len(deleted) == 0 {
+		t.Fatalf("got no VMs deleted between pages")
+	}
+}
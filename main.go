@@ -14,6 +14,8 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -23,53 +25,112 @@ import (
 // '2020.09.10.0'
 var Version = "Development"
 
-// loadVMs loads the VM list from a JSON file (VMS_JSON)
-func loadVMs() (VMs, error) {
+// loadFixture loads the VM list, and the delays of all VMs if any, from a
+// JSON file (VMS_JSON)
+func loadFixture() (Fixture, error) {
 	log.Printf("Loading fake Cloud state from local file %q", VMsJSON)
 	_, err := os.Stat(VMsJSON)
 	if errors.Is(err, os.ErrNotExist) {
 		log.Printf("Missing %q, generating one...", VMsJSON)
-		if err := saveVMs(defaultVMs); err != nil {
-			return nil, fmt.Errorf("error generating default %q: %v", VMsJSON, err)
+		if err := saveFixture(Fixture{VMs: defaultVMs}); err != nil {
+			return Fixture{}, fmt.Errorf("error generating default %q: %v", VMsJSON, err)
 		}
 		log.Printf("Tip: You can tweak %q adding VMs or changing states for next run.", VMsJSON)
 	} else if err != nil {
-		return nil, fmt.Errorf("error stating %q: %v", VMsJSON, err)
+		return Fixture{}, fmt.Errorf("error stating %q: %v", VMsJSON, err)
 	}
 	f, err := os.Open(VMsJSON)
 	if err != nil {
-		return nil, fmt.Errorf("error opening %q: %v", VMsJSON, err)
+		return Fixture{}, fmt.Errorf("error opening %q: %v", VMsJSON, err)
 	}
 
 	defer f.Close()
 	vmsJSON, err := ioutil.ReadAll(f)
 	if err != nil {
-		return nil, fmt.Errorf("error reading %q: %v", VMsJSON, err)
+		return Fixture{}, fmt.Errorf("error reading %q: %v", VMsJSON, err)
 	}
 
-	vms := make(VMs, 0)
-	err = json.Unmarshal(vmsJSON, &vms)
+	fixture := Fixture{VMs: make(VMs, 0)}
+	err = json.Unmarshal(vmsJSON, &fixture)
 	if err != nil {
-		return nil, fmt.Errorf("error JSON-parsing %q: %v", VMsJSON, err)
+		return Fixture{}, fmt.Errorf("error JSON-parsing %q: %v", VMsJSON, err)
 	}
 
-	return vms, nil
+	return fixture, nil
 }
 
-// saveVMs saves the VM list to a JSON file (VMS_JSON)
-func saveVMs(vms VMs) error {
-	vmsJSON, err := json.Marshal(vms)
+// saveFixture saves the VM list, and the delays of all VMs if any, to a
+// JSON file (VMS_JSON)
+func saveFixture(fixture Fixture) error {
+	vmsJSON, err := json.Marshal(fixture)
 	if err != nil {
 		return fmt.Errorf("error writing JSON for %q: %v", VMsJSON, err)
 	}
 
-	err = ioutil.WriteFile(VMsJSON, vmsJSON, 0644)
+	err = writeFileAtomically(VMsJSON, vmsJSON, 0644)
 	if err != nil {
 		return fmt.Errorf("error saving %q: %v", VMsJSON, err)
 	}
 	return nil
 }
 
+// writeFileAtomically replaces the file at path with data, so that readers
+// (or a restart after a crash) only ever see the old or the new contents.
+// It writes a temporary file in the same folder, fsyncs it and renames it.
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// fsync the folder too, so the rename itself is durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// float32Value is a flag.Value for float32 variables
+type float32Value struct {
+	f *float32
+}
+
+func (v float32Value) String() string {
+	if v.f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*v.f), 'g', -1, 32)
+}
+
+func (v float32Value) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return err
+	}
+	*v.f = float32(f)
+	return nil
+}
+
 func printDefaultsTo(w io.Writer, fs *flag.FlagSet) {
 	defer func(saved io.Writer) {
 		fs.SetOutput(saved)
@@ -84,7 +145,7 @@ func dirMustExist(path string) error {
 		return err
 	}
 	if !info.IsDir() {
-		fmt.Errorf("path %q is not a directory", path)
+		return fmt.Errorf("path %q is not a directory", path)
 	}
 	return nil
 }
@@ -103,44 +164,194 @@ func setupOptionalUIFileServer(uiFolder string) (http.Handler, error) {
 	return http.FileServer(http.Dir(uiFolder)), nil
 }
 
+// apiRoutes lists the paths of the API endpoints, and of the trees of
+// endpoints under them, which are all the public address serves besides
+// the UI
+var apiRoutes = []string{"/vms", "/operations", "/audit", "/ws", "/openapi.json", "/openapi.yaml", "/openapi.yml", "/docs"}
+
 func rootHandler(fileServer http.Handler, apiServer http.Handler) http.Handler {
+	rootHandler := http.NewServeMux()
 	if fileServer != nil {
-		rootHandler := http.NewServeMux()
 		rootHandler.Handle("/ui/", http.StripPrefix("/ui/", fileServer))
-		rootHandler.Handle("/vms/", apiServer)
-		return rootHandler
 	}
-	return apiServer
+	for _, route := range apiRoutes {
+		rootHandler.Handle(route, apiServer)
+		rootHandler.Handle(route+"/", apiServer)
+	}
+	return rootHandler
 }
 
 func mainE() error {
 	log.Printf("Test VM Backend version %s", Version)
 	var address string
+	var adminAddress string
+	var adminToken string
 	var uiFolder string
+	var persist bool
+	var auditFile string
+	var dumpOpenAPI bool
+	var lifecycleFile string
+	var dumpLifecycle bool
+	var faultsFile string
+	var faults FaultRules
+	var chaos ChaosRules
+	var seed int64
+	var virtualClock bool
+	var timeScale float64
+	limits := DefaultLimits
 	flag.StringVar(&address, "address", ":8080", "Listen address for the backend")
+	flag.StringVar(&adminAddress, "admin-address", "", "Listen address for the admin, debug and metrics endpoints (disabled if unset)")
+	flag.StringVar(&adminToken, "admin-token", "",
+		fmt.Sprintf("Bearer token required by the admin endpoints, read from $%s if unset, random if both unset", AdminTokenEnv))
 	flag.StringVar(&uiFolder, "uiFolder", "", "Directory to serve UI files from")
+	flag.StringVar(&auditFile, "audit-file", "", "Append every audit journal entry to this file, as JSON lines")
+	flag.BoolVar(&persist, "persist", false, fmt.Sprintf("Write every VM change back to %q", VMsJSON))
+	flag.IntVar(&limits.VCPUS, "max-vcpus", limits.VCPUS, "Max number of processors of a VM")
+	flag.Var(float32Value{&limits.Clock}, "max-clock", "Max frequency of 1 processor of a VM, in MHz")
+	flag.IntVar(&limits.RAM, "max-ram", limits.RAM, "Max amount of internal memory of a VM, in MiB")
+	flag.IntVar(&limits.Storage, "max-storage", limits.Storage, "Max amount of persistent storage of a VM, in GiB")
+	flag.IntVar(&limits.Network, "max-network", limits.Network, "Max network device speed of a VM, in Mbps")
+	flag.BoolVar(&dumpOpenAPI, "dump-openapi", false, "Print the OpenAPI document of the API and exit")
+	flag.StringVar(&lifecycleFile, "lifecycle", "", "JSON or YAML file with the VM lifecycle to use instead of the default one")
+	flag.BoolVar(&dumpLifecycle, "dump-lifecycle", false, "Print the default VM lifecycle JSON and exit")
+	flag.StringVar(&faultsFile, "faults", "", "JSON file with a list of fault rules making transitions fail")
+	flag.Var(faultRuleList{&faults}, "fault",
+		"Fault rule making transitions fail, such as vm=2,action=launch,probability=0.5,outcome=rollback,count=1 (repeatable)")
+	flag.Var(chaosRuleList{&chaos}, "chaos",
+		"Chaos rule making API requests go wrong, such as fault=throttle,endpoint=/vms,method=GET,probability=0.2 (repeatable)")
+	flag.Int64Var(&seed, "seed", 0, "Seed of the random delays, faults and chaos, to reproduce a run (random if 0)")
+	flag.BoolVar(&virtualClock, "virtual-clock", false, "Run transitions on a virtual clock, only moving forward on POST /admin/clock/advance")
+	flag.Float64Var(&timeScale, "time-scale", 1, "Factor applied to all transition delays, such as 0.01 for fast demos or 10 for slow motion")
 	flag.Parse()
-	vms, err := loadVMs()
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("Random seed: %d", seed)
+	rand.Seed(seed)
+	if dumpLifecycle {
+		return writeJSON(os.Stdout, DefaultLifecycle)
+	}
+	if lifecycleFile != "" {
+		log.Printf("Loading VM lifecycle from %q", lifecycleFile)
+		lifecycle, err := LoadLifecycle(lifecycleFile)
+		if err != nil {
+			return err
+		}
+		if err := UseLifecycle(lifecycle); err != nil {
+			return fmt.Errorf("error in %q: %v", lifecycleFile, err)
+		}
+	}
+	if dumpOpenAPI {
+		return writeJSON(os.Stdout, openAPIDocument(APISpec))
+	}
+	fixture, err := loadFixture()
 	if err != nil {
 		return fmt.Errorf("error loading VMs initial state: %v", err)
 	}
-	server := NewVMServer(vms)
+	if err := fixture.Validate(); err != nil {
+		return fmt.Errorf("error in %q: %v", VMsJSON, err)
+	}
+	if faultsFile != "" {
+		log.Printf("Loading fault rules from %q", faultsFile)
+		fileFaults, err := LoadFaultRules(faultsFile)
+		if err != nil {
+			return err
+		}
+		faults = append(fileFaults, faults...)
+	}
+	server := NewVMServer(fixture.VMs)
+	server.vmm.SeedFaults(seed)
+	server.chaos.seed(seed)
+	server.vmm.ReserveIDs(fixture.NextID)
+	server.vmm.SetLimits(limits)
+	if err := server.vmm.SetDelays(fixture.Delays); err != nil {
+		return fmt.Errorf("error in %q: %v", VMsJSON, err)
+	}
+	if err := server.vmm.SetTimeScale(timeScale); err != nil {
+		return err
+	}
+	if virtualClock {
+		log.Printf("Running on a virtual clock, advance it with POST /admin/clock/advance?d= on the admin address")
+		if adminAddress == "" {
+			log.Printf("Warning: without --admin-address the virtual clock never moves forward")
+		}
+		server.vmm.UseClock(NewVirtualClock(time.Now()))
+	}
+	if err := server.vmm.SetFaults(faults); err != nil {
+		return fmt.Errorf("error setting up faults: %v", err)
+	}
+	if len(faults) > 0 {
+		log.Printf("Injecting faults: %v", faults)
+	}
+	if err := server.chaos.set(chaos); err != nil {
+		return fmt.Errorf("error setting up chaos: %v", err)
+	}
+	if len(chaos) > 0 {
+		log.Printf("Injecting chaos: %v", chaos)
+	}
+	if auditFile != "" {
+		f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening audit file: %v", err)
+		}
+		defer f.Close()
+		log.Printf("Mirroring the audit journal to %q", auditFile)
+		server.vmm.MirrorAudit(f)
+		defer server.vmm.FlushAudit()
+	}
+	if persist {
+		log.Printf("Persisting VM changes to %q", VMsJSON)
+		save := func(vms VMs, nextID int) error {
+			return saveFixture(Fixture{Delays: fixture.Delays, NextID: nextID, VMs: vms})
+		}
+		if err := server.vmm.PersistWith(save); err != nil {
+			return fmt.Errorf("error setting up persistence: %v", err)
+		}
+	}
+	// VMs left in transitional states, by a restart or by the fixture
+	// itself, get their transitions resumed
+	server.vmm.ResumeTransitions()
 	server.WriteAPIDoc(os.Stdout)
 	fileServer, err := setupOptionalUIFileServer(uiFolder)
 	if err != nil {
 		return fmt.Errorf("error setting up ui fileserver: %v", err)
 	}
-	http.Handle("/", rootHandler(fileServer, server))
 	CORSMessage := "Unlike a real production service this API accepts:\n"
 	CORSMessage += "- Any Origin on CORS requests.\n"
 	CORSMessage += "- Preflight OPTIONS request with any headers."
 	log.Printf(CORSMessage)
-	log.Printf("Server listening at %v", address)
-	err = http.ListenAndServe(address, nil)
+	errs := make(chan error, 2)
+	if adminAddress != "" {
+		if adminToken == "" {
+			adminToken = os.Getenv(AdminTokenEnv)
+		}
+		if adminToken == "" {
+			adminToken = newAdminToken()
+			log.Printf("Generated admin token: %s", adminToken)
+		}
+		server.WriteAdminAPIDoc(os.Stdout)
+		go func() {
+			log.Printf("Admin server listening at %v", adminAddress)
+			errs <- listen("admin-address", adminAddress, server.AdminHandler(adminToken))
+		}()
+	} else {
+		log.Printf("Admin endpoints disabled, enable them with --admin-address")
+	}
+	go func() {
+		log.Printf("Server listening at %v", address)
+		errs <- listen("address", address, rootHandler(fileServer, server))
+	}()
+	return <-errs
+}
+
+// listen serves the handler on the address, explaining how to pick another
+// address through the named flag if it is in use
+func listen(flagName, address string, handler http.Handler) error {
+	err := http.ListenAndServe(address, handler)
 	if err != nil && strings.Contains(err.Error(), "address already in use") {
 		var sb strings.Builder
 		fmt.Fprintln(&sb, err.Error())
-		fmt.Fprintf(&sb, "^ You can avoid binding issues by using the address flag:\n")
+		fmt.Fprintf(&sb, "^ You can avoid binding issues by using the %s flag:\n", flagName)
 		printDefaultsTo(&sb, flag.CommandLine)
 		return fmt.Errorf(sb.String())
 	}
@@ -148,7 +359,6 @@ func mainE() error {
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
 	if err := mainE(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,290 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsContentType is the media type of the Prometheus text format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsPrefix namespaces all metric names
+const metricsPrefix = "test_vm_backend_"
+
+var (
+	// requestBuckets are the upper bounds of request latencies, in seconds
+	requestBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	// transitionBuckets are the upper bounds of transition durations, in seconds
+	transitionBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300}
+)
+
+// histogram counts observations in cumulative buckets, as Prometheus does
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets, in increasing order
+	counts []uint64  // observations within each bound
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// requestKey identifies the APISpec endpoint and method of a request
+type requestKey struct {
+	endpoint string // DisplayPath of the endpoint
+	method   string
+}
+
+// requestCode identifies the replies to requests with a status code
+type requestCode struct {
+	requestKey
+	code string
+}
+
+// requestMetrics counts the API requests and their latencies.
+// The zero value is ready to use.
+type requestMetrics struct {
+	lock      sync.Mutex
+	counts    map[requestCode]uint64
+	latencies map[requestKey]*histogram
+}
+
+// observe records a request to the endpoint, replied with the code, and
+// its latency unless it is a stream, lasting as long as its client wants
+func (m *requestMetrics) observe(endpoint, method, code string, latency time.Duration, stream bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.counts == nil {
+		m.counts = make(map[requestCode]uint64)
+		m.latencies = make(map[requestKey]*histogram)
+	}
+	key := requestKey{endpoint: endpoint, method: method}
+	m.counts[requestCode{requestKey: key, code: code}]++
+	if stream {
+		return
+	}
+	h, found := m.latencies[key]
+	if !found {
+		h = newHistogram(requestBuckets)
+		m.latencies[key] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+// write dumps the metrics onto the writer, sorted by endpoint and method
+func (m *requestMetrics) write(mw metricsWriter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	codes := make([]requestCode, 0, len(m.counts))
+	for code := range m.counts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		a, b := codes[i], codes[j]
+		if a.requestKey != b.requestKey {
+			return a.requestKey.less(b.requestKey)
+		}
+		return a.code < b.code
+	})
+	mw.header("http_requests_total", "counter", "API requests by endpoint, method and status code")
+	for _, code := range codes {
+		mw.sample("http_requests_total", m.counts[code], "endpoint", code.endpoint, "method", code.method, "code", code.code)
+	}
+	keys := make([]requestKey, 0, len(m.latencies))
+	for key := range m.latencies {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	mw.header("http_request_duration_seconds", "histogram", "API request latencies by endpoint and method")
+	for _, key := range keys {
+		mw.histogram("http_request_duration_seconds", m.latencies[key], "endpoint", key.endpoint, "method", key.method)
+	}
+}
+
+func (key requestKey) less(other requestKey) bool {
+	if key.endpoint != other.endpoint {
+		return key.endpoint < other.endpoint
+	}
+	return key.method < other.method
+}
+
+// transitionMetrics counts the delayed transitions completed, failed or
+// not, along with their durations on the clock of the Cloud.
+// The zero value is ready to use.
+type transitionMetrics struct {
+	lock      sync.Mutex
+	durations map[OperationKind]*histogram
+	failed    map[OperationKind]uint64
+}
+
+// observe records a completed transition of the given kind
+func (m *transitionMetrics) observe(kind OperationKind, duration time.Duration, failed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.durations == nil {
+		m.durations = make(map[OperationKind]*histogram)
+		m.failed = make(map[OperationKind]uint64)
+	}
+	h, found := m.durations[kind]
+	if !found {
+		h = newHistogram(transitionBuckets)
+		m.durations[kind] = h
+	}
+	h.observe(duration.Seconds())
+	if failed {
+		m.failed[kind]++
+	}
+}
+
+// write dumps the metrics onto the writer, sorted by action
+func (m *transitionMetrics) write(mw metricsWriter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	kinds := make([]string, 0, len(m.durations))
+	for kind := range m.durations {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	mw.header("transitions_total", "counter", "Delayed transitions completed by action, failed or not")
+	for _, kind := range kinds {
+		mw.sample("transitions_total", m.durations[OperationKind(kind)].count, "action", kind)
+	}
+	mw.header("transitions_failed_total", "counter", "Delayed transitions failed by action")
+	for _, kind := range kinds {
+		mw.sample("transitions_failed_total", m.failed[OperationKind(kind)], "action", kind)
+	}
+	mw.header("transition_duration_seconds", "histogram", "Delayed transition durations by action, on the clock of the cloud")
+	for _, kind := range kinds {
+		mw.histogram("transition_duration_seconds", m.durations[OperationKind(kind)], "action", kind)
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus text format
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(mw.w, "# TYPE %s%s %s\n", metricsPrefix, name, kind)
+}
+
+// sample writes a value of the metric with the given label name and value pairs
+func (mw metricsWriter) sample(name string, value interface{}, labels ...string) {
+	fmt.Fprintf(mw.w, "%s%s%s %v\n", metricsPrefix, name, formatLabels(labels), value)
+}
+
+func (mw metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	for i, bound := range h.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		mw.sample(name+"_bucket", h.counts[i], append(labels, "le", le)...)
+	}
+	mw.sample(name+"_bucket", h.count, append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", strconv.FormatFloat(h.sum, 'g', -1, 64), labels...)
+	mw.sample(name+"_count", h.count, labels...)
+}
+
+// labelEscaper escapes label values as the Prometheus text format wants
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the label name and value pairs within braces,
+// or nothing if there are none
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metrics replies with all metrics in the Prometheus text format
+func (s *VMServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	mw := metricsWriter{w: w}
+	s.requests.write(mw)
+	mw.header("vms", "gauge", "VMs by state")
+	counts := s.vmm.StateCounts()
+	for _, state := range currentRules().states {
+		mw.sample("vms", counts[state], "state", string(state))
+	}
+	s.vmm.transitions.write(mw)
+}
+
+// statusRecorder remembers the status code replied by a handler, letting
+// streams flush and WebSockets hijack the connection
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(data)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	sr.hijacked = true
+	return hijacker.Hijack()
+}
+
+// code returns the status code replied, or "hijacked" for connections taken
+// over by the handler with no reply through the ResponseWriter
+func (sr *statusRecorder) code() string {
+	switch {
+	case sr.status != 0:
+		return strconv.Itoa(sr.status)
+	case sr.hijacked:
+		return "hijacked"
+	}
+	return strconv.Itoa(http.StatusOK)
+}
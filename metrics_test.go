@@ -0,0 +1,78 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	server := NewVMServer(defaultVMs.clone())
+	server.vmm.UseClock(newTestClock())
+	vm := 0
+	server.vmm.SetFaults(FaultRules{{VM: &vm, Action: LAUNCH, Probability: 1}})
+	for _, path := range []string{"/vms/0/launch", "/vms/1/launch"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, nil))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("PUT %s: got status: %d, want: %d", path, w.Code, http.StatusAccepted)
+		}
+	}
+	server.vmm.AdvanceClock(time.Duration(2*DefaultStartDelay) * timeUnit)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/vms/nowhere/launch", nil))
+	r := httptest.NewRequest(http.MethodGet, "/vms/0/history", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	server.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+	w = httptest.NewRecorder()
+	server.metrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	got := w.Body.String()
+	for _, want := range []string{
+		"# TYPE test_vm_backend_http_requests_total counter\n",
+		`test_vm_backend_http_requests_total{endpoint="/vms/{vm_id}/launch",method="PUT",code="202"} 2` + "\n",
+		"# TYPE test_vm_backend_http_request_duration_seconds histogram\n",
+		`test_vm_backend_http_request_duration_seconds_bucket{endpoint="/vms/{vm_id}/launch",method="PUT",le="+Inf"} 2` + "\n",
+		`test_vm_backend_http_request_duration_seconds_count{endpoint="/vms/{vm_id}/launch",method="PUT"} 2` + "\n",
+		`test_vm_backend_vms{state="Running"} 1` + "\n",
+		`test_vm_backend_vms{state="Error"} 1` + "\n",
+		`test_vm_backend_vms{state="Suspended"} 0` + "\n",
+		`test_vm_backend_transitions_total{action="launch"} 2` + "\n",
+		`test_vm_backend_transitions_failed_total{action="launch"} 1` + "\n",
+		`test_vm_backend_transition_duration_seconds_count{action="launch"} 2` + "\n",
+		`test_vm_backend_http_requests_total{endpoint="/vms/{vm_id}/history",method="GET",code="200"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in metrics:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "nowhere") || strings.Contains(got, `code="404"`) {
+		t.Errorf("got metrics of a request to no endpoint:\n%s", got)
+	}
+	if strings.Contains(got, `duration_seconds_count{endpoint="/vms/{vm_id}/history"`) {
+		t.Errorf("got the latency of a stream:\n%s", got)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	for _, tc := range []struct {
+		labels []string
+		want   string
+	}{
+		{want: ""},
+		{labels: []string{"state", "Running"}, want: `{state="Running"}`},
+		{labels: []string{"a", `"quoted"\`, "b", "two\nlines"}, want: `{a="\"quoted\"\\",b="two\nlines"}`},
+	} {
+		if got := formatLabels(tc.labels); got != tc.want {
+			t.Errorf("formatLabels(%q): got: %s, want: %s", tc.labels, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema is a JSON Schema, as used by OpenAPI 3.1 documents
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+var (
+	integerSchema = &Schema{Type: "integer"}
+	stringSchema  = &Schema{Type: "string"}
+	objectSchema  = &Schema{Type: "object"}
+	timeSchema    = &Schema{Type: "string", Format: "date-time"}
+)
+
+// schemaRef returns a reference to a schema defined in openAPIComponents
+func schemaRef(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func withDoc(schema Schema, doc string) *Schema {
+	schema.Description = doc
+	return &schema
+}
+
+func enumSchema(doc string, values ...string) *Schema {
+	return &Schema{Type: "string", Description: doc, Enum: values}
+}
+
+func positive() *float64 {
+	min := 1.0
+	return &min
+}
+
+func zero() *float64 {
+	min := 0.0
+	return &min
+}
+
+// knownStates returns all the VM states, sorted
+func knownStates() []string {
+	allowed := currentRules().allowed
+	states := make([]string, 0, len(allowed))
+	for state := range allowed {
+		states = append(states, string(state))
+	}
+	sort.Strings(states)
+	return states
+}
+
+// knownKinds returns all the operation kinds, sorted
+func knownKinds() []string {
+	actions := currentRules().actions
+	kinds := make([]string, 0, len(actions))
+	for kind := range actions {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func errorCodes() []string {
+	codes := make([]string, 0, len(errorStatus))
+	for code := range errorStatus {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// openAPIComponents returns the schemas referenced from APISpec
+func openAPIComponents() map[string]*Schema {
+	components := map[string]*Schema{
+		"VM": {
+			Type:        "object",
+			Description: "Virtual Machine",
+			Properties: map[string]*Schema{
+				"vcpus":   {Type: "integer", Minimum: positive(), Description: "Number of processors"},
+				"clock":   {Type: "number", Minimum: positive(), Description: "Frequency of 1 processor, in MHz"},
+				"ram":     {Type: "integer", Minimum: positive(), Description: "Amount of internal memory, in MiB"},
+				"storage": {Type: "integer", Minimum: positive(), Description: "Amount of persistent storage, in GiB"},
+				"network": {Type: "integer", Minimum: positive(), Description: "Network device speed, in Mbps"},
+				"state": {Type: "string", Enum: knownStates(), ReadOnly: true,
+					Description: "Current state, new VMs are created in the initial lifecycle state, Provisioning by default"},
+				"due": {Type: "string", Format: "date-time", ReadOnly: true,
+					Description: "When the transition in progress is expected to finish, if any"},
+				"startDelay": withDoc(*schemaRef("Delay"), "Delay of launches, in seconds, instead of the lifecycle one"),
+				"stopDelay":  withDoc(*schemaRef("Delay"), "Delay of stops, in seconds, instead of the lifecycle one"),
+			},
+			Required: []string{"vcpus", "clock", "ram", "storage", "network"},
+		},
+		"Delay": {
+			Description: "Fixed delay, or random delay within a range",
+			OneOf: []*Schema{
+				{Type: "number", Minimum: zero()},
+				{
+					Type: "object",
+					Properties: map[string]*Schema{
+						"min": {Type: "number", Minimum: zero()},
+						"max": {Type: "number", Minimum: zero()},
+					},
+					Required: []string{"min", "max"},
+				},
+			},
+		},
+		"VMPatch": {
+			Type:        "object",
+			Description: "JSON merge patch of the VM specs: vcpus, clock and ram only change while Stopped, storage only grows",
+			Properties: map[string]*Schema{
+				"vcpus":   {Type: "integer", Minimum: positive(), Description: "Number of processors"},
+				"clock":   {Type: "number", Minimum: positive(), Description: "Frequency of 1 processor, in MHz"},
+				"ram":     {Type: "integer", Minimum: positive(), Description: "Amount of internal memory, in MiB"},
+				"storage": {Type: "integer", Minimum: positive(), Description: "Amount of persistent storage, in GiB"},
+				"network": {Type: "integer", Minimum: positive(), Description: "Network device speed, in Mbps"},
+			},
+		},
+		"VMs": {
+			Type:                 "object",
+			Description:          "VMs by id",
+			AdditionalProperties: schemaRef("VM"),
+		},
+		"Operation": {
+			Type:        "object",
+			Description: "Long running transition of a VM",
+			Properties: map[string]*Schema{
+				"id":       withDoc(*integerSchema, "Operation id, never reused"),
+				"vm":       withDoc(*integerSchema, "Id of the VM transitioning"),
+				"kind":     enumSchema("Transition requested", knownKinds()...),
+				"status":   enumSchema("Progress", string(PENDING), string(DONE), string(FAILED), string(CANCELLED)),
+				"created":  withDoc(*timeSchema, "When the operation was requested"),
+				"finished": withDoc(*timeSchema, "When the operation completed, if it did"),
+				"error":    withDoc(*stringSchema, "Why the operation failed, if it did"),
+				"delay":    {Type: "number", Description: "Effective delay of the transition in seconds, time scale applied"},
+				"due":      withDoc(*timeSchema, "When the transition is expected to finish"),
+			},
+			Required: []string{"id", "vm", "kind", "status", "created"},
+		},
+		"Operations": {
+			Type:  "array",
+			Items: schemaRef("Operation"),
+		},
+		"Event": {
+			Type:        "object",
+			Description: "Change on a VM, sent as the data of server sent events",
+			Properties: map[string]*Schema{
+				"seq":      withDoc(*integerSchema, "Sequence number, also the event id"),
+				"type":     enumSchema("Kind of change", string(CREATED), string(TRANSITIONED), string(DELETED), string(RESIZED)),
+				"vm":       withDoc(*integerSchema, "Id of the VM that changed"),
+				"oldState": enumSchema("State before the change, unset on creation", knownStates()...),
+				"newState": enumSchema("State after the change, unset on deletion", knownStates()...),
+				"time":     withDoc(*timeSchema, "When the change happened"),
+			},
+			Required: []string{"seq", "type", "vm", "time"},
+		},
+		"TelemetrySample": {
+			Type:        "object",
+			Description: "Guest telemetry of a VM at some point, all 0 unless the VM is Running",
+			Properties: map[string]*Schema{
+				"time":    withDoc(*timeSchema, "When the sample was taken, or the start of the step averaged"),
+				"cpu":     {Type: "number", Description: "Processor use in %, up to 100 per VCPU"},
+				"memory":  {Type: "number", Description: "Memory in use in MiB, up to the RAM"},
+				"disk":    {Type: "number", Description: "Disk IO in MiB/s, up to 1 MiB/s per GiB of storage"},
+				"network": {Type: "number", Description: "Network throughput in Mbps, up to the network speed"},
+			},
+			Required: []string{"time", "cpu", "memory", "disk", "network"},
+		},
+		"TelemetrySamples": {
+			Type:  "array",
+			Items: schemaRef("TelemetrySample"),
+		},
+		"ConsoleOutput": {
+			Type:        "object",
+			Description: "Chunk of the serial console output of a VM",
+			Properties: map[string]*Schema{
+				"contents": withDoc(*stringSchema, "Output from start on"),
+				"start":    withDoc(*integerSchema, "Byte offset of the contents, later than the one asked for if it was dropped"),
+				"next":     withDoc(*integerSchema, "Byte offset to ask for next time"),
+			},
+			Required: []string{"contents", "start", "next"},
+		},
+		"AuditEntry": {
+			Type:        "object",
+			Description: "API request changing a VM, admin request changing the backend, or a VM changing state, showing up or going away",
+			Properties: map[string]*Schema{
+				"seq":       withDoc(*integerSchema, "Sequence number, increases by 1 on each entry"),
+				"time":      withDoc(*timeSchema, "When it happened"),
+				"vm":        withDoc(*integerSchema, "Id of the VM, unless the request failed before finding one or is an admin one"),
+				"actor":     withDoc(*stringSchema, "Who did it: the X-Actor request header, the client address, or system"),
+				"requestId": withDoc(*stringSchema, "X-Request-Id of the API request, if any"),
+				"action":    withDoc(*stringSchema, "Such as create, launch, delete, reset, or transition, created and deleted for events"),
+				"oldState":  enumSchema("State before, unset on creation", knownStates()...),
+				"newState":  enumSchema("State after, unset on deletion", knownStates()...),
+				"outcome":   enumSchema("Whether it went well", string(SUCCESS), string(FAILURE)),
+				"error":     withDoc(*stringSchema, "Why it failed, if it did"),
+			},
+			Required: []string{"seq", "time", "actor", "action", "outcome"},
+		},
+		"AuditEntries": {
+			Type:  "array",
+			Items: schemaRef("AuditEntry"),
+		},
+		"Problem": {
+			Type:        "object",
+			Description: "Error details, following RFC 7807",
+			Properties: map[string]*Schema{
+				"type":     withDoc(*stringSchema, "Always about:blank, see code instead"),
+				"title":    withDoc(*stringSchema, "HTTP status text"),
+				"status":   withDoc(*integerSchema, "HTTP status code"),
+				"detail":   withDoc(*stringSchema, "Error message"),
+				"instance": withDoc(*stringSchema, "Request path"),
+				"code":     enumSchema("Machine readable error type", errorCodes()...),
+			},
+			Required: []string{"type", "title", "status", "code"},
+		},
+	}
+	listed := *components["VM"]
+	listed.Description = "Virtual Machine along with its id, with the fields asked for only"
+	listed.Properties = map[string]*Schema{"id": withDoc(*integerSchema, "VM id")}
+	for name, property := range components["VM"].Properties {
+		listed.Properties[name] = property
+	}
+	listed.Required = nil
+	components["ListedVM"] = &listed
+	components["ListedVMs"] = &Schema{Type: "array", Items: schemaRef("ListedVM")}
+	return components
+}
+
+type openAPIMediaType struct {
+	Schema  *Schema         `json:"schema,omitempty"`
+	Example json.RawMessage `json:"example,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId,omitempty"`
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+// OpenAPIDocument is an OpenAPI 3.1 description of an API
+type OpenAPIDocument struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title       string `json:"title"`
+		Version     string `json:"version"`
+		Description string `json:"description"`
+	} `json:"info"`
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+func toParameters(in string, params []ParamSpec) []openAPIParameter {
+	parameters := make([]openAPIParameter, 0, len(params))
+	for _, p := range params {
+		parameters = append(parameters, openAPIParameter{
+			Name:        p.Name,
+			In:          in,
+			Description: p.Doc,
+			Required:    in == "path",
+			Schema:      p.Schema,
+		})
+	}
+	return parameters
+}
+
+// toOpenAPIOperation describes a method following OpenAPI conventions
+func toOpenAPIOperation(m MethodSpec) openAPIOperation {
+	op := openAPIOperation{
+		OperationID: m.OperationID,
+		Summary:     m.Doc,
+		Parameters:  toParameters("query", m.Query),
+		Responses:   make(map[string]openAPIResponse),
+	}
+	if m.Request != nil {
+		op.RequestBody = &openAPIRequestBody{
+			Required: true,
+			Content: map[string]openAPIMediaType{"application/json": {
+				Schema:  m.Request,
+				Example: json.RawMessage(m.Example),
+			}},
+		}
+	}
+	status := m.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := openAPIResponse{Description: http.StatusText(status)}
+	if m.Response != nil {
+		contentType := m.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		success.Content = map[string]openAPIMediaType{contentType: {Schema: m.Response}}
+	}
+	op.Responses[strconv.Itoa(status)] = success
+	codesByStatus := make(map[int][]string)
+	for _, code := range m.Errors {
+		codesByStatus[errorStatus[code]] = append(codesByStatus[errorStatus[code]], string(code))
+	}
+	for status, codes := range codesByStatus {
+		op.Responses[strconv.Itoa(status)] = openAPIResponse{
+			Description: fmt.Sprintf("%s (%s)", http.StatusText(status), strings.Join(codes, ", ")),
+			Content:     map[string]openAPIMediaType{ProblemContentType: {Schema: schemaRef("Problem")}},
+		}
+	}
+	return op
+}
+
+// openAPIDocument generates the OpenAPI 3.1 document for the endpoints
+func openAPIDocument(endpoints []EndpointSpec) OpenAPIDocument {
+	var doc OpenAPIDocument
+	doc.OpenAPI = "3.1.0"
+	doc.Info.Title = "Test VM Backend"
+	doc.Info.Version = Version
+	doc.Info.Description = "Fake cloud of VMs to develop frontends against. " +
+		"VMs take a while to transition between states when launched or stopped."
+	doc.Paths = make(map[string]map[string]interface{})
+	for _, endpoint := range endpoints {
+		item := make(map[string]interface{})
+		if len(endpoint.Params) > 0 {
+			item["parameters"] = toParameters("path", endpoint.Params)
+		}
+		for _, m := range endpoint.Methods {
+			item[strings.ToLower(m.Method)] = toOpenAPIOperation(m)
+		}
+		doc.Paths[endpoint.DisplayPath] = item
+	}
+	doc.Components.Schemas = openAPIComponents()
+	return doc
+}
+
+// docFormat is an encoding to serve documents with
+type docFormat struct {
+	contentType string
+	encode      func(w io.Writer, v interface{}) error
+}
+
+var jsonFormat = docFormat{"application/json", writeJSON}
+
+var yamlFormat = docFormat{"application/yaml", writeYAML}
+
+func (s *VMServer) openAPI(format docFormat, w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := format.encode(&buf, openAPIDocument(APISpec)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	buf.WriteTo(w)
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+)
+
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+
+func TestOpenAPIPathParams(t *testing.T) {
+	for _, endpoint := range APISpec {
+		var names []string
+		for _, match := range pathParam.FindAllStringSubmatch(endpoint.DisplayPath, -1) {
+			names = append(names, match[1])
+		}
+		if len(names) != len(endpoint.Params) {
+			t.Fatalf("%s: got %d params, want: %v", endpoint.DisplayPath, len(endpoint.Params), names)
+		}
+		for i, name := range names {
+			if got := endpoint.Params[i].Name; got != name {
+				t.Fatalf("%s: got param: %q, want: %q", endpoint.DisplayPath, got, name)
+			}
+		}
+	}
+}
+
+var schemaRefs = regexp.MustCompile(`"\$ref":"#/components/schemas/([^"]+)"`)
+
+func TestOpenAPIRefs(t *testing.T) {
+	doc := openAPIDocument(APISpec)
+	docJSON, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range schemaRefs.FindAllStringSubmatch(string(docJSON), -1) {
+		if _, found := doc.Components.Schemas[match[1]]; !found {
+			t.Fatalf("dangling reference to schema %q", match[1])
+		}
+	}
+	operationIDs := make(map[string]bool)
+	for _, endpoint := range APISpec {
+		for _, m := range endpoint.Methods {
+			if m.OperationID == "" || operationIDs[m.OperationID] {
+				t.Fatalf("%v %s: missing or duplicated operation id %q", m.Method, endpoint.DisplayPath, m.OperationID)
+			}
+			operationIDs[m.OperationID] = true
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OperationKind tells which transition an Operation tracks,
+// the action performed or PROVISION for new VMs
+type OperationKind string
+
+// Kinds of the DefaultLifecycle actions
+const (
+	// LAUNCH operation takes a VM from Stopped to Running
+	LAUNCH OperationKind = "launch"
+
+	// STOP operation takes a VM from Running, Suspended or Error to Stopped
+	STOP OperationKind = "stop"
+
+	// PROVISION operation takes a new VM from its initial state to the next,
+	// from Provisioning to Stopped by default
+	PROVISION OperationKind = "provision"
+
+	// SUSPEND operation takes a VM from Running to Suspended
+	SUSPEND OperationKind = "suspend"
+
+	// RESUME operation takes a VM from Suspended to Running
+	RESUME OperationKind = "resume"
+
+	// REBOOT operation takes a VM from Running back to Running
+	REBOOT OperationKind = "reboot"
+)
+
+// OperationStatus represents the progress of an Operation
+type OperationStatus string
+
+const (
+	// PENDING operation is still waiting for its VM to transition
+	PENDING OperationStatus = "Pending"
+
+	// DONE operation got its VM to the final state
+	DONE OperationStatus = "Done"
+
+	// FAILED operation could not get its VM to the final state
+	FAILED OperationStatus = "Failed"
+
+	// CANCELLED operation was aborted, rolling its VM back
+	CANCELLED OperationStatus = "Cancelled"
+)
+
+// maxOperations is how many operations are kept around for inspection,
+// the oldest finished ones are forgotten first
+const maxOperations = 1024
+
+// Operation tracks a long running transition of a VM
+type Operation struct {
+	ID       int             `json:"id"`                 // Operation id, never reused
+	VMID     int             `json:"vm"`                 // Id of the VM transitioning
+	Kind     OperationKind   `json:"kind"`               // Lifecycle action performed, or provision
+	Status   OperationStatus `json:"status"`             // Value within [Pending, Done, Failed, Cancelled]
+	Created  time.Time       `json:"created"`            // When the operation was requested
+	Finished *time.Time      `json:"finished,omitempty"` // When the operation completed, if it did
+	Error    string          `json:"error,omitempty"`    // Why the operation failed, if it did
+	Delay    float64         `json:"delay,omitempty"`    // Effective delay of the transition in seconds, time scale applied
+	Due      *time.Time      `json:"due,omitempty"`      // When the transition is expected to finish
+
+	done chan struct{} // closed on completion
+}
+
+// String on an Operation dumps it in JSON format
+func (op Operation) String() string {
+	opJSON, err := json.Marshal(op)
+	dieOnError(err, "Can't generate JSON for Operation object %#v", op)
+	return string(opJSON)
+}
+
+// Done returns a channel closed when the operation completes
+func (op Operation) Done() <-chan struct{} {
+	return op.done
+}
+
+// Operations defines a list of Operations with attached methods
+type Operations []Operation
+
+// String on Operations dumps the list in JSON format
+func (ops Operations) String() string {
+	opsJSON, err := json.Marshal(ops)
+	dieOnError(err, "Can't generate JSON for Operation objects %#v", ops)
+	return string(opsJSON)
+}
+
+// operationRegistry keeps track of operations by id.
+// The zero value is ready to use.
+type operationRegistry struct {
+	lock   sync.RWMutex
+	lastID int
+	ops    map[int]*Operation
+	clock  Clock // stamps operations, the system clock if nil
+}
+
+// useClock makes the registry stamp operations with the given clock
+func (reg *operationRegistry) useClock(clock Clock) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	reg.clock = clock
+}
+
+// start registers a new PENDING operation
+func (reg *operationRegistry) start(vmID int, kind OperationKind) *Operation {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if reg.ops == nil {
+		reg.ops = make(map[int]*Operation)
+	}
+	reg.lastID++
+	op := &Operation{
+		ID:      reg.lastID,
+		VMID:    vmID,
+		Kind:    kind,
+		Status:  PENDING,
+		Created: clockOrSystem(reg.clock).Now(),
+		done:    make(chan struct{}),
+	}
+	reg.ops[op.ID] = op
+	reg.evict()
+	return op
+}
+
+// schedule records when the transition of the operation is due
+func (reg *operationRegistry) schedule(op *Operation, due time.Time) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	op.Due = &due
+	op.Delay = due.Sub(op.Created).Seconds()
+}
+
+// finish completes the operation, as FAILED if err is not nil
+func (reg *operationRegistry) finish(op *Operation, err error) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	now := clockOrSystem(reg.clock).Now()
+	op.Finished = &now
+	op.Status = DONE
+	if err != nil {
+		op.Status = FAILED
+		op.Error = err.Error()
+	}
+	close(op.done)
+}
+
+// cancel completes the operation as CANCELLED, returning a snapshot of it
+func (reg *operationRegistry) cancel(op *Operation) Operation {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	now := clockOrSystem(reg.clock).Now()
+	op.Finished = &now
+	op.Status = CANCELLED
+	close(op.done)
+	return *op
+}
+
+// evict forgets the oldest finished operations over maxOperations.
+// Must be called holding the write lock.
+func (reg *operationRegistry) evict() {
+	if len(reg.ops) <= maxOperations {
+		return
+	}
+	ids := make([]int, 0, len(reg.ops))
+	for id := range reg.ops {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if len(reg.ops) <= maxOperations {
+			return
+		}
+		if reg.ops[id].Finished != nil {
+			delete(reg.ops, id)
+		}
+	}
+}
+
+// get returns a snapshot of the operation by id
+func (reg *operationRegistry) get(id int) (Operation, bool) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+
+	op, found := reg.ops[id]
+	if !found {
+		return Operation{}, false
+	}
+	return *op, true
+}
+
+// list returns a snapshot of all operations sorted by id
+func (reg *operationRegistry) list() Operations {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+
+	ops := make(Operations, 0, len(reg.ops))
+	for _, op := range reg.ops {
+		ops = append(ops, *op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].ID < ops[j].ID
+	})
+	return ops
+}
@@ -4,19 +4,24 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // VMServer is a http.Handler of VM REST requests
 type VMServer struct {
-	vmm Cloud
+	vmm      *Cloud
+	chaos    chaosMonkey    // makes API requests go wrong, on demand
+	requests requestMetrics // API requests served, for metrics
 }
 
 type serverHandler func(s *VMServer, w http.ResponseWriter, r *http.Request)
@@ -29,10 +34,18 @@ func mustCompileAnchored(pattern string) *regexp.Regexp {
 
 // MethodSpec defines a single method on an entrypoint
 type MethodSpec struct {
-	Method   string
-	BodySpec string
-	Doc      string
-	Handler  serverHandler
+	Method      string
+	BodySpec    string
+	Doc         string
+	OperationID string        // Unique name of the method for generated clients
+	Example     string        // Sample request body, for docs
+	Query       []ParamSpec   // Query parameters accepted
+	Request     *Schema       // Request body schema, if any
+	Status      int           // Success status code, http.StatusOK if unset
+	Response    *Schema       // Success response body schema, if any
+	ContentType string        // Success response media type, JSON if unset
+	Errors      []ErrorCode   // Errors the method may reply with
+	Handler     serverHandler // Implementation of the method
 }
 
 // MethodSpecs makes up a list of Method Specifications
@@ -42,43 +55,188 @@ type MethodSpecs []MethodSpec
 type EndpointSpec struct {
 	DisplayPath string
 	Path        *regexp.Regexp
+	Params      []ParamSpec // Path parameters, in DisplayPath order
 	Methods     MethodSpecs
 }
 
-// APISpec specifies endpoint paths and their implemented methods
-var APISpec = []EndpointSpec{
+// ParamSpec defines a path or query parameter
+type ParamSpec struct {
+	Name   string
+	Doc    string
+	Schema *Schema
+}
+
+var vmIDParam = ParamSpec{Name: "vm_id", Doc: "VM id", Schema: integerSchema}
+
+var opIDParam = ParamSpec{Name: "op_id", Doc: "Operation id", Schema: integerSchema}
+
+var lastEventIDParam = ParamSpec{
+	Name:   "lastEventId",
+	Doc:    "Sequence number of the last event seen, to resume after it (same as the Last-Event-ID header)",
+	Schema: integerSchema,
+}
+
+// APISpec specifies endpoint paths and their implemented methods,
+// including an endpoint per action of the lifecycle in use
+var APISpec []EndpointSpec
+
+// baseAPISpec specifies the endpoints found whatever the lifecycle
+var baseAPISpec = []EndpointSpec{
 	{
 		DisplayPath: "/vms",
 		Path:        mustCompileAnchored(`/vms[/]?`),
 		Methods: []MethodSpec{
 			{
-				http.MethodGet, "VMs JSON", "list All VMs",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+				Method:      http.MethodGet,
+				BodySpec:    "VMs JSON",
+				Doc:         "list All VMs, or those passing filters such as ?state=Running&ram>=8192, sorted and paged",
+				OperationID: "listVMs",
+				Query: []ParamSpec{
+					{Name: "state", Doc: "Only VMs in one of these comma separated states. Any other VM field filters too, with =, !=, >, >=, < or <= such as ram>=8192. Parameters naming neither a field nor an option are ignored", Schema: stringSchema},
+					{Name: "sort", Doc: "Comma separated fields to sort on, each prefixed by - for descending order (id by default)", Schema: stringSchema},
+					{Name: "fields", Doc: "Comma separated fields to reply with (all by default)", Schema: stringSchema},
+					{Name: "format", Doc: "object of VMs by id (by default), or array of VMs with their ids in sort order", Schema: enumSchema("", "object", "array")},
+					{Name: "limit", Doc: "Max number of VMs per page, the next one linked from the Link header (all by default)", Schema: integerSchema},
+					{Name: "page_token", Doc: "Token of the page to reply with, from the Link header of the previous one", Schema: stringSchema},
+				},
+				Response: &Schema{OneOf: []*Schema{schemaRef("VMs"), schemaRef("ListedVMs")}},
+				Errors:   []ErrorCode{BadRequest},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.list(w, r)
 				},
 			},
+			{
+				Method:      http.MethodPost,
+				BodySpec:    "VM JSON",
+				Doc:         "create a new VM from a VM JSON body",
+				OperationID: "createVM",
+				Request:     schemaRef("VM"),
+				Example:     `{"vcpus":2,"clock":2200,"ram":8192,"storage":256,"network":1000}`,
+				Status:      http.StatusCreated,
+				Response:    schemaRef("VM"),
+				Errors:      []ErrorCode{BadRequest, ValidationFailed},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.create(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/events",
+		Path:        mustCompileAnchored(`/vms/events[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "SSE stream",
+				Doc:         "stream all VM changes as server sent events",
+				OperationID: "streamEvents",
+				Query:       []ParamSpec{lastEventIDParam},
+				Response:    schemaRef("Event"),
+				ContentType: "text/event-stream",
+				Errors:      []ErrorCode{BadRequest},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.streamEvents(allEvents, w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/events",
+		Path:        mustCompileAnchored(`/vms/\d+/events[/]?`),
+		Params:      []ParamSpec{vmIDParam},
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "SSE stream",
+				Doc:         "stream VM changes by id as server sent events",
+				OperationID: "streamVMEvents",
+				Query:       []ParamSpec{lastEventIDParam},
+				Response:    schemaRef("Event"),
+				ContentType: "text/event-stream",
+				Errors:      []ErrorCode{BadRequest, NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.vmEvents, 2, w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/metrics",
+		Path:        mustCompileAnchored(`/vms/\d+/metrics[/]?`),
+		Params:      []ParamSpec{vmIDParam},
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "TelemetrySamples JSON",
+				Doc:         "get the guest telemetry of a VM by id, streamed live as server sent events on Accept: text/event-stream",
+				OperationID: "getVMTelemetry",
+				Query: []ParamSpec{
+					{Name: "from", Doc: "Start of the samples, as a RFC 3339 time (1 hour ago by default)", Schema: timeSchema},
+					{Name: "to", Doc: "End of the samples, as a RFC 3339 time (now by default)", Schema: timeSchema},
+					{Name: "step", Doc: "Period to average the samples over, as a duration such as 1m (5s by default and at least)", Schema: stringSchema},
+				},
+				Response: schemaRef("TelemetrySamples"),
+				Errors:   []ErrorCode{BadRequest, NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.vmTelemetry, 2, w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/console",
+		Path:        mustCompileAnchored(`/vms/\d+/console[/]?`),
+		Params:      []ParamSpec{vmIDParam},
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "ConsoleOutput JSON",
+				Doc:         "get the serial console output of a VM by id, streamed live as server sent events on Accept: text/event-stream",
+				OperationID: "getVMConsole",
+				Query: []ParamSpec{
+					{Name: "offset", Doc: "Byte offset to start from, the next of the previous reply (0 by default)", Schema: integerSchema},
+					{Name: "limit", Doc: "Max number of bytes to reply with (all by default)", Schema: integerSchema},
+				},
+				Response: schemaRef("ConsoleOutput"),
+				Errors:   []ErrorCode{BadRequest, NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.console, 2, w, r)
+				},
+			},
 		},
 	},
 	{
-		DisplayPath: "/vms/{vm_id}/launch",
-		Path:        mustCompileAnchored(`/vms/\d+/launch[/]?`),
+		DisplayPath: "/vms/{vm_id}/history",
+		Path:        mustCompileAnchored(`/vms/\d+/history[/]?`),
+		Params:      []ParamSpec{vmIDParam},
 		Methods: []MethodSpec{
 			{
-				http.MethodPut, "", "launch VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
-					s.requestIDfor(s.launch, 2, w, r)
+				Method:      http.MethodGet,
+				BodySpec:    "AuditEntries JSON",
+				Doc:         "get the audit entries of a VM by id, even if deleted, oldest first",
+				OperationID: "getVMHistory",
+				Response:    schemaRef("AuditEntries"),
+				Errors:      []ErrorCode{NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.history, 2, w, r)
 				},
 			},
 		},
 	},
 	{
-		DisplayPath: "/vms/{vm_id}/stop",
-		Path:        mustCompileAnchored(`/vms/\d+/stop[/]?`),
+		DisplayPath: "/vms/{vm_id}/cancel",
+		Path:        mustCompileAnchored(`/vms/\d+/cancel[/]?`),
+		Params:      []ParamSpec{vmIDParam},
 		Methods: []MethodSpec{
 			{
-				http.MethodPut, "", "stop VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
-					s.requestIDfor(s.stop, 2, w, r)
+				Method:      http.MethodPost,
+				BodySpec:    "Operation JSON",
+				Doc:         "cancel the transition in progress on a VM by id",
+				OperationID: "cancelVMTransition",
+				Response:    schemaRef("Operation"),
+				Errors:      []ErrorCode{NotFound, Conflict},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.cancel, 2, w, r)
 				},
 			},
 		},
@@ -86,21 +244,259 @@ var APISpec = []EndpointSpec{
 	{
 		DisplayPath: "/vms/{vm_id}",
 		Path:        mustCompileAnchored(`/vms/\d+`),
+		Params:      []ParamSpec{vmIDParam},
 		Methods: []MethodSpec{
 			{
-				http.MethodGet, "VM JSON", "inspect a VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+				Method:      http.MethodGet,
+				BodySpec:    "VM JSON",
+				Doc:         "inspect a VM by id",
+				OperationID: "inspectVM",
+				Response:    schemaRef("VM"),
+				Errors:      []ErrorCode{NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.requestIDfor(s.inspect, 2, w, r)
 				},
 			},
 			{
-				http.MethodDelete, "", "delete a VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+				Method:      http.MethodPatch,
+				BodySpec:    "VM JSON",
+				Doc:         "resize a VM by id from a VM JSON merge patch body",
+				OperationID: "resizeVM",
+				Request:     schemaRef("VMPatch"),
+				Example:     `{"storage":512,"network":10000}`,
+				Response:    schemaRef("VM"),
+				Errors:      []ErrorCode{BadRequest, NotFound, ValidationFailed, Conflict},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.resize, 2, w, r)
+				},
+			},
+			{
+				Method:      http.MethodDelete,
+				Doc:         "delete a VM by id",
+				OperationID: "deleteVM",
+				Errors:      []ErrorCode{NotFound, Conflict},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.requestIDfor(s.delete, 2, w, r)
 				},
 			},
 		},
 	},
+	{
+		DisplayPath: "/operations",
+		Path:        mustCompileAnchored(`/operations[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "Operations JSON",
+				Doc:         "list operations on VMs",
+				OperationID: "listOperations",
+				Response:    schemaRef("Operations"),
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.listOperations(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/operations/{op_id}",
+		Path:        mustCompileAnchored(`/operations/\d+`),
+		Params:      []ParamSpec{opIDParam},
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "Operation JSON",
+				Doc:         "inspect an operation by id",
+				OperationID: "inspectOperation",
+				Response:    schemaRef("Operation"),
+				Errors:      []ErrorCode{NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.inspectOperation, 2, w, r)
+				},
+			},
+			{
+				Method:      http.MethodDelete,
+				BodySpec:    "Operation JSON",
+				Doc:         "cancel an operation in progress by id",
+				OperationID: "cancelOperation",
+				Response:    schemaRef("Operation"),
+				Errors:      []ErrorCode{NotFound, Conflict},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.cancelOperation, 2, w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/operations/{op_id}:wait",
+		Path:        mustCompileAnchored(`/operations/\d+:wait`),
+		Params:      []ParamSpec{opIDParam},
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "Operation JSON",
+				Doc:         "wait for an operation to finish, up to ?timeout=",
+				OperationID: "waitOperation",
+				Query: []ParamSpec{{
+					Name:   "timeout",
+					Doc:    "How long to wait at most, as a duration such as 10s (30s by default, 5m at most)",
+					Schema: stringSchema,
+				}},
+				Response: schemaRef("Operation"),
+				Errors:   []ErrorCode{BadRequest, NotFound},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.waitOperation, 2, w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/audit",
+		Path:        mustCompileAnchored(`/audit[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "AuditEntries JSON",
+				Doc:         "list the audit entries of API mutations and VM transitions, oldest first",
+				OperationID: "listAuditEntries",
+				Query: []ParamSpec{
+					{Name: "since", Doc: "Only entries after this sequence number, or at or after this RFC 3339 time", Schema: stringSchema},
+					{Name: "vm", Doc: "Only entries of the VM with this id", Schema: integerSchema},
+					{Name: "action", Doc: "Only entries of this action, such as delete or transition", Schema: stringSchema},
+				},
+				Response: schemaRef("AuditEntries"),
+				Errors:   []ErrorCode{BadRequest},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.auditLog(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/ws",
+		Path:        mustCompileAnchored(`/ws[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodGet,
+				BodySpec:    "WebSocket",
+				Doc:         "subscribe to VM changes and send commands over a WebSocket",
+				OperationID: "webSocket",
+				Status:      http.StatusSwitchingProtocols,
+				Errors:      []ErrorCode{UpgradeRequired},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.webSocket(w, r)
+				},
+			},
+		},
+	},
+}
+
+func init() {
+	// Appended here as their handlers read APISpec, which would be
+	// an initialization cycle within the baseAPISpec declaration itself
+	baseAPISpec = append(baseAPISpec,
+		EndpointSpec{
+			DisplayPath: "/openapi.json",
+			Path:        mustCompileAnchored(`/openapi\.json`),
+			Methods: []MethodSpec{
+				{
+					Method:      http.MethodGet,
+					BodySpec:    "OpenAPI JSON",
+					Doc:         "get the OpenAPI 3.1 document of this API",
+					OperationID: "getOpenAPIJSON",
+					Response:    objectSchema,
+					Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+						s.openAPI(jsonFormat, w, r)
+					},
+				},
+			},
+		},
+		EndpointSpec{
+			DisplayPath: "/openapi.yaml",
+			Path:        mustCompileAnchored(`/openapi\.ya?ml`),
+			Methods: []MethodSpec{
+				{
+					Method:      http.MethodGet,
+					BodySpec:    "OpenAPI YAML",
+					Doc:         "get the OpenAPI 3.1 document of this API in YAML",
+					OperationID: "getOpenAPIYAML",
+					Response:    objectSchema,
+					ContentType: "application/yaml",
+					Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+						s.openAPI(yamlFormat, w, r)
+					},
+				},
+			},
+		},
+		EndpointSpec{
+			DisplayPath: "/docs",
+			Path:        mustCompileAnchored(`/docs[/]?`),
+			Methods: []MethodSpec{
+				{
+					Method:      http.MethodGet,
+					BodySpec:    "HTML page",
+					Doc:         "explore and try this API from the browser",
+					OperationID: "getDocs",
+					Response:    stringSchema,
+					ContentType: "text/html",
+					Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+						s.docs(w, r)
+					},
+				},
+			},
+		},
+	)
+	APISpec = withActionEndpoints(baseAPISpec, currentRules().kinds)
+}
+
+// withActionEndpoints returns the endpoints along with an endpoint per
+// action kind, listed before the cancel endpoint
+func withActionEndpoints(endpoints []EndpointSpec, kinds []OperationKind) []EndpointSpec {
+	spec := make([]EndpointSpec, 0, len(endpoints)+len(kinds))
+	for _, endpoint := range endpoints {
+		if endpoint.DisplayPath == "/vms/{vm_id}/cancel" {
+			for _, kind := range kinds {
+				spec = append(spec, actionEndpoint(kind))
+			}
+		}
+		spec = append(spec, endpoint)
+	}
+	return spec
+}
+
+// actionEndpoint specifies the endpoint performing the action of the given
+// kind on a VM, such as "/vms/{vm_id}/launch" for LAUNCH
+func actionEndpoint(kind OperationKind) EndpointSpec {
+	action := currentRules().actions[kind]
+	from := make([]string, 0, len(action.From))
+	for _, state := range action.From {
+		from = append(from, string(state))
+	}
+	when := from[len(from)-1]
+	if len(from) > 1 {
+		when = strings.Join(from[:len(from)-1], ", ") + " or " + when
+	}
+	doc := fmt.Sprintf("%s VM by id, when %s", kind, when)
+	return EndpointSpec{
+		DisplayPath: fmt.Sprintf("/vms/{vm_id}/%s", kind),
+		Path:        mustCompileAnchored(fmt.Sprintf(`/vms/\d+/%s[/]?`, regexp.QuoteMeta(string(kind)))),
+		Params:      []ParamSpec{vmIDParam},
+		Methods: []MethodSpec{
+			{
+				Method:      http.MethodPut,
+				BodySpec:    "Operation JSON",
+				Doc:         doc,
+				OperationID: fmt.Sprintf("%sVM", kind),
+				Status:      http.StatusAccepted,
+				Response:    schemaRef("Operation"),
+				Errors:      []ErrorCode{NotFound, IllegalTransition},
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(func(id int, w http.ResponseWriter, r *http.Request) {
+						s.perform(kind, id, w, r)
+					}, 2, w, r)
+				},
+			},
+		},
+	}
 }
 
 // Names returns the list of methods names in a MethodSpecs list
@@ -114,13 +510,18 @@ func (ms MethodSpecs) Names() []string {
 
 // NewVMServer returns a new VM server
 func NewVMServer(vms VMs) *VMServer {
-	return &VMServer{Cloud{vms: vms}}
+	return &VMServer{vmm: NewCloud(vms)}
 }
 
 // WriteAPIDoc dumps the API simple doc onto the given writer
 func (s *VMServer) WriteAPIDoc(w io.Writer) {
 	fmt.Fprintln(w, "API:")
-	for _, endpoint := range APISpec {
+	writeEndpointsDoc(w, APISpec)
+}
+
+// writeEndpointsDoc dumps a line of doc per method of the given endpoints
+func writeEndpointsDoc(w io.Writer, endpoints []EndpointSpec) {
+	for _, endpoint := range endpoints {
 		for _, m := range endpoint.Methods {
 			bodySpec := m.BodySpec
 			if bodySpec == "" {
@@ -136,8 +537,29 @@ func (s *VMServer) WriteAPIDoc(w io.Writer) {
 func (s *VMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("<- %v %v", r.Method, r.URL.Path)
 	prepareCORSHeaders(w, r)
-	for _, endpoint := range APISpec {
-		if endpoint.Path.MatchString(r.URL.Path) {
+	ensureRequestID(w, r)
+	if endpoint, m, found := findMethod(APISpec, r); found {
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		defer func() {
+			s.requests.observe(endpoint.DisplayPath, m.Method, recorder.code(), time.Since(start), isStream(m, r))
+		}()
+		w = recorder
+	}
+	s.chaos.serve(w, r, func(w http.ResponseWriter, r *http.Request) {
+		s.dispatch(w, r, APISpec)
+	})
+}
+
+// dispatch calls the handler of the first endpoint and method matching the
+// request within the given specs, replying with an error if there is none
+func (s *VMServer) dispatch(w http.ResponseWriter, r *http.Request, specs ...[]EndpointSpec) {
+	var allowed []string
+	for _, spec := range specs {
+		for _, endpoint := range spec {
+			if !endpoint.Path.MatchString(r.URL.Path) {
+				continue
+			}
 			for _, m := range endpoint.Methods {
 				if r.Method == m.Method {
 					m.Handler(s, w, r)
@@ -148,10 +570,15 @@ func (s *VMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				preflightReply(w, r, endpoint.Methods.Names())
 				return
 			}
+			allowed = append(allowed, endpoint.Methods.Names()...)
 		}
 	}
-	msg := fmt.Sprintf("%v %v not allowed", r.Method, r.URL.Path)
-	http.Error(w, msg, http.StatusMethodNotAllowed)
+	if len(allowed) == 0 {
+		writeError(w, r, newError(NotFound, "%v not found", r.URL.Path))
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, r, newError(MethodNotAllowed, "%v %v not allowed", r.Method, r.URL.Path))
 }
 
 func matches(r *http.Request, method string, pathRegex *regexp.Regexp) bool {
@@ -161,47 +588,319 @@ func matches(r *http.Request, method string, pathRegex *regexp.Regexp) bool {
 	return pathRegex.MatchString(r.URL.Path)
 }
 
-func (s *VMServer) list(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, fmt.Sprintf("%v not allowed", r.Method), http.StatusMethodNotAllowed)
+func (s *VMServer) create(w http.ResponseWriter, r *http.Request) {
+	vm, err := decodeVM(r.Body)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	fmt.Fprint(w, s.vmm.List().String())
+	op, vm, status, err := s.createVM(requesterOf(r), vm)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", vmLocation(op.VMID))
+	w.Header().Set("Operation-Location", operationLocation(op.ID))
+	w.WriteHeader(status)
+	fmt.Fprint(w, vm)
 }
 
+func (s *VMServer) resize(id int, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, newError(BadRequest, "error reading VM patch: %v", err))
+		return
+	}
+	vm, _, err := s.resizeVM(requesterOf(r), id, body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, vm)
+}
+
+// requestIDfor calls f with the id found at position pos of the path,
+// ignoring any custom method suffix such as in "/operations/1:wait"
 func (s *VMServer) requestIDfor(f idHandlerFunc, pos int, w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
-	id, err := strconv.Atoi(path.Base(pathParts[pos]))
+	idPart := strings.SplitN(path.Base(pathParts[pos]), ":", 2)[0]
+	id, err := strconv.Atoi(idPart)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, newError(BadRequest, "bad id %q: %v", idPart, err))
 		return
 	}
 	f(id, w, r)
 }
 
-func (s *VMServer) launch(id int, w http.ResponseWriter, r *http.Request) {
-	if _, err := s.vmm.Launch(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+func (s *VMServer) perform(kind OperationKind, id int, w http.ResponseWriter, r *http.Request) {
+	op, status, err := s.performVM(requesterOf(r), id, kind)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	replyOperation(op, status, w)
+}
+
+func (s *VMServer) cancel(id int, w http.ResponseWriter, r *http.Request) {
+	op, status, err := s.cancelVM(requesterOf(r), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	replyOperation(op, status, w)
+}
+
+func (s *VMServer) cancelOperation(id int, w http.ResponseWriter, r *http.Request) {
+	var target *int
+	var old VMState
+	if op, found := s.vmm.Operation(id); found {
+		target, old = s.auditTarget(op.VMID)
+	}
+	op, err := s.vmm.CancelOperation(id)
+	s.audit(requesterOf(r), "cancel", target, old, err)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	replyOperation(op, http.StatusOK, w)
+}
+
+func replyOperation(op Operation, status int, w http.ResponseWriter) {
+	w.Header().Set("Location", operationLocation(op.ID))
+	w.WriteHeader(status)
+	fmt.Fprint(w, op)
+}
+
+func (s *VMServer) listOperations(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, s.vmm.Operations().String())
 }
 
-func (s *VMServer) stop(id int, w http.ResponseWriter, r *http.Request) {
-	if _, err := s.vmm.Stop(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+func (s *VMServer) inspectOperation(id int, w http.ResponseWriter, r *http.Request) {
+	op, found := s.vmm.Operation(id)
+	if !found {
+		writeError(w, r, newError(NotFound, "not found operation with id %d", id))
 		return
 	}
+	fmt.Fprint(w, op)
+}
+
+// DefaultWaitTimeout is how long operation waits last when not told otherwise
+const DefaultWaitTimeout = 30 * time.Second
+
+// MaxWaitTimeout caps how long a single operation wait can last
+const MaxWaitTimeout = 5 * time.Minute
+
+// waitOperation replies with the operation as soon as it finishes or the
+// timeout expires, whatever happens first
+func (s *VMServer) waitOperation(id int, w http.ResponseWriter, r *http.Request) {
+	timeout := DefaultWaitTimeout
+	if timeoutParam := r.URL.Query().Get("timeout"); timeoutParam != "" {
+		var err error
+		if timeout, err = time.ParseDuration(timeoutParam); err != nil || timeout < 0 {
+			writeError(w, r, newError(BadRequest, "bad timeout %q, want a duration such as 10s", timeoutParam))
+			return
+		}
+		if timeout > MaxWaitTimeout {
+			timeout = MaxWaitTimeout
+		}
+	}
+	op, found := s.vmm.Operation(id)
+	if !found {
+		writeError(w, r, newError(NotFound, "not found operation with id %d", id))
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-op.Done():
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	s.inspectOperation(id, w, r)
 }
 
 func (s *VMServer) delete(id int, w http.ResponseWriter, r *http.Request) {
-	if err := s.vmm.Delete(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotAcceptable)
+	if _, err := s.deleteVM(requesterOf(r), id); err != nil {
+		writeError(w, r, err)
 	}
 }
 
 func (s *VMServer) inspect(id int, w http.ResponseWriter, r *http.Request) {
-	vm, _ := s.vmm.Inspect(id)
-	if _, err := fmt.Fprint(w, vm); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	vm, _, err := s.inspectVM(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Fprint(w, vm)
+}
+
+// The xxxVM methods below implement the actions shared by the REST handlers
+// and the WebSocket API, so that both reply with the same status codes.
+// On error, the status is the one the error maps to.
+// The ones changing VMs record who asked for it in the audit journal.
+
+func vmLocation(id int) string {
+	return fmt.Sprintf("/vms/%d", id)
+}
+
+func operationLocation(id int) string {
+	return fmt.Sprintf("/operations/%d", id)
+}
+
+// decodeVM reads the VM JSON of a create request, refusing unknown fields
+func decodeVM(body io.Reader) (VM, error) {
+	var vm VM
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&vm); err != nil {
+		return VM{}, newError(BadRequest, "invalid VM JSON: %v", err)
+	}
+	return vm, nil
+}
+
+func (s *VMServer) createVM(req requester, vm VM) (Operation, VM, int, error) {
+	op, vm, err := s.vmm.CreateOperation(vm)
+	var id *int
+	if err == nil {
+		id = &op.VMID
+	}
+	s.audit(req, "create", id, "", err)
+	if err != nil {
+		return Operation{}, VM{}, statusFor(err), err
+	}
+	return op, vm, http.StatusCreated, nil
+}
+
+func (s *VMServer) inspectVM(id int) (VM, int, error) {
+	vm, found := s.vmm.Inspect(id)
+	if !found {
+		err := newError(NotFound, "not found VM with id %d", id)
+		return VM{}, statusFor(err), err
+	}
+	return vm, http.StatusOK, nil
+}
+
+func (s *VMServer) resizeVM(req requester, id int, patchJSON []byte) (VM, int, error) {
+	target, old := s.auditTarget(id)
+	patch, err := ParseVMPatch(patchJSON)
+	var vm VM
+	if err == nil {
+		vm, err = s.vmm.Resize(id, patch)
+	}
+	s.audit(req, "resize", target, old, err)
+	if err != nil {
+		return VM{}, statusFor(err), err
+	}
+	return vm, http.StatusOK, nil
+}
+
+func (s *VMServer) performVM(req requester, id int, kind OperationKind) (Operation, int, error) {
+	target, old := s.auditTarget(id)
+	op, err := s.vmm.StartOperation(id, kind)
+	s.audit(req, string(kind), target, old, err)
+	if err != nil {
+		return Operation{}, statusFor(err), err
+	}
+	return op, http.StatusAccepted, nil
+}
+
+func (s *VMServer) cancelVM(req requester, id int) (Operation, int, error) {
+	target, old := s.auditTarget(id)
+	op, err := s.vmm.Cancel(id)
+	s.audit(req, "cancel", target, old, err)
+	if err != nil {
+		return Operation{}, statusFor(err), err
+	}
+	return op, http.StatusOK, nil
+}
+
+func (s *VMServer) deleteVM(req requester, id int) (int, error) {
+	target, old := s.auditTarget(id)
+	err := s.vmm.Delete(id)
+	s.audit(req, "delete", target, old, err)
+	if err != nil {
+		return statusFor(err), err
+	}
+	return http.StatusOK, nil
+}
+
+// sseKeepAlive is the period to send comments on idle event streams,
+// so that proxies and browsers do not drop the connection
+const sseKeepAlive = 15 * time.Second
+
+// streamPoll is how often live streams of telemetry or console output look
+// for new data
+const streamPoll = time.Second
+
+func allEvents(e Event) bool {
+	return true
+}
+
+func (s *VMServer) vmEvents(id int, w http.ResponseWriter, r *http.Request) {
+	if _, found := s.vmm.Inspect(id); !found {
+		writeError(w, r, newError(NotFound, "not found VM with id %d", id))
+		return
+	}
+	s.streamEvents(func(e Event) bool {
+		return e.VMID == id
+	}, w, r)
+}
+
+// streamEvents writes the events passing filter as a text/event-stream.
+// Clients resume from the event after the one given by the Last-Event-ID
+// header, or the lastEventId query parameter.
+func (s *VMServer) streamEvents(filter func(Event) bool, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, newError(Internal, "streaming unsupported"))
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var since uint64
+	if lastEventID != "" {
+		var err error
+		if since, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			writeError(w, r, newError(BadRequest, "bad Last-Event-ID: %v", err))
+			return
+		}
+	}
+	events, backlog, cancel := s.vmm.Subscribe(since)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range backlog {
+		if filter(e) {
+			e.writeSSE(w)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return // too slow, the client can resume with Last-Event-ID
+			}
+			if !filter(e) {
+				continue
+			}
+			if err := e.writeSSE(w); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
 	}
 }
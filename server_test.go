@@ -0,0 +1,379 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiCase is a request to the API server along with its expected reply
+type apiCase struct {
+	endpoint   string // APISpec DisplayPath covered by the case
+	method     string
+	path       string
+	body       string
+	before     func() // optional setup, such as changing timeUnit
+	wantStatus int
+	wantBody   string                 // exact body, unless anyBody or wantFields are set
+	anyBody    bool                   // skip checking the body, for lists or streams
+	wantFields map[string]interface{} // fields in the JSON body, if set
+	wantHeader map[string]string      // reply headers, if set
+	noAuth     bool                   // send admin requests without the admin token
+}
+
+// testAdminToken is the admin token of the test server
+const testAdminToken = "secret"
+
+// problem returns the wantFields of a Problem reply with the given code
+func problem(code ErrorCode) map[string]interface{} {
+	return map[string]interface{}{"code": string(code), "status": float64(errorStatus[code])}
+}
+
+func slowTime() {
+	timeUnit = time.Second
+}
+
+var apiCases = []apiCase{
+	{endpoint: "/vms", method: http.MethodGet, path: "/vms",
+		wantStatus: http.StatusOK, wantBody: defaultVMs.String()},
+	{endpoint: "/vms", method: http.MethodGet, path: "/vms?state=Stopped&ram>=8192&fields=ram",
+		wantStatus: http.StatusOK, wantBody: `{"1":{"ram":32768},"2":{"ram":8192}}`,
+		wantHeader: map[string]string{"X-Total-Count": "2"}},
+	{endpoint: "/vms", method: http.MethodGet, path: "/vms?sort=color",
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/vms/{vm_id}", method: http.MethodGet, path: "/vms/1",
+		wantStatus: http.StatusOK, wantBody: defaultVMs[GoodID].String()},
+	{endpoint: "/vms/{vm_id}", method: http.MethodGet, path: fmt.Sprintf("/vms/%d", BadID),
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound),
+		wantHeader: map[string]string{"Content-Type": ProblemContentType}},
+	{endpoint: "/vms", method: http.MethodPost, path: "/vms",
+		body:       `{"vcpus":1,"clock":1500,"ram":4096,"storage":128,"network":1000}`,
+		wantStatus: http.StatusCreated, wantFields: map[string]interface{}{"state": "Provisioning", "ram": 4096.0},
+		wantHeader: map[string]string{"Location": "/vms/3", "Operation-Location": "/operations/1"}},
+	{endpoint: "/vms", method: http.MethodPost, path: "/vms",
+		body:       `{"vcpus":1,"clock":1500,"ram":0,"storage":128,"network":1000}`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/vms", method: http.MethodPost, path: "/vms", body: `{"cpus":1}`,
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/vms/{vm_id}", method: http.MethodPatch, path: "/vms/2", body: `{"ram":16384}`,
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"ram": 16384.0, "vcpus": 2.0}},
+	{endpoint: "/vms/{vm_id}", method: http.MethodPatch, path: "/vms/2", body: `{"storage":1}`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/vms/{vm_id}", method: http.MethodPatch, path: "/vms/2", body: `{"ram":null}`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/vms/{vm_id}", method: http.MethodPatch, path: "/vms/2", body: `{"cpus":2}`,
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/vms/{vm_id}", method: http.MethodPatch, path: fmt.Sprintf("/vms/%d", BadID), body: `{"ram":1}`,
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/vms/{vm_id}/stop", method: http.MethodPut, path: "/vms/1/stop",
+		wantStatus: http.StatusConflict, wantFields: problem(IllegalTransition)},
+	{endpoint: "/vms/{vm_id}/launch", method: http.MethodPut, path: fmt.Sprintf("/vms/%d/launch", BadID),
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/vms/{vm_id}/launch", method: http.MethodPut, path: "/vms/1/launch", before: shrinkTime,
+		wantStatus: http.StatusAccepted,
+		wantFields: map[string]interface{}{"id": 2.0, "vm": 1.0, "kind": "launch", "status": "Pending"},
+		wantHeader: map[string]string{"Location": "/operations/2"}},
+	{endpoint: "/operations/{op_id}:wait", method: http.MethodGet, path: "/operations/2:wait?timeout=1s",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"id": 2.0, "status": "Done"}},
+	{endpoint: "/vms/{vm_id}", method: http.MethodPatch, path: "/vms/1", body: `{"vcpus":8}`,
+		wantStatus: http.StatusConflict, wantFields: problem(Conflict)},
+	{endpoint: "/vms/{vm_id}", method: http.MethodPatch, path: "/vms/1", body: `{"storage":1024}`,
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"storage": 1024.0, "state": "Running"}},
+	{endpoint: "/operations/{op_id}:wait", method: http.MethodGet, path: "/operations/2:wait?timeout=soon",
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/operations/{op_id}", method: http.MethodGet, path: "/operations/2",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"id": 2.0, "kind": "launch", "status": "Done"}},
+	{endpoint: "/operations/{op_id}", method: http.MethodGet, path: "/operations/99",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/operations/{op_id}", method: http.MethodDelete, path: "/operations/2",
+		wantStatus: http.StatusConflict, wantFields: problem(Conflict)},
+	{endpoint: "/operations", method: http.MethodGet, path: "/operations",
+		wantStatus: http.StatusOK, anyBody: true},
+	{endpoint: "/vms/{vm_id}/launch", method: http.MethodPut, path: "/vms/1/launch",
+		wantStatus: http.StatusConflict, wantFields: problem(IllegalTransition)},
+	{endpoint: "/vms/{vm_id}/stop", method: http.MethodPut, path: "/vms/1/stop", before: slowTime,
+		wantStatus: http.StatusAccepted,
+		wantFields: map[string]interface{}{"id": 3.0, "vm": 1.0, "kind": "stop", "status": "Pending"}},
+	{endpoint: "/vms/{vm_id}", method: http.MethodDelete, path: "/vms/1",
+		wantStatus: http.StatusConflict, wantFields: problem(Conflict)},
+	{endpoint: "/vms/{vm_id}/cancel", method: http.MethodPost, path: "/vms/1/cancel",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"id": 3.0, "status": "Cancelled"}},
+	{endpoint: "/vms/{vm_id}/cancel", method: http.MethodPost, path: "/vms/1/cancel",
+		wantStatus: http.StatusConflict, wantFields: problem(Conflict)},
+	{endpoint: "/vms/{vm_id}/stop", method: http.MethodPut, path: "/vms/1/stop",
+		wantStatus: http.StatusAccepted, wantFields: map[string]interface{}{"id": 4.0, "kind": "stop"}},
+	{endpoint: "/operations/{op_id}", method: http.MethodDelete, path: "/operations/4",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"id": 4.0, "status": "Cancelled"}},
+	{endpoint: "/vms/{vm_id}/resume", method: http.MethodPut, path: "/vms/1/resume",
+		wantStatus: http.StatusConflict, wantFields: problem(IllegalTransition)},
+	{endpoint: "/vms/{vm_id}/suspend", method: http.MethodPut, path: "/vms/1/suspend", before: shrinkTime,
+		wantStatus: http.StatusAccepted,
+		wantFields: map[string]interface{}{"id": 5.0, "vm": 1.0, "kind": "suspend", "status": "Pending"}},
+	{endpoint: "/operations/{op_id}:wait", method: http.MethodGet, path: "/operations/5:wait?timeout=1s",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"id": 5.0, "status": "Done"}},
+	{endpoint: "/vms/{vm_id}/reboot", method: http.MethodPut, path: "/vms/1/reboot",
+		wantStatus: http.StatusConflict, wantFields: problem(IllegalTransition)},
+	{endpoint: "/vms/{vm_id}/resume", method: http.MethodPut, path: "/vms/1/resume",
+		wantStatus: http.StatusAccepted, wantFields: map[string]interface{}{"id": 6.0, "kind": "resume"}},
+	{endpoint: "/operations/{op_id}:wait", method: http.MethodGet, path: "/operations/6:wait?timeout=1s",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"id": 6.0, "status": "Done"}},
+	{endpoint: "/vms/{vm_id}/reboot", method: http.MethodPut, path: "/vms/1/reboot",
+		wantStatus: http.StatusAccepted, wantFields: map[string]interface{}{"id": 7.0, "kind": "reboot"}},
+	{endpoint: "/vms/{vm_id}", method: http.MethodGet, path: "/vms/1",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"state": "Rebooting"}},
+	{endpoint: "/vms/{vm_id}", method: http.MethodDelete, path: "/vms/0",
+		wantStatus: http.StatusOK, wantBody: ""},
+	{endpoint: "/vms/{vm_id}", method: http.MethodGet, path: "/vms/0",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/vms/{vm_id}", method: http.MethodDelete, path: "/vms/0",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/vms/events", method: http.MethodGet, path: "/vms/events",
+		wantStatus: http.StatusOK, anyBody: true, wantHeader: map[string]string{"Content-Type": "text/event-stream"}},
+	{endpoint: "/vms/{vm_id}/events", method: http.MethodGet, path: "/vms/2/events",
+		wantStatus: http.StatusOK, anyBody: true, wantHeader: map[string]string{"Content-Type": "text/event-stream"}},
+	{endpoint: "/vms/{vm_id}/events", method: http.MethodGet, path: "/vms/0/events",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/vms/{vm_id}/metrics", method: http.MethodGet, path: "/vms/2/metrics?step=1m",
+		wantStatus: http.StatusOK, anyBody: true},
+	{endpoint: "/vms/{vm_id}/metrics", method: http.MethodGet, path: "/vms/2/metrics?step=1s",
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/vms/{vm_id}/metrics", method: http.MethodGet, path: "/vms/2/metrics?from=yesterday",
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/vms/{vm_id}/metrics", method: http.MethodGet, path: "/vms/0/metrics",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/vms/{vm_id}/console", method: http.MethodGet, path: "/vms/2/console?offset=0&limit=100",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"start": 0.0}},
+	{endpoint: "/vms/{vm_id}/console", method: http.MethodGet, path: "/vms/2/console?offset=-1",
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/vms/{vm_id}/console", method: http.MethodGet, path: "/vms/0/console",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/vms/{vm_id}/history", method: http.MethodGet, path: "/vms/0/history",
+		wantStatus: http.StatusOK, anyBody: true},
+	{endpoint: "/vms/{vm_id}/history", method: http.MethodGet, path: fmt.Sprintf("/vms/%d/history", BadID),
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/audit", method: http.MethodGet, path: "/audit?since=3&vm=1&action=transition",
+		wantStatus: http.StatusOK, anyBody: true},
+	{endpoint: "/audit", method: http.MethodGet, path: "/audit?since=yesterday",
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/ws", method: http.MethodGet, path: "/ws",
+		wantStatus: http.StatusUpgradeRequired, wantFields: problem(UpgradeRequired)},
+	{endpoint: "/openapi.json", method: http.MethodGet, path: "/openapi.json",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"openapi": "3.1.0"}},
+	{endpoint: "/openapi.yaml", method: http.MethodGet, path: "/openapi.yaml",
+		wantStatus: http.StatusOK, anyBody: true,
+		wantHeader: map[string]string{"Content-Type": "application/yaml"}},
+	{endpoint: "/docs", method: http.MethodGet, path: "/docs",
+		wantStatus: http.StatusOK, anyBody: true,
+		wantHeader: map[string]string{"Content-Type": "text/html; charset=utf-8"}},
+	{endpoint: "/admin/faults", method: http.MethodGet, path: "/admin/faults",
+		wantStatus: http.StatusOK, wantBody: "[]"},
+	{endpoint: "/admin/faults", method: http.MethodPut, path: "/admin/faults",
+		body:       `[{"vm":2,"action":"launch","probability":0.5}]`,
+		wantStatus: http.StatusOK, wantBody: `[{"vm":2,"action":"launch","probability":0.5,"outcome":"error"}]`},
+	{endpoint: "/admin/faults", method: http.MethodPut, path: "/admin/faults", body: `[{"probability":2}]`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/admin/faults", method: http.MethodPost, path: "/admin/faults",
+		body:       `{"action":"stop","probability":1,"outcome":"rollback","count":1}`,
+		wantStatus: http.StatusOK,
+		wantBody:   `[{"vm":2,"action":"launch","probability":0.5,"outcome":"error"},{"action":"stop","probability":1,"outcome":"rollback","count":1}]`},
+	{endpoint: "/admin/faults", method: http.MethodPost, path: "/admin/faults", body: `{"vm":"two"}`,
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/admin/faults", method: http.MethodDelete, path: "/admin/faults",
+		wantStatus: http.StatusNoContent, wantBody: ""},
+	{endpoint: "/admin/chaos", method: http.MethodGet, path: "/admin/chaos",
+		wantStatus: http.StatusOK, wantBody: "[]"},
+	{endpoint: "/admin/chaos", method: http.MethodPut, path: "/admin/chaos",
+		body:       `[{"endpoint":"/vms/{vm_id}","method":"DELETE","fault":"throttle","probability":1,"retryAfter":3}]`,
+		wantStatus: http.StatusOK,
+		wantBody:   `[{"endpoint":"/vms/{vm_id}","method":"DELETE","fault":"throttle","probability":1,"retryAfter":3}]`},
+	{endpoint: "/vms/{vm_id}", method: http.MethodDelete, path: "/vms/2",
+		wantStatus: http.StatusTooManyRequests, wantFields: problem(TooManyRequests),
+		wantHeader: map[string]string{"Retry-After": "3"}},
+	{endpoint: "/admin/chaos", method: http.MethodPut, path: "/admin/chaos", body: `[{"fault":"latency","probability":1}]`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/admin/chaos", method: http.MethodPost, path: "/admin/chaos",
+		body:       `{"method":"PATCH","fault":"unavailable","probability":0}`,
+		wantStatus: http.StatusOK,
+		wantBody:   `[{"endpoint":"/vms/{vm_id}","method":"DELETE","fault":"throttle","probability":1,"retryAfter":3},{"method":"PATCH","fault":"unavailable","probability":0}]`},
+	{endpoint: "/admin/chaos", method: http.MethodPost, path: "/admin/chaos", body: `{"fault":1}`,
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/admin/chaos", method: http.MethodDelete, path: "/admin/chaos",
+		wantStatus: http.StatusNoContent, wantBody: ""},
+	{endpoint: "/admin/clock", method: http.MethodGet, path: "/admin/clock",
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"virtual": false}},
+	{endpoint: "/admin/clock", method: http.MethodPut, path: "/admin/clock", body: `{"timeScale":0.5}`,
+		wantStatus: http.StatusOK, wantFields: map[string]interface{}{"timeScale": 0.5}},
+	{endpoint: "/admin/clock", method: http.MethodPut, path: "/admin/clock", body: `{"timeScale":-1}`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/admin/clock/advance", method: http.MethodPost, path: "/admin/clock/advance?d=30s",
+		wantStatus: http.StatusConflict, wantFields: problem(Conflict)},
+	{endpoint: "/admin/clock/advance", method: http.MethodPost, path: "/admin/clock/advance?d=soon",
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/admin/snapshots", method: http.MethodPost, path: "/admin/snapshots", body: `{"name":"before-reset"}`,
+		wantStatus: http.StatusCreated, wantFields: map[string]interface{}{"name": "before-reset"}},
+	{endpoint: "/admin/snapshots", method: http.MethodPost, path: "/admin/snapshots", body: `{"name":""}`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/admin/snapshots", method: http.MethodGet, path: "/admin/snapshots",
+		wantStatus: http.StatusOK, anyBody: true},
+	{endpoint: "/admin/reset", method: http.MethodPost, path: "/admin/reset",
+		wantStatus: http.StatusOK, wantBody: defaultVMs.String()},
+	{endpoint: "/admin/snapshots/{name}/restore", method: http.MethodPost, path: "/admin/snapshots/before-reset/restore",
+		wantStatus: http.StatusOK, anyBody: true},
+	{endpoint: "/vms/{vm_id}", method: http.MethodGet, path: "/vms/0",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/admin/snapshots/{name}/restore", method: http.MethodPost, path: "/admin/snapshots/missing/restore",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+	{endpoint: "/admin/state", method: http.MethodPut, path: "/admin/state",
+		body:       `{"5":{"vcpus":1,"clock":1500,"ram":4096,"storage":128,"network":1000,"state":"Stopped"}}`,
+		wantStatus: http.StatusOK, wantBody: `{"5":{"vcpus":1,"clock":1500,"ram":4096,"storage":128,"network":1000,"state":"Stopped"}}`},
+	{endpoint: "/admin/state", method: http.MethodPut, path: "/admin/state", body: `{"5":{"vcpus":0}}`,
+		wantStatus: http.StatusUnprocessableEntity, wantFields: problem(ValidationFailed)},
+	{endpoint: "/admin/state", method: http.MethodPut, path: "/admin/state", body: `[]`,
+		wantStatus: http.StatusBadRequest, wantFields: problem(BadRequest)},
+	{endpoint: "/admin/state", method: http.MethodGet, path: "/admin/state",
+		wantStatus: http.StatusOK, wantBody: `{"5":{"vcpus":1,"clock":1500,"ram":4096,"storage":128,"network":1000,"state":"Stopped"}}`},
+	{endpoint: "/metrics", method: http.MethodGet, path: "/metrics",
+		wantStatus: http.StatusOK, anyBody: true,
+		wantHeader: map[string]string{"Content-Type": MetricsContentType}},
+	{method: http.MethodGet, path: "/admin/state", noAuth: true,
+		wantStatus: http.StatusUnauthorized, wantFields: problem(Unauthorized),
+		wantHeader: map[string]string{"WWW-Authenticate": `Bearer realm="admin"`}},
+	{method: http.MethodOptions, path: "/admin/state", noAuth: true,
+		wantStatus: http.StatusNoContent, anyBody: true},
+	{method: http.MethodDelete, path: "/vms",
+		wantStatus: http.StatusMethodNotAllowed, wantFields: problem(MethodNotAllowed),
+		wantHeader: map[string]string{"Allow": "GET, POST"}},
+	{method: http.MethodGet, path: "/nowhere",
+		wantStatus: http.StatusNotFound, wantFields: problem(NotFound)},
+}
+
+// serve sends the request of the case to the server and records the reply.
+// Admin requests go to the admin handler, with the admin token unless noAuth.
+// Streaming endpoints get a cancelled context so that they return right away.
+func (tc apiCase) serve(server *VMServer) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+	var handler http.Handler = server
+	if _, _, admin := findMethod(AdminSpec, r); admin || strings.HasPrefix(tc.path, "/admin/") {
+		handler = server.AdminHandler(testAdminToken)
+		if !tc.noAuth {
+			r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		}
+	}
+	if strings.HasSuffix(tc.endpoint, "/events") {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancel()
+		r = r.WithContext(ctx)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPI(t *testing.T) {
+	defer shrinkTime()
+	server := NewVMServer(defaultVMs.clone())
+	for i, tc := range apiCases {
+		if tc.before != nil {
+			tc.before()
+		}
+		w := tc.serve(server)
+		name := fmt.Sprintf("case #%d %v %v", i, tc.method, tc.path)
+		if w.Code != tc.wantStatus {
+			t.Fatalf("%s: got status: %d, want: %d (body: %s)", name, w.Code, tc.wantStatus, w.Body)
+		}
+		if tc.wantFields == nil && !tc.anyBody && w.Body.String() != tc.wantBody {
+			t.Fatalf("%s: got body: %q, want: %q", name, w.Body, tc.wantBody)
+		}
+		if tc.wantFields != nil {
+			var got map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("%s: invalid JSON body %q: %v", name, w.Body, err)
+			}
+			for field, want := range tc.wantFields {
+				if got[field] != want {
+					t.Fatalf("%s: got %s: %v, want: %v (body: %s)", name, field, got[field], want, w.Body)
+				}
+			}
+		}
+		for header, want := range tc.wantHeader {
+			if got := w.Header().Get(header); got != want {
+				t.Fatalf("%s: got header %s: %q, want: %q", name, header, got, want)
+			}
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	server := NewVMServer(defaultVMs.clone())
+	admin := server.AdminHandler(testAdminToken)
+	for _, tc := range []struct {
+		handler    http.Handler
+		path       string
+		auth       string
+		wantStatus int
+	}{
+		{handler: server, path: "/admin/clock", auth: "Bearer " + testAdminToken, wantStatus: http.StatusNotFound},
+		{handler: admin, path: "/vms", auth: "Bearer " + testAdminToken, wantStatus: http.StatusNotFound},
+		{handler: admin, path: "/admin/clock", auth: "Bearer " + testAdminToken, wantStatus: http.StatusOK},
+		{handler: admin, path: "/admin/clock", auth: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{handler: admin, path: "/admin/clock", auth: testAdminToken, wantStatus: http.StatusUnauthorized},
+		{handler: admin, path: "/debug/pprof/cmdline", auth: "Bearer " + testAdminToken, wantStatus: http.StatusOK},
+		{handler: admin, path: "/debug/pprof/cmdline", wantStatus: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		tc.handler.ServeHTTP(w, r)
+		if w.Code != tc.wantStatus {
+			t.Errorf("GET %s with %q: got status: %d, want: %d", tc.path, tc.auth, w.Code, tc.wantStatus)
+		}
+	}
+}
+
+func TestRootHandler(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "api")
+	})
+	ui := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "ui "+r.URL.Path)
+	})
+	paths := map[string]string{"/ui/vms.html": "ui vms.html", "/": "", "/admin/clock": "", "/metrics": "", "/debug/pprof/": ""}
+	for _, endpoint := range APISpec {
+		path := strings.NewReplacer("{vm_id}", "0", "{op_id}", "1").Replace(endpoint.DisplayPath)
+		paths[path] = "api"
+	}
+	handler := rootHandler(ui, api)
+	for path, want := range paths {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("X-Served-By"); got != want {
+			t.Errorf("GET %s: got served by %q, want: %q", path, got, want)
+		}
+	}
+}
+
+func TestAPICasesCoverAPISpec(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, tc := range apiCases {
+		covered[tc.method+" "+tc.endpoint] = true
+	}
+	for _, spec := range [][]EndpointSpec{APISpec, AdminSpec} {
+		for _, endpoint := range spec {
+			for _, m := range endpoint.Methods {
+				if key := m.Method + " " + endpoint.DisplayPath; !covered[key] {
+					t.Errorf("missing API test case for %s", key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TelemetryInterval is the time between two telemetry samples of a VM
+	TelemetryInterval = 5 * time.Second
+
+	// TelemetryHistory is how many samples are kept per VM, 1 hour worth
+	TelemetryHistory = 720
+)
+
+// TelemetrySample is what the guest of a VM looked like at some point.
+// All values are 0 unless the VM is Running.
+type TelemetrySample struct {
+	Time    time.Time `json:"time"`
+	CPU     float64   `json:"cpu"`     // Processor use in %, up to 100 per VCPU
+	Memory  float64   `json:"memory"`  // Memory in use in MiB, up to the RAM
+	Disk    float64   `json:"disk"`    // Disk IO in MiB/s, up to 1 MiB/s per GiB of storage
+	Network float64   `json:"network"` // Network throughput in Mbps, up to the network speed
+}
+
+// String on a TelemetrySample dumps it in JSON format
+func (sample TelemetrySample) String() string {
+	sampleJSON, err := json.Marshal(sample)
+	dieOnError(err, "Can't generate JSON for TelemetrySample object %#v", sample)
+	return string(sampleJSON)
+}
+
+// id of the sample on event streams, its time in milliseconds since the epoch
+func (sample TelemetrySample) id() int64 {
+	return sample.Time.UnixNano() / int64(time.Millisecond)
+}
+
+// writeSSE writes the sample in text/event-stream format
+func (sample TelemetrySample) writeSSE(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: sample\ndata: %s\n\n", sample.id(), sample)
+	return err
+}
+
+// TelemetrySamples defines a list of TelemetrySamples with attached methods
+type TelemetrySamples []TelemetrySample
+
+// String on TelemetrySamples dumps the list in JSON format
+func (samples TelemetrySamples) String() string {
+	samplesJSON, err := json.Marshal(samples)
+	dieOnError(err, "Can't generate JSON for TelemetrySample objects %#v", samples)
+	return string(samplesJSON)
+}
+
+// downsample averages the samples over periods of step, each stamped with
+// the start of its period. Samples must be sorted by time.
+func (samples TelemetrySamples) downsample(step time.Duration) TelemetrySamples {
+	var result TelemetrySamples
+	count := 0.0
+	for _, sample := range samples {
+		start := sample.Time.Truncate(step)
+		if len(result) == 0 || !result[len(result)-1].Time.Equal(start) {
+			result.average(count)
+			result = append(result, TelemetrySample{Time: start})
+			count = 0
+		}
+		last := &result[len(result)-1]
+		last.CPU += sample.CPU
+		last.Memory += sample.Memory
+		last.Disk += sample.Disk
+		last.Network += sample.Network
+		count++
+	}
+	result.average(count)
+	return result
+}
+
+// average divides the sums of the last sample by count
+func (samples TelemetrySamples) average(count float64) {
+	if len(samples) == 0 || count == 0 {
+		return
+	}
+	last := &samples[len(samples)-1]
+	last.CPU = round2(last.CPU / count)
+	last.Memory = round2(last.Memory / count)
+	last.Disk = round2(last.Disk / count)
+	last.Network = round2(last.Network / count)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// telemetryLoad is the share of each resource a guest uses, within [0, 1]
+type telemetryLoad struct {
+	cpu, memory, disk, network float64
+}
+
+// bootLoad is the load of guests right after they start
+var bootLoad = telemetryLoad{cpu: 0.6, memory: 0.25, disk: 0.4, network: 0.05}
+
+// steadyLoad is the load guests drift towards over time
+var steadyLoad = telemetryLoad{cpu: 0.3, memory: 0.6, disk: 0.1, network: 0.2}
+
+// next returns the load one interval later: a random walk pulled back
+// towards the steady load, so that values look alive yet stay believable
+func (load telemetryLoad) next(r *rand.Rand) telemetryLoad {
+	walk := func(v, target, volatility float64) float64 {
+		v += (target-v)*0.2 + (r.Float64()*2-1)*volatility
+		return math.Max(0.01, math.Min(1, v))
+	}
+	return telemetryLoad{
+		cpu:     walk(load.cpu, steadyLoad.cpu, 0.15),
+		memory:  walk(load.memory, steadyLoad.memory, 0.03),
+		disk:    walk(load.disk, steadyLoad.disk, 0.1),
+		network: walk(load.network, steadyLoad.network, 0.1),
+	}
+}
+
+// vmTelemetry generates the telemetry of a single VM, keeping its recent
+// samples in a ring buffer
+type vmTelemetry struct {
+	vm      VM // specs and state since the last sample
+	load    telemetryLoad
+	rand    *rand.Rand
+	last    time.Time         // time of the last sample
+	samples []TelemetrySample // ring buffer of up to TelemetryHistory samples
+	next    int               // index of the oldest sample once the buffer is full
+}
+
+func newVMTelemetry(vm VM, now time.Time) *vmTelemetry {
+	return &vmTelemetry{
+		vm:      vm,
+		load:    bootLoad,
+		rand:    rand.New(rand.NewSource(rand.Int63())),
+		last:    now.Truncate(TelemetryInterval),
+		samples: make([]TelemetrySample, 0, TelemetryHistory),
+	}
+}
+
+// catchUp generates the samples due up to now, using the VM as it was
+// since the last sample. Samples older than the ring buffer can hold are
+// never generated.
+func (t *vmTelemetry) catchUp(now time.Time) {
+	if oldest := now.Truncate(TelemetryInterval).Add(-TelemetryHistory * TelemetryInterval); t.last.Before(oldest) {
+		t.last = oldest
+	}
+	for due := t.last.Add(TelemetryInterval); !due.After(now); due = due.Add(TelemetryInterval) {
+		t.push(t.sample(due))
+		t.last = due
+	}
+}
+
+// sample returns the next sample of the VM, scaled to its specs
+func (t *vmTelemetry) sample(at time.Time) TelemetrySample {
+	if t.vm.State != RUNNING {
+		t.load = bootLoad
+		return TelemetrySample{Time: at}
+	}
+	t.load = t.load.next(t.rand)
+	return TelemetrySample{
+		Time:    at,
+		CPU:     round2(t.load.cpu * 100 * float64(t.vm.VCPUS)),
+		Memory:  round2(t.load.memory * float64(t.vm.RAM)),
+		Disk:    round2(t.load.disk * float64(t.vm.Storage)),
+		Network: round2(t.load.network * float64(t.vm.Network)),
+	}
+}
+
+func (t *vmTelemetry) push(sample TelemetrySample) {
+	if len(t.samples) < cap(t.samples) {
+		t.samples = append(t.samples, sample)
+		return
+	}
+	t.samples[t.next] = sample
+	t.next = (t.next + 1) % len(t.samples)
+}
+
+// between returns the samples within [from, to], oldest first
+func (t *vmTelemetry) between(from, to time.Time) TelemetrySamples {
+	var samples TelemetrySamples
+	for i := range t.samples {
+		sample := t.samples[(t.next+i)%len(t.samples)]
+		if !sample.Time.Before(from) && !sample.Time.After(to) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// telemetryGenerator generates the telemetry of all VMs, lazily: samples
+// are only generated when asked for, or when VMs change.
+// The zero value is ready to use.
+type telemetryGenerator struct {
+	lock sync.Mutex
+	vms  map[int]*vmTelemetry
+}
+
+// reset forgets all samples, generating them for the given VMs from now on
+func (g *telemetryGenerator) reset(vms VMs, now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.vms = make(map[int]*vmTelemetry, len(vms))
+	for _, id := range vms.ids() { // in order, so that each VM gets the same seed on every run
+		g.vms[id] = newVMTelemetry(vms[id], now)
+	}
+}
+
+// update generates the samples due up to now for the VM as it was, then
+// keeps on with the VM as it is, or forgets it if it is gone (nil)
+func (g *telemetryGenerator) update(id int, vm *VM, now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.vms == nil {
+		g.vms = make(map[int]*vmTelemetry)
+	}
+	t, found := g.vms[id]
+	switch {
+	case vm == nil:
+		delete(g.vms, id)
+	case !found:
+		g.vms[id] = newVMTelemetry(*vm, now)
+	default:
+		t.catchUp(now)
+		t.vm = *vm
+	}
+}
+
+// between returns the samples of the VM within [from, to] generated up to
+// now, oldest first, and whether the VM is known
+func (g *telemetryGenerator) between(id int, from, to, now time.Time) (TelemetrySamples, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	t, found := g.vms[id]
+	if !found {
+		return nil, false
+	}
+	t.catchUp(now)
+	return t.between(from, to), true
+}
+
+// vmTelemetry replies with the telemetry samples of a VM within ?from= and
+// ?to=, averaged over ?step=, or streams them as server sent events when
+// asked for text/event-stream
+func (s *VMServer) vmTelemetry(id int, w http.ResponseWriter, r *http.Request) {
+	now := s.vmm.Now()
+	from, err := timeParam(r, "from", now.Add(-TelemetryHistory*TelemetryInterval))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	to, err := timeParam(r, "to", now)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	step := TelemetryInterval
+	if stepParam := r.URL.Query().Get("step"); stepParam != "" {
+		if step, err = time.ParseDuration(stepParam); err != nil || step < TelemetryInterval {
+			writeError(w, r, newError(BadRequest, "bad step %q, want a duration of %v at least", stepParam, TelemetryInterval))
+			return
+		}
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.streamTelemetry(id, step, w, r)
+		return
+	}
+	samples, err := s.vmm.Telemetry(id, from, to)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if samples = samples.downsample(step); samples == nil {
+		samples = TelemetrySamples{}
+	}
+	fmt.Fprint(w, samples)
+}
+
+// timeParam returns the time of the named query parameter, or the given
+// default if unset
+func timeParam(r *http.Request, name string, defaultTime time.Time) (time.Time, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return defaultTime, nil
+	}
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, newError(BadRequest, "bad %s %q, want a RFC 3339 time such as 2020-11-10T09:40:00Z", name, param)
+	}
+	return t, nil
+}
+
+// streamTelemetry writes the samples of a VM as a text/event-stream as they
+// get generated, averaged over step once all the samples of a period are.
+// Clients resume from the sample after the one given by the Last-Event-ID
+// header, or get the samples after ?from= first, if set.
+func (s *VMServer) streamTelemetry(id int, step time.Duration, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, newError(Internal, "streaming unsupported"))
+		return
+	}
+	since, err := timeParam(r, "from", s.vmm.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		ms, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			writeError(w, r, newError(BadRequest, "bad Last-Event-ID: %v", err))
+			return
+		}
+		since = time.Unix(0, ms*int64(time.Millisecond)).Add(time.Nanosecond)
+	}
+	// Start on a period boundary, so that no period is averaged partially
+	if start := since.Truncate(step); start.Before(since) {
+		since = start.Add(step)
+	}
+	send := func() bool {
+		now := s.vmm.Now()
+		samples, err := s.vmm.Telemetry(id, since, now)
+		if err != nil {
+			return false // the VM is gone
+		}
+		// Periods ending after the next sample is due are not over yet
+		next := now.Truncate(TelemetryInterval).Add(TelemetryInterval)
+		samples = samples.downsample(step)
+		for len(samples) > 0 && samples[len(samples)-1].Time.Add(step).After(next) {
+			samples = samples[:len(samples)-1]
+		}
+		for _, sample := range samples {
+			if err := sample.writeSSE(w); err != nil {
+				return false
+			}
+			since = sample.Time.Add(step)
+		}
+		flusher.Flush()
+		return true
+	}
+	if _, found := s.vmm.Inspect(id); !found {
+		writeError(w, r, newError(NotFound, "not found VM with id %d", id))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if !send() {
+		return
+	}
+
+	poll := time.NewTicker(streamPoll)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+			if !send() {
+				return
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelemetry(t *testing.T) {
+	c := NewDefaultCloud()
+	c.UseClock(newTestClock())
+	all := func() TelemetrySamples {
+		samples, err := c.Telemetry(GoodID, testStart, testStart.Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return samples
+	}
+	c.AdvanceClock(time.Minute)
+	if samples := all(); len(samples) != 12 || samples[0].Time != testStart.Add(TelemetryInterval) || samples[11] != (TelemetrySample{Time: testStart.Add(time.Minute)}) {
+		t.Fatalf("got: %v, want 12 zero samples of a stopped VM", samples)
+	}
+
+	launch, _ := c.LaunchOperation(GoodID)
+	c.AdvanceClock(time.Minute)
+	stop, _ := c.StopOperation(GoodID)
+	c.AdvanceClock(time.Minute)
+	launch, _ = c.Operation(launch.ID)
+	stop, _ = c.Operation(stop.ID)
+	vm, _ := c.Inspect(GoodID)
+	running := 0
+	for _, sample := range all() {
+		isRunning := sample.Time.After(*launch.Finished) && !sample.Time.After(stop.Created)
+		if !isRunning {
+			if sample != (TelemetrySample{Time: sample.Time}) {
+				t.Fatalf("got: %v, want a zero sample while not running", sample)
+			}
+			continue
+		}
+		running++
+		if sample.CPU <= 0 || sample.CPU > 100*float64(vm.VCPUS) ||
+			sample.Memory <= 0 || sample.Memory > float64(vm.RAM) ||
+			sample.Disk <= 0 || sample.Disk > float64(vm.Storage) ||
+			sample.Network <= 0 || sample.Network > float64(vm.Network) {
+			t.Fatalf("got: %v, want a sample within the specs of %v", sample, vm)
+		}
+	}
+	if running == 0 {
+		t.Fatalf("got no samples while running, launched at %v and stopped at %v", launch.Finished, stop.Created)
+	}
+
+	c.AdvanceClock(2 * time.Hour)
+	if samples := all(); len(samples) != TelemetryHistory {
+		t.Fatalf("got %d samples, want the last %d only", len(samples), TelemetryHistory)
+	}
+	if err := c.Delete(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Telemetry(GoodID, testStart, testStart.Add(24*time.Hour)); errorCode(err) != NotFound {
+		t.Fatalf("got: %v, want a %v error for a deleted VM", err, NotFound)
+	}
+}
+
+func TestTelemetryDownsample(t *testing.T) {
+	var samples TelemetrySamples
+	for i := 0; i < 8; i++ {
+		v := float64(i)
+		samples = append(samples, TelemetrySample{Time: testStart.Add(time.Duration(i) * 10 * time.Second), CPU: v, Memory: 2 * v, Disk: 3 * v, Network: 4 * v})
+	}
+	want := TelemetrySamples{
+		{Time: testStart, CPU: 1, Memory: 2, Disk: 3, Network: 4},
+		{Time: testStart.Add(30 * time.Second), CPU: 4, Memory: 8, Disk: 12, Network: 16},
+		{Time: testStart.Add(time.Minute), CPU: 6.5, Memory: 13, Disk: 19.5, Network: 26},
+	}
+	if got := samples.downsample(30 * time.Second); got.String() != want.String() {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestTelemetryStream(t *testing.T) {
+	server := NewVMServer(defaultVMs.clone())
+	server.vmm.UseClock(newTestClock())
+	server.vmm.AdvanceClock(time.Minute)
+	for _, tc := range []struct {
+		step        string
+		lastEventID string
+		want        int
+	}{
+		{want: 12},
+		{lastEventID: fmt.Sprint(testStart.Add(50*time.Second).UnixNano() / int64(time.Millisecond)), want: 2},
+		// the period starting at 09:01:00 is not over yet
+		{step: "30s", want: 2},
+		{step: "30s", lastEventID: fmt.Sprint(testStart.UnixNano() / int64(time.Millisecond)), want: 1},
+		{step: "20s", lastEventID: fmt.Sprint(testStart.Add(10*time.Second).UnixNano() / int64(time.Millisecond)), want: 2},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/vms/1/metrics?step="+tc.step+"&from="+testStart.Format(time.RFC3339), nil)
+		r.Header.Set("Accept", "text/event-stream")
+		if tc.lastEventID != "" {
+			r.Header.Set("Last-Event-ID", tc.lastEventID)
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		cancel()
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r.WithContext(ctx))
+		if got := strings.Count(w.Body.String(), "event: sample\n"); got != tc.want {
+			t.Fatalf("step %q, Last-Event-ID %q: got %d samples, want: %d (body: %s)", tc.step, tc.lastEventID, got, tc.want, w.Body)
+		}
+	}
+}
@@ -4,16 +4,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"time"
 )
 
 // VMState represents the current state of a VM
 type VMState string
 
+// States of the DefaultLifecycle
 const (
 	// STOPPED VM is stopped at this state it can be removed
 	STOPPED VMState = "Stopped"
@@ -24,31 +27,52 @@ const (
 	// RUNNING VM is online
 	RUNNING VMState = "Running"
 
-	// STOPPING VM is transitioning from Running to Stopped
+	// STOPPING VM is transitioning from Running, Suspended or Error to Stopped
 	STOPPING VMState = "Stopping"
+
+	// PROVISIONING VM was just created and is transitioning to Stopped
+	PROVISIONING VMState = "Provisioning"
+
+	// SUSPENDING VM is transitioning from Running to Suspended
+	SUSPENDING VMState = "Suspending"
+
+	// SUSPENDED VM is paused with its memory saved, it can be resumed
+	SUSPENDED VMState = "Suspended"
+
+	// RESUMING VM is transitioning from Suspended to Running
+	RESUMING VMState = "Resuming"
+
+	// REBOOTING VM is transitioning from Running back to Running
+	REBOOTING VMState = "Rebooting"
+
+	// ERROR VM failed a transition, it can only be stopped
+	ERROR VMState = "Error"
 )
 
+// Average delays of the DefaultLifecycle transitions
 const (
 	// DefaultStartDelay Start VM process simulated delay, measured in timeUnits
 	DefaultStartDelay = 10
 
 	// DefaultStopDelay Stop VM process simulated delay, measured in timeUnits
 	DefaultStopDelay = 5
+
+	// DefaultProvisionDelay Create VM process simulated delay, measured in timeUnits
+	DefaultProvisionDelay = 3
+
+	// DefaultSuspendDelay Suspend VM process simulated delay, measured in timeUnits
+	DefaultSuspendDelay = 3
+
+	// DefaultResumeDelay Resume VM process simulated delay, measured in timeUnits
+	DefaultResumeDelay = 3
+
+	// DefaultRebootDelay Reboot VM process simulated delay, measured in timeUnits
+	DefaultRebootDelay = 8
 )
 
 // timeUnit allows unit tests to change the timescale
 var timeUnit = time.Second
 
-// StartDelay for launch operations
-func StartDelay() time.Duration {
-	return randomDuration(timeUnit, 2*(DefaultStartDelay*timeUnit)-timeUnit)
-}
-
-// StopDelay for stop operations
-func StopDelay() time.Duration {
-	return randomDuration(timeUnit, 2*(DefaultStopDelay*timeUnit)-timeUnit)
-}
-
 func randomDuration(min, max time.Duration) time.Duration {
 	return time.Duration(rand.Intn(int(max-min+1))) + min
 }
@@ -66,10 +90,15 @@ func dieOnError(err error, format string, args ...interface{}) {
 type VM struct {
 	VCPUS   int     `json:"vcpus,omitempty"`   // Number of processors
 	Clock   float32 `json:"clock,omitempty"`   // Frequency of 1 processor, in MHz (Megahertz)
-	RAM     int     `json:"ram,omitempty"`     // Amount of internal memory, in MB (Megabytes)
-	Storage int     `json:"storage,omitempty"` // Amount of persistent storage, in GB (Gigabytes)
-	Network int     `json:"network,omitempty"` // Network device speed in Gb/s (Gigabits per second)
-	State   VMState `json:"state,omitempty"`   // Value within [Running, Stopped, Starting, Stopping]
+	RAM     int     `json:"ram,omitempty"`     // Amount of internal memory, in MiB (Mebibytes)
+	Storage int     `json:"storage,omitempty"` // Amount of persistent storage, in GiB (Gibibytes)
+	Network int     `json:"network,omitempty"` // Network device speed, in Mbps (Megabits per second)
+	State   VMState `json:"state,omitempty"`   // Value within the lifecycle states
+
+	StartDelay *DelayRange `json:"startDelay,omitempty"` // Delay of launches, in seconds, instead of the lifecycle one
+	StopDelay  *DelayRange `json:"stopDelay,omitempty"`  // Delay of stops, in seconds, instead of the lifecycle one
+
+	Due *time.Time `json:"due,omitempty"` // When the transition in progress is expected to finish, if any
 }
 
 // VM by default dumps itself in JSON format
@@ -79,12 +108,171 @@ func (vm VM) String() string {
 	return string(vmJSON)
 }
 
-// AllowedTransition lists allowed state transitions
-var AllowedTransition = map[VMState]VMState{
-	STOPPED:  STARTING,
-	STARTING: RUNNING,
-	RUNNING:  STOPPING,
-	STOPPING: STOPPED,
+// vmSpec is a named hardware spec value of a VM
+type vmSpec struct {
+	name  string
+	value float32
+}
+
+// specs returns the hardware spec values of the VM
+func (vm VM) specs() []vmSpec {
+	return []vmSpec{
+		{"vcpus", float32(vm.VCPUS)},
+		{"clock", vm.Clock},
+		{"ram", float32(vm.RAM)},
+		{"storage", float32(vm.Storage)},
+		{"network", float32(vm.Network)},
+	}
+}
+
+// Validate checks the VM specs are usable for a new VM
+func (vm VM) Validate() error {
+	if err := vm.validateSpecs(); err != nil {
+		return err
+	}
+	if err := vm.validateDelays(); err != nil {
+		return err
+	}
+	if initial := currentRules().actions[PROVISION].Via; vm.State != "" && vm.State != initial {
+		return newError(ValidationFailed, "invalid VM: new VMs can only be created in state %v", initial)
+	}
+	if vm.Due != nil {
+		return newError(ValidationFailed, "invalid VM: due is only set by transitions")
+	}
+	return nil
+}
+
+func (vm VM) validateSpecs() error {
+	for _, spec := range vm.specs() {
+		if spec.value <= 0 {
+			return newError(ValidationFailed, "invalid VM: %s must be a positive number", spec.name)
+		}
+	}
+	return nil
+}
+
+func (vm VM) validateDelays() error {
+	if vm.StartDelay != nil && !vm.StartDelay.valid() {
+		return newError(ValidationFailed, "invalid VM: bad startDelay range [%v, %v]", vm.StartDelay.Min, vm.StartDelay.Max)
+	}
+	if vm.StopDelay != nil && !vm.StopDelay.valid() {
+		return newError(ValidationFailed, "invalid VM: bad stopDelay range [%v, %v]", vm.StopDelay.Min, vm.StopDelay.Max)
+	}
+	return nil
+}
+
+// delayFor returns the delay overriding the lifecycle one for the
+// action of the given kind on the VM, if any
+func (vm VM) delayFor(kind OperationKind) *DelayRange {
+	switch kind {
+	case LAUNCH:
+		return vm.StartDelay
+	case STOP:
+		return vm.StopDelay
+	}
+	return nil
+}
+
+// Limits bounds the hardware specs VMs can have
+type Limits struct {
+	VCPUS   int     `json:"vcpus"`   // Max number of processors
+	Clock   float32 `json:"clock"`   // Max frequency of 1 processor, in MHz
+	RAM     int     `json:"ram"`     // Max amount of internal memory, in MiB
+	Storage int     `json:"storage"` // Max amount of persistent storage, in GiB
+	Network int     `json:"network"` // Max network device speed, in Mbps
+}
+
+// DefaultLimits for VM hardware specs, with room to grow any default VM
+var DefaultLimits = Limits{
+	VCPUS:   64,
+	Clock:   5000,
+	RAM:     262144,
+	Storage: 65536,
+	Network: 100000,
+}
+
+// Check returns an error if the VM specs go over the limits
+func (l Limits) Check(vm VM) error {
+	max := VM{VCPUS: l.VCPUS, Clock: l.Clock, RAM: l.RAM, Storage: l.Storage, Network: l.Network}.specs()
+	for i, spec := range vm.specs() {
+		if spec.value > max[i].value {
+			return newError(ValidationFailed, "invalid VM: %s must be at most %v", spec.name, max[i].value)
+		}
+	}
+	return nil
+}
+
+// VMPatch is a JSON merge patch (RFC 7396) of the VM hardware specs.
+// Fields left unset are not changed.
+type VMPatch struct {
+	VCPUS   *int     `json:"vcpus,omitempty"`
+	Clock   *float32 `json:"clock,omitempty"`
+	RAM     *int     `json:"ram,omitempty"`
+	Storage *int     `json:"storage,omitempty"`
+	Network *int     `json:"network,omitempty"`
+}
+
+// ParseVMPatch decodes a JSON merge patch of the VM hardware specs.
+// As all specs are required, null values removing them are rejected,
+// and so is the state, which only changes launching or stopping the VM.
+func ParseVMPatch(data []byte) (VMPatch, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return VMPatch{}, newError(BadRequest, "invalid VM patch JSON: %v", err)
+	}
+	for name, value := range fields {
+		if name == "state" {
+			return VMPatch{}, newError(ValidationFailed, "invalid VM patch: state can't be patched, launch or stop the VM instead")
+		}
+		if string(value) == "null" {
+			return VMPatch{}, newError(ValidationFailed, "invalid VM patch: %s can't be removed", name)
+		}
+	}
+	var patch VMPatch
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		return VMPatch{}, newError(BadRequest, "invalid VM patch JSON: %v", err)
+	}
+	return patch, nil
+}
+
+// WithPatch returns the VM with the patch applied or an error,
+// if the resize breaks any rule:
+// - vcpus, clock and ram can only change while the VM is Stopped.
+// - storage can only grow.
+// - all specs must stay positive and within limits.
+func (vm VM) WithPatch(patch VMPatch, limits Limits) (VM, error) {
+	patched := vm
+	if patch.VCPUS != nil {
+		patched.VCPUS = *patch.VCPUS
+	}
+	if patch.Clock != nil {
+		patched.Clock = *patch.Clock
+	}
+	if patch.RAM != nil {
+		patched.RAM = *patch.RAM
+	}
+	if patch.Storage != nil {
+		patched.Storage = *patch.Storage
+	}
+	if patch.Network != nil {
+		patched.Network = *patch.Network
+	}
+	cpuOrRAMChanged := patched.VCPUS != vm.VCPUS || patched.Clock != vm.Clock || patched.RAM != vm.RAM
+	if cpuOrRAMChanged && vm.State != STOPPED {
+		return VM{}, newError(Conflict, "resize error: vcpus, clock and ram can only change in state %v but it is %v", STOPPED, vm.State)
+	}
+	if patched.Storage < vm.Storage {
+		return VM{}, newError(ValidationFailed, "resize error: storage can only grow from %d", vm.Storage)
+	}
+	if err := patched.validateSpecs(); err != nil {
+		return VM{}, err
+	}
+	if err := limits.Check(patched); err != nil {
+		return VM{}, err
+	}
+	return patched, nil
 }
 
 // WithState returns a VM on the requested end state or an error,
@@ -93,8 +281,8 @@ func (vm VM) WithState(state VMState) (VM, error) {
 	if state == vm.State {
 		return vm, nil // NOP
 	}
-	if AllowedTransition[vm.State] != state {
-		return VM{}, fmt.Errorf("illegal transition from %q to %q", vm.State, state)
+	if !canTransition(vm.State, state) {
+		return VM{}, newError(IllegalTransition, "illegal transition from %q to %q", vm.State, state)
 	}
 	vm.State = state
 	return vm, nil
@@ -112,6 +300,16 @@ func (vms VMs) clone() VMs {
 	return cloneList
 }
 
+// ids returns the ids of the VMs, sorted
+func (vms VMs) ids() []int {
+	ids := make([]int, 0, len(vms))
+	for id := range vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
 // String in VMs by default dumps itself in JSON format skipping empty entries
 func (vms VMs) String() string {
 	vmJSON, err := json.Marshal(vms)
@@ -119,13 +317,71 @@ func (vms VMs) String() string {
 	return string(vmJSON)
 }
 
+// Fixture is the contents of VMsJSON: the VMs, along with the delays
+// overriding the lifecycle ones for all of them by action kind, and the
+// next id to hand out on creation.
+// Fixtures with neither delays nor next id are just the VMs map, as in older
+// versions.
+type Fixture struct {
+	Delays map[OperationKind]DelayRange `json:"delays,omitempty"`
+	NextID int                          `json:"nextId,omitempty"` // so that ids of deleted VMs are never reused
+	VMs    VMs                          `json:"vms"`
+}
+
+// fixtureFields is a Fixture without its JSON methods
+type fixtureFields Fixture
+
+// MarshalJSON dumps the fixture, as just the VMs map if it has no delays
+// and no next id
+func (f Fixture) MarshalJSON() ([]byte, error) {
+	if len(f.Delays) == 0 && f.NextID == 0 {
+		return json.Marshal(f.VMs)
+	}
+	return json.Marshal(fixtureFields(f))
+}
+
+// UnmarshalJSON reads either a fixture object with its "vms", "delays" and
+// "nextId", or just a VMs map
+func (f *Fixture) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if _, found := fields["vms"]; !found {
+		f.Delays, f.NextID = nil, 0
+		return json.Unmarshal(data, &f.VMs)
+	}
+	var fixture fixtureFields
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fixture); err != nil {
+		return err
+	}
+	*f = Fixture(fixture)
+	return nil
+}
+
+// Validate checks the VMs are in states the lifecycle in use knows about,
+// and their delays are valid
+func (f Fixture) Validate() error {
+	if err := checkStates(f.VMs); err != nil {
+		return err
+	}
+	for id, vm := range f.VMs {
+		if err := vm.validateDelays(); err != nil {
+			return fmt.Errorf("VM %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
 var defaultVMs = VMs{
 	0: {
 		VCPUS:   1,       // Number of processors
 		Clock:   1500,    // Frequency of 1 processor, expressed in MHz (Megahertz)
-		RAM:     4096,    // Amount of internal memory, expressed in MB (Megabytes)
-		Storage: 128,     // Amount of internal space available for storage, expressed in GB (Gigabytes)
-		Network: 1000,    // Speed of the networking device, expressed in Gb/s (Gigabits per second)
+		RAM:     4096,    // Amount of internal memory, expressed in MiB (Mebibytes)
+		Storage: 128,     // Amount of internal space available for storage, expressed in GiB (Gibibytes)
+		Network: 1000,    // Speed of the networking device, expressed in Mbps (Megabits per second)
 		State:   STOPPED, // Value from within the set [Running, Stopped, Starting, Stopping]
 	},
 	1: {
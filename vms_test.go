@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -27,10 +28,27 @@ var withStateHappyCases = []struct {
 	{vm: VMInState(STARTING), state: RUNNING, want: VMInState(RUNNING)},
 	{vm: VMInState(RUNNING), state: STOPPING, want: VMInState(STOPPING)},
 	{vm: VMInState(STOPPING), state: STOPPED, want: VMInState(STOPPED)},
+	{vm: VMInState(PROVISIONING), state: STOPPED, want: VMInState(STOPPED)},
+	{vm: VMInState(RUNNING), state: SUSPENDING, want: VMInState(SUSPENDING)},
+	{vm: VMInState(SUSPENDING), state: SUSPENDED, want: VMInState(SUSPENDED)},
+	{vm: VMInState(SUSPENDED), state: RESUMING, want: VMInState(RESUMING)},
+	{vm: VMInState(RESUMING), state: RUNNING, want: VMInState(RUNNING)},
+	{vm: VMInState(SUSPENDED), state: STOPPING, want: VMInState(STOPPING)},
+	{vm: VMInState(RUNNING), state: REBOOTING, want: VMInState(REBOOTING)},
+	{vm: VMInState(REBOOTING), state: RUNNING, want: VMInState(RUNNING)},
+	{vm: VMInState(PROVISIONING), state: ERROR, want: VMInState(ERROR)},
+	{vm: VMInState(STARTING), state: ERROR, want: VMInState(ERROR)},
+	{vm: VMInState(STOPPING), state: ERROR, want: VMInState(ERROR)},
+	{vm: VMInState(SUSPENDING), state: ERROR, want: VMInState(ERROR)},
+	{vm: VMInState(RESUMING), state: ERROR, want: VMInState(ERROR)},
+	{vm: VMInState(REBOOTING), state: ERROR, want: VMInState(ERROR)},
+	{vm: VMInState(ERROR), state: STOPPING, want: VMInState(STOPPING)},
 	{vm: VMInState(STOPPED), state: STOPPED, want: VMInState(STOPPED)},
 	{vm: VMInState(STARTING), state: STARTING, want: VMInState(STARTING)},
 	{vm: VMInState(RUNNING), state: RUNNING, want: VMInState(RUNNING)},
 	{vm: VMInState(STOPPING), state: STOPPING, want: VMInState(STOPPING)},
+	{vm: VMInState(SUSPENDED), state: SUSPENDED, want: VMInState(SUSPENDED)},
+	{vm: VMInState(ERROR), state: ERROR, want: VMInState(ERROR)},
 }
 
 func TestWithStateHappyCases(t *testing.T) {
@@ -62,6 +80,24 @@ var withStateErrors = []struct {
 		want: `illegal transition from "Starting" to "Stopped"`},
 	{vm: VMInState(STARTING), state: STOPPING,
 		want: `illegal transition from "Starting" to "Stopping"`},
+	{vm: VMInState(STOPPED), state: PROVISIONING,
+		want: `illegal transition from "Stopped" to "Provisioning"`},
+	{vm: VMInState(PROVISIONING), state: STARTING,
+		want: `illegal transition from "Provisioning" to "Starting"`},
+	{vm: VMInState(STOPPED), state: SUSPENDING,
+		want: `illegal transition from "Stopped" to "Suspending"`},
+	{vm: VMInState(SUSPENDED), state: RUNNING,
+		want: `illegal transition from "Suspended" to "Running"`},
+	{vm: VMInState(SUSPENDED), state: REBOOTING,
+		want: `illegal transition from "Suspended" to "Rebooting"`},
+	{vm: VMInState(RUNNING), state: RESUMING,
+		want: `illegal transition from "Running" to "Resuming"`},
+	{vm: VMInState(RUNNING), state: ERROR,
+		want: `illegal transition from "Running" to "Error"`},
+	{vm: VMInState(ERROR), state: STARTING,
+		want: `illegal transition from "Error" to "Starting"`},
+	{vm: VMInState(ERROR), state: STOPPED,
+		want: `illegal transition from "Error" to "Stopped"`},
 }
 
 func TestWithStateErrors(t *testing.T) {
@@ -75,3 +111,155 @@ func TestWithStateErrors(t *testing.T) {
 		}
 	}
 }
+
+var validateErrors = []struct {
+	vm   VM
+	want string
+}{
+	{vm: VM{Clock: 1500, RAM: 4096, Storage: 128, Network: 1000},
+		want: "invalid VM: vcpus must be a positive number"},
+	{vm: VM{VCPUS: 1, Clock: -1, RAM: 4096, Storage: 128, Network: 1000},
+		want: "invalid VM: clock must be a positive number"},
+	{vm: VM{VCPUS: 1, Clock: 1500, RAM: 4096, Network: 1000},
+		want: "invalid VM: storage must be a positive number"},
+	{vm: VM{VCPUS: 1, Clock: 1500, RAM: 4096, Storage: 128},
+		want: "invalid VM: network must be a positive number"},
+	{vm: *VMInState(RUNNING),
+		want: `invalid VM: new VMs can only be created in state Provisioning`},
+	{vm: *VMInState(STOPPED),
+		want: `invalid VM: new VMs can only be created in state Provisioning`},
+	{vm: VM{VCPUS: 1, Clock: 1500, RAM: 4096, Storage: 128, Network: 1000, StartDelay: &DelayRange{Min: 2, Max: 1}},
+		want: `invalid VM: bad startDelay range [2, 1]`},
+}
+
+func TestValidateErrors(t *testing.T) {
+	for _, tc := range validateErrors {
+		if got := tc.vm.Validate(); got == nil || got.Error() != tc.want {
+			t.Fatalf("got: %v, want %q", got, tc.want)
+		}
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func float32Ptr(f float32) *float32 {
+	return &f
+}
+
+var withPatchHappyCases = []struct {
+	vm    *VM
+	patch VMPatch
+	want  VM
+}{
+	{vm: VMInState(STOPPED), patch: VMPatch{VCPUS: intPtr(4), Clock: float32Ptr(3000), RAM: intPtr(8192)},
+		want: VM{VCPUS: 4, Clock: 3000, RAM: 8192, Storage: 128, Network: 1000, State: STOPPED}},
+	{vm: VMInState(STOPPED), patch: VMPatch{Storage: intPtr(256), Network: intPtr(10000)},
+		want: VM{VCPUS: 1, Clock: 1500, RAM: 4096, Storage: 256, Network: 10000, State: STOPPED}},
+	{vm: VMInState(RUNNING), patch: VMPatch{Storage: intPtr(256), Network: intPtr(100)},
+		want: VM{VCPUS: 1, Clock: 1500, RAM: 4096, Storage: 256, Network: 100, State: RUNNING}},
+	{vm: VMInState(RUNNING), patch: VMPatch{VCPUS: intPtr(1), RAM: intPtr(4096)},
+		want: *VMInState(RUNNING)},
+	{vm: VMInState(STOPPED), patch: VMPatch{},
+		want: *VMInState(STOPPED)},
+}
+
+func TestWithPatchHappyCases(t *testing.T) {
+	for _, tc := range withPatchHappyCases {
+		got, err := tc.vm.WithPatch(tc.patch, DefaultLimits)
+		if err != nil {
+			t.Fatalf("Unexpected error in happy case %v: %v", tc, err)
+		}
+		if got != tc.want {
+			t.Fatalf("got: %v, want %v", got, tc.want)
+		}
+	}
+}
+
+var withPatchErrors = []struct {
+	vm    *VM
+	patch VMPatch
+	want  string
+}{
+	{vm: VMInState(RUNNING), patch: VMPatch{VCPUS: intPtr(2)},
+		want: "resize error: vcpus, clock and ram can only change in state Stopped but it is Running"},
+	{vm: VMInState(STARTING), patch: VMPatch{Clock: float32Ptr(2000)},
+		want: "resize error: vcpus, clock and ram can only change in state Stopped but it is Starting"},
+	{vm: VMInState(STOPPING), patch: VMPatch{RAM: intPtr(8192)},
+		want: "resize error: vcpus, clock and ram can only change in state Stopped but it is Stopping"},
+	{vm: VMInState(STOPPED), patch: VMPatch{Storage: intPtr(64)},
+		want: "resize error: storage can only grow from 128"},
+	{vm: VMInState(STOPPED), patch: VMPatch{VCPUS: intPtr(0)},
+		want: "invalid VM: vcpus must be a positive number"},
+	{vm: VMInState(STOPPED), patch: VMPatch{Network: intPtr(-1)},
+		want: "invalid VM: network must be a positive number"},
+	{vm: VMInState(STOPPED), patch: VMPatch{VCPUS: intPtr(DefaultLimits.VCPUS + 1)},
+		want: "invalid VM: vcpus must be at most 64"},
+	{vm: VMInState(STOPPED), patch: VMPatch{RAM: intPtr(DefaultLimits.RAM * 2)},
+		want: "invalid VM: ram must be at most 262144"},
+	{vm: VMInState(RUNNING), patch: VMPatch{Storage: intPtr(DefaultLimits.Storage + 1)},
+		want: "invalid VM: storage must be at most 65536"},
+}
+
+func TestWithPatchErrors(t *testing.T) {
+	for _, tc := range withPatchErrors {
+		vm, got := tc.vm.WithPatch(tc.patch, DefaultLimits)
+		if (vm != VM{}) {
+			t.Fatalf("Unexpected VM valid value in error case %v: %v", tc, vm)
+		}
+		if got == nil || got.Error() != tc.want {
+			t.Fatalf("got: %v, want %q", got, tc.want)
+		}
+	}
+}
+
+var parseVMPatchErrors = []struct {
+	patch string
+	want  ErrorCode
+}{
+	{patch: `{"ram":null}`, want: ValidationFailed},
+	{patch: `{"state":"Running"}`, want: ValidationFailed},
+	{patch: `{"cpus":1}`, want: BadRequest},
+	{patch: `{"ram":"lots"}`, want: BadRequest},
+	{patch: `[]`, want: BadRequest},
+}
+
+func TestParseVMPatchErrors(t *testing.T) {
+	for _, tc := range parseVMPatchErrors {
+		if _, got := ParseVMPatch([]byte(tc.patch)); errorCode(got) != tc.want {
+			t.Fatalf("%s: got: %v, want code %q", tc.patch, got, tc.want)
+		}
+	}
+}
+
+func TestFixtureJSON(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want Fixture
+	}{
+		{json: `{"0":{"vcpus":1,"clock":1500,"ram":4096,"storage":128,"network":1000,"state":"Stopped","startDelay":1}}`,
+			want: Fixture{VMs: VMs{0: {VCPUS: 1, Clock: 1500, RAM: 4096, Storage: 128, Network: 1000, State: STOPPED,
+				StartDelay: &DelayRange{Min: 1, Max: 1}}}}},
+		{json: `{"delays":{"stop":{"min":20,"max":40}},"vms":{"0":{"vcpus":1,"clock":1500,"ram":4096,"storage":128,"network":1000,"state":"Stopped"}}}`,
+			want: Fixture{Delays: map[OperationKind]DelayRange{STOP: {Min: 20, Max: 40}}, VMs: VMs{0: *VMInState(STOPPED)}}},
+	} {
+		var got Fixture
+		if err := json.Unmarshal([]byte(tc.json), &got); err != nil {
+			t.Fatal(err)
+		}
+		if gotJSON, err := json.Marshal(got); err != nil || string(gotJSON) != tc.json {
+			t.Fatalf("got: %s, %v, want: %s", gotJSON, err, tc.json)
+		}
+		wantJSON, _ := json.Marshal(tc.want)
+		if string(wantJSON) != tc.json {
+			t.Fatalf("got: %s, want: %s", wantJSON, tc.json)
+		}
+	}
+	var fixture Fixture
+	for _, bad := range []string{`{"vms":{},"delay":{}}`, `{"0":{"startDelay":{"min":1,"avg":2}}}`} {
+		if err := json.Unmarshal([]byte(bad), &fixture); err == nil {
+			t.Fatalf("%s: got no error", bad)
+		}
+	}
+}
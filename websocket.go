@@ -0,0 +1,225 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// websocketGUID is the magic value to compute Sec-WebSocket-Accept (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketMessage bounds the size of messages accepted from clients
+const maxWebSocketMessage = 1 << 20
+
+// WebSocket frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsConn is a minimal server side WebSocket connection (RFC 6455).
+// Reads must happen from a single goroutine, writes are concurrent-safe.
+type wsConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the WebSocket opening handshake and hijacks
+// the underlying connection.
+// On error a reply has already been sent to the client.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		err := newError(UpgradeRequired, "websocket upgrade required")
+		writeError(w, r, err)
+		return nil, err
+	}
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != "13" {
+		err := newError(UpgradeRequired, "unsupported websocket version %q", version)
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, err)
+		return nil, err
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := newError(Internal, "websocket unsupported")
+		writeError(w, r, err)
+		return nil, err
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		writeError(w, r, err)
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprint(rw, "Upgrade: websocket\r\n")
+	fmt.Fprint(rw, "Connection: Upgrade\r\n")
+	fmt.Fprintf(rw, "Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(hash[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader, writer: rw.Writer}, nil
+}
+
+// readFrame reads a single frame, unmasking its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		err = errors.New("websocket client frames must be masked")
+		return
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketMessage {
+		err = fmt.Errorf("websocket frame too big: %d bytes", length)
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next data message, reassembling fragments and
+// answering control frames on the way.
+// Returns io.EOF once the client closes the connection.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, errors.New("websocket message interleaved with fragments")
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, errors.New("websocket continuation without a message")
+			}
+		default:
+			return nil, fmt.Errorf("websocket unknown opcode %#x", opcode)
+		}
+		message = append(message, payload...)
+		if len(message) > maxWebSocketMessage {
+			return nil, fmt.Errorf("websocket message too big: %d bytes", len(message))
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// writeFrame writes a single unfragmented and unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	header := []byte{0x80 | opcode, 0}
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := c.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(payload); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// WriteJSON sends v as a JSON text message
+func (c *wsConn) WriteJSON(v interface{}) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, message)
+}
+
+// Close the underlying connection
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsTestClient is a bare bones WebSocket client for tests
+type wsTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server) *wsTestClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: test\r\n")
+	fmt.Fprint(conn, "Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n")
+	fmt.Fprint(conn, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sample accept value from RFC 6455 section 1.3
+	want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); resp.StatusCode != http.StatusSwitchingProtocols || got != want {
+		t.Fatalf("got: %v %q, want: %v %q", resp.StatusCode, got, http.StatusSwitchingProtocols, want)
+	}
+	return &wsTestClient{conn: conn, reader: reader}
+}
+
+func (c *wsTestClient) send(t *testing.T, opcode byte, fin bool, payload string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		frame[0] |= 0x80
+	}
+	frame = append(frame, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *wsTestClient) receive(t *testing.T) wsMessage {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1])
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.reader, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	var msg wsMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatalf("invalid message %q: %v", payload, err)
+	}
+	return msg
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	shrinkTime()
+	server := httptest.NewServer(NewVMServer(defaultVMs.clone()))
+	defer server.Close()
+	client := dialWebSocket(t, server)
+	defer client.conn.Close()
+
+	client.send(t, wsText, true, `{"id":"1","action":"subscribe"}`)
+	if got := client.receive(t); got.ID != "1" || got.Status != http.StatusOK {
+		t.Fatalf("got: %v, want: reply 1 with status 200", got)
+	}
+	// fragmented command
+	client.send(t, wsText, false, `{"id":"2","action":`)
+	client.send(t, wsContinuation, true, `"launch","vm":1}`)
+	if got := client.receive(t); got.ID != "2" || got.Status != http.StatusAccepted {
+		t.Fatalf("got: %v, want: reply 2 with status 202", got)
+	}
+	want := Event{Seq: 1, Type: TRANSITIONED, VMID: GoodID, OldState: STOPPED, NewState: STARTING}
+	if got := client.receive(t); got.Event == nil || got.Event.Seq != want.Seq || got.Event.NewState != want.NewState {
+		t.Fatalf("got: %v, want event: %v", got, want)
+	}
+	client.send(t, wsText, true, fmt.Sprintf(`{"id":"3","action":"launch","vm":%d}`, BadID))
+	for {
+		got := client.receive(t)
+		if got.Type == "event" {
+			continue // the launch transition completing
+		}
+		wantErr := fmt.Sprintf(expectedNotFoundMsgFmt, BadID)
+		if got.ID != "3" || got.Status != http.StatusNotFound || got.Error != wantErr {
+			t.Fatalf("got: %v, want: reply 3 with status 404 and error %q", got, wantErr)
+		}
+		break
+	}
+	// same error as POST /vms for a VM with an unknown field
+	client.send(t, wsText, true, `{"id":"4","action":"create","body":{"cpus":1}}`)
+	for {
+		got := client.receive(t)
+		if got.Type == "event" {
+			continue
+		}
+		if got.ID != "4" || got.Status != http.StatusBadRequest || got.Code != BadRequest {
+			t.Fatalf("got: %v, want: reply 4 with status 400 and code %v", got, BadRequest)
+		}
+		break
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// wsRequest is a command sent by a WebSocket API client
+type wsRequest struct {
+	ID     string          `json:"id"`              // Chosen by the client to correlate the reply
+	Action string          `json:"action"`          // Value within [list, inspect, create, resize, cancel, delete, subscribe, unsubscribe] or a lifecycle action such as launch
+	VM     *int            `json:"vm,omitempty"`    // VM id for inspect, resize, cancel, delete and the launch, stop, etc. actions
+	Body   json.RawMessage `json:"body,omitempty"`  // VM JSON for create, VM JSON merge patch for resize
+	Since  uint64          `json:"since,omitempty"` // Event sequence number to resume a subscription after
+}
+
+// wsMessage is sent to WebSocket API clients
+type wsMessage struct {
+	Type   string      `json:"type"`             // Value within [reply, event, unsubscribed]
+	ID     string      `json:"id,omitempty"`     // Id of the request a reply is for
+	Status int         `json:"status,omitempty"` // HTTP status code the REST API would reply with
+	Result interface{} `json:"result,omitempty"` // Same JSON the REST API would reply with
+	Error  string      `json:"error,omitempty"`  // Error message, for failed replies
+	Code   ErrorCode   `json:"code,omitempty"`   // Machine readable error type, for failed replies
+	Event  *Event      `json:"event,omitempty"`  // VM change, for events
+}
+
+// wsCreated is the result of a create command
+type wsCreated struct {
+	ID        int       `json:"id"`
+	Location  string    `json:"location"`
+	VM        VM        `json:"vm"`
+	Operation Operation `json:"operation"` // Provisioning the new VM
+}
+
+// wsSession holds the state of a single WebSocket API client connection
+type wsSession struct {
+	server *VMServer
+	conn   *wsConn
+	from   requester // the upgrade request, for the audit journal
+
+	lock         sync.Mutex
+	subscription *wsSubscription
+}
+
+// wsSubscription forwards Cloud events to the session
+type wsSubscription struct {
+	cancel    func()
+	cancelled bool
+}
+
+func (s *VMServer) webSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("websocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	session := &wsSession{server: s, conn: conn, from: requesterOf(r)}
+	defer session.unsubscribe()
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("websocket read error: %v", err)
+			}
+			return
+		}
+		var req wsRequest
+		if err := json.Unmarshal(message, &req); err != nil {
+			reply := wsMessage{Type: "reply", Status: http.StatusBadRequest, Code: BadRequest,
+				Error: fmt.Sprintf("invalid request JSON: %v", err)}
+			if err := conn.WriteJSON(reply); err != nil {
+				return
+			}
+			continue
+		}
+		if err := session.handle(req); err != nil {
+			log.Printf("websocket write error: %v", err)
+			return
+		}
+	}
+}
+
+// handle runs the request command and writes its reply
+func (ss *wsSession) handle(req wsRequest) error {
+	log.Printf("<- WS %v", req.Action)
+	reply := wsMessage{Type: "reply", ID: req.ID, Status: http.StatusOK}
+	fail := func(status int, err error) error {
+		reply.Status = status
+		reply.Result = nil
+		reply.Error = err.Error()
+		reply.Code = errorCode(err)
+		return ss.conn.WriteJSON(reply)
+	}
+	who := ss.from
+	if req.ID != "" {
+		who.requestID = req.ID
+	}
+	command := req.Action
+	if isAction(OperationKind(command)) {
+		command = "action" // any of the lifecycle actions, such as launch
+	}
+	switch command {
+	case "list":
+		reply.Result = ss.server.vmm.List()
+	case "create":
+		vm, err := decodeVM(bytes.NewReader(req.Body))
+		if err != nil {
+			return fail(statusFor(err), err)
+		}
+		op, vm, status, err := ss.server.createVM(who, vm)
+		if err != nil {
+			return fail(status, err)
+		}
+		reply.Status = status
+		reply.Result = wsCreated{ID: op.VMID, Location: vmLocation(op.VMID), VM: vm, Operation: op}
+	case "subscribe":
+		if err := ss.conn.WriteJSON(reply); err != nil {
+			return err
+		}
+		ss.subscribe(req.Since)
+		return nil
+	case "unsubscribe":
+		ss.unsubscribe()
+	case "inspect", "resize", "action", "cancel", "delete":
+		if req.VM == nil {
+			return fail(http.StatusBadRequest, newError(BadRequest, "missing vm id for %s", req.Action))
+		}
+		var status int
+		var err error
+		switch command {
+		case "inspect":
+			reply.Result, status, err = ss.server.inspectVM(*req.VM)
+		case "resize":
+			reply.Result, status, err = ss.server.resizeVM(who, *req.VM, req.Body)
+		case "action":
+			reply.Result, status, err = ss.server.performVM(who, *req.VM, OperationKind(req.Action))
+		case "cancel":
+			reply.Result, status, err = ss.server.cancelVM(who, *req.VM)
+		case "delete":
+			status, err = ss.server.deleteVM(who, *req.VM)
+		}
+		if err != nil {
+			return fail(status, err)
+		}
+		reply.Status = status
+	default:
+		return fail(http.StatusBadRequest, newError(BadRequest, "unknown action %q", req.Action))
+	}
+	return ss.conn.WriteJSON(reply)
+}
+
+// subscribe (re)starts forwarding Cloud events after since to the client
+func (ss *wsSession) subscribe(since uint64) {
+	ss.unsubscribe()
+	events, backlog, cancel := ss.server.vmm.Subscribe(since)
+	sub := &wsSubscription{cancel: cancel}
+	ss.lock.Lock()
+	ss.subscription = sub
+	ss.lock.Unlock()
+
+	go func() {
+		lastSeq := since
+		send := func(e Event) bool {
+			lastSeq = e.Seq
+			return ss.conn.WriteJSON(wsMessage{Type: "event", Event: &e}) == nil
+		}
+		for _, e := range backlog {
+			if !send(e) {
+				cancel()
+				return
+			}
+		}
+		for e := range events {
+			if !send(e) {
+				cancel()
+				return
+			}
+		}
+		ss.lock.Lock()
+		defer ss.lock.Unlock()
+		if !sub.cancelled {
+			// dropped for being too slow, the client may subscribe again
+			ss.conn.WriteJSON(wsMessage{Type: "unsubscribed", Result: lastSeq})
+		}
+	}()
+}
+
+// unsubscribe stops forwarding Cloud events, if subscribed
+func (ss *wsSession) unsubscribe() {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.subscription != nil {
+		ss.subscription.cancelled = true
+		ss.subscription.cancel()
+		ss.subscription = nil
+	}
+}
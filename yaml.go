@@ -0,0 +1,472 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The server writes and reads the small subset of YAML it needs, for its
+// OpenAPI document and lifecycle files. Both go through the generic values
+// of encoding/json, so YAML documents follow the same rules as JSON ones,
+// such as struct field tags. Anything beyond the subset is refused rather
+// than misread.
+
+// writeYAML writes v as block style YAML, following the same rules as JSON
+// to encode v, such as struct field tags. Map keys are sorted.
+func writeYAML(w io.Writer, v interface{}) error {
+	vJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(vJSON))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return err
+	}
+	for _, line := range yamlLines(generic) {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// yamlPlainKey matches map keys that need no quoting
+var yamlPlainKey = regexp.MustCompile(`^[A-Za-z_$/][A-Za-z0-9_$./{}-]*$`)
+
+func yamlKey(key string) string {
+	if yamlPlainKey.MatchString(key) {
+		return key
+	}
+	return yamlScalar(key)
+}
+
+// yamlScalar encodes scalars, JSON strings are valid YAML double quoted ones
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case json.Number:
+		return v.String()
+	default:
+		scalarJSON, _ := json.Marshal(v)
+		return string(scalarJSON)
+	}
+}
+
+// yamlInline returns the single line encoding of v, if it has one
+func yamlInline(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return "{}", true
+		}
+		return "", false
+	case []interface{}:
+		if len(v) == 0 {
+			return "[]", true
+		}
+		return "", false
+	default:
+		return yamlScalar(v), true
+	}
+}
+
+// yamlLines returns the lines encoding a generic JSON value as YAML
+func yamlLines(v interface{}) []string {
+	if inline, ok := yamlInline(v); ok {
+		return []string{inline}
+	}
+	var lines []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if inline, ok := yamlInline(v[key]); ok {
+				lines = append(lines, yamlKey(key)+": "+inline)
+				continue
+			}
+			lines = append(lines, yamlKey(key)+":")
+			for _, line := range yamlLines(v[key]) {
+				lines = append(lines, "  "+line)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			for i, line := range yamlLines(item) {
+				if i == 0 {
+					lines = append(lines, "- "+line)
+				} else {
+					lines = append(lines, "  "+line)
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// yamlToJSON converts a YAML document to JSON, so that it can be decoded
+// with the same rules as JSON input, such as struct field tags.
+// It reads the subset of YAML needed by configuration files: block and
+// flow mappings and sequences, quoted and plain scalars, and comments.
+// Anchors, tags, block scalars and multi-line plain scalars are refused.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var p yamlParser
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimRight(stripYAMLComment(text), " \t\r")
+		content := strings.TrimLeft(text, " ")
+		indent := len(text) - len(content)
+		if content == "" || indent == 0 && (content == "---" || content == "...") {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: indent, text: content})
+	}
+	v, err := p.parseNode(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.lines[p.pos].errorf("bad indentation")
+	}
+	return json.Marshal(v)
+}
+
+// yamlLine is a non blank line of a YAML document, without its comment
+type yamlLine struct {
+	number int    // 1-based, for errors
+	indent int    // Leading spaces
+	text   string // Content after the indentation
+}
+
+func (l yamlLine) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("line %d: %s", l.number, fmt.Sprintf(format, a...))
+}
+
+// yamlParser reads block nodes out of the lines of a YAML document
+type yamlParser struct {
+	lines []yamlLine
+	pos   int // Next line to read
+}
+
+// parseNode reads the node starting on the next line, null if that line is
+// indented less than the given indentation
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	if p.pos == len(p.lines) || p.lines[p.pos].indent < indent {
+		return nil, nil
+	}
+	line := p.lines[p.pos]
+	if isYAMLItem(line.text) {
+		return p.parseSequence(line.indent)
+	}
+	if _, _, ok, err := splitYAMLKey(line.text); err != nil {
+		return nil, line.errorf("%v", err)
+	} else if ok {
+		return p.parseMapping(line.indent)
+	}
+	p.pos++
+	v, err := parseYAMLFlow(line.text)
+	if err != nil {
+		return nil, line.errorf("%v", err)
+	}
+	return v, nil
+}
+
+// parseSequence reads the "- item" lines at the given indentation
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || line.indent == indent && !isYAMLItem(line.text) {
+			break
+		}
+		if line.indent > indent {
+			return nil, line.errorf("bad indentation")
+		}
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if rest == "" {
+			p.pos++
+		} else {
+			// The item starts on the same line, as if it were on its own
+			// line indented up to its first character
+			p.lines[p.pos] = yamlLine{number: line.number, indent: indent + len(line.text) - len(rest), text: rest}
+		}
+		item, err := p.parseNode(indent + 1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseMapping reads the "key: value" lines at the given indentation
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, line.errorf("bad indentation")
+		}
+		key, rest, ok, err := splitYAMLKey(line.text)
+		if err != nil {
+			return nil, line.errorf("%v", err)
+		}
+		if !ok {
+			return nil, line.errorf("want a key: value mapping entry, got %q", line.text)
+		}
+		if _, found := m[key]; found {
+			return nil, line.errorf("duplicate key %q", key)
+		}
+		p.pos++
+		if rest != "" {
+			if m[key], err = parseYAMLFlow(rest); err != nil {
+				return nil, line.errorf("%v", err)
+			}
+			continue
+		}
+		// The value is on the next lines: indented further, or a sequence
+		// at the same indentation
+		m[key] = nil
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || next.indent == indent && isYAMLItem(next.text) {
+				if m[key], err = p.parseNode(next.indent); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// isYAMLItem tells whether a line starts a block sequence item
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits a "key: value" mapping entry, ok is false if the text
+// is no such entry
+func splitYAMLKey(text string) (key, rest string, ok bool, err error) {
+	if text == "" || strings.ContainsRune("[{", rune(text[0])) {
+		return "", "", false, nil
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		key, after, err := scanYAMLQuoted(text)
+		if err != nil {
+			return "", "", false, err
+		}
+		if after = strings.TrimLeft(after, " "); after != ":" && !strings.HasPrefix(after, ": ") {
+			return "", "", false, nil
+		}
+		return key, strings.TrimSpace(after[1:]), true, nil
+	}
+	colon := strings.Index(text, ": ")
+	if colon < 0 && strings.HasSuffix(text, ":") {
+		colon = len(text) - 1
+	}
+	if colon < 0 {
+		return "", "", false, nil
+	}
+	return strings.TrimSpace(text[:colon]), strings.TrimSpace(text[colon+1:]), true, nil
+}
+
+// stripYAMLComment removes the # comment ending the line, if any
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,:", line[i-1]) >= 0):
+			quote = c
+		}
+	}
+	return line
+}
+
+// scanYAMLQuoted reads the single or double quoted scalar starting the text,
+// returning it along with the text after it
+func scanYAMLQuoted(text string) (string, string, error) {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			if quote == '\'' {
+				return strings.ReplaceAll(text[1:i], "''", "'"), text[i+1:], nil
+			}
+			var s string
+			if err := json.Unmarshal([]byte(text[:i+1]), &s); err != nil {
+				return "", "", fmt.Errorf("bad double quoted string %s: %v", text[:i+1], err)
+			}
+			return s, text[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted string %s", text)
+}
+
+// parseYAMLFlow reads a value written on a single line: a scalar, or a flow
+// sequence or mapping such as [a, b] or {min: 1, max: 2}
+func parseYAMLFlow(text string) (interface{}, error) {
+	f := yamlFlow{text: text}
+	v, err := f.value("")
+	if err != nil {
+		return nil, err
+	}
+	if f.skipSpaces(); f.pos < len(f.text) {
+		return nil, fmt.Errorf("unexpected %q after value", f.text[f.pos:])
+	}
+	return v, nil
+}
+
+// yamlFlowIndicators end plain scalars within flow collections
+const yamlFlowIndicators = ",[]{}"
+
+// yamlFlow scans flow style values
+type yamlFlow struct {
+	text string
+	pos  int
+}
+
+func (f *yamlFlow) skipSpaces() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+// value reads the next value, plain scalars ending before any of the given
+// delimiters
+func (f *yamlFlow) value(delimiters string) (interface{}, error) {
+	f.skipSpaces()
+	if f.pos == len(f.text) {
+		return nil, nil
+	}
+	switch f.text[f.pos] {
+	case '[':
+		return f.collection(']', func() (interface{}, error) {
+			return f.value(yamlFlowIndicators)
+		})
+	case '{':
+		m := map[string]interface{}{}
+		_, err := f.collection('}', func() (interface{}, error) {
+			key, err := f.value(":" + yamlFlowIndicators)
+			if err != nil {
+				return nil, err
+			}
+			if key == nil {
+				return nil, fmt.Errorf("missing key in flow mapping")
+			}
+			if f.skipSpaces(); f.pos == len(f.text) || f.text[f.pos] != ':' {
+				return nil, fmt.Errorf("want a colon after key %v", key)
+			}
+			f.pos++
+			name := fmt.Sprint(key)
+			if _, found := m[name]; found {
+				return nil, fmt.Errorf("duplicate key %q", name)
+			}
+			if m[name], err = f.value(yamlFlowIndicators); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		})
+		return m, err
+	case '"', '\'':
+		s, rest, err := scanYAMLQuoted(f.text[f.pos:])
+		f.pos = len(f.text) - len(rest)
+		return s, err
+	}
+	end := len(f.text)
+	if i := strings.IndexAny(f.text[f.pos:], delimiters); delimiters != "" && i >= 0 {
+		end = f.pos + i
+	}
+	plain := strings.TrimSpace(f.text[f.pos:end])
+	f.pos = end
+	return yamlPlain(plain)
+}
+
+// collection reads the comma separated items of a flow sequence or mapping
+// up to its closing character
+func (f *yamlFlow) collection(closing byte, item func() (interface{}, error)) (interface{}, error) {
+	items := []interface{}{}
+	f.pos++
+	for {
+		if f.skipSpaces(); f.pos < len(f.text) && f.text[f.pos] == closing {
+			f.pos++
+			return items, nil
+		}
+		v, err := item()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+		f.skipSpaces()
+		switch {
+		case f.pos == len(f.text):
+			return nil, fmt.Errorf("missing closing %q", closing)
+		case f.text[f.pos] == ',':
+			f.pos++
+		case f.text[f.pos] != closing:
+			return nil, fmt.Errorf("unexpected %q, want a comma or %q", f.text[f.pos], closing)
+		}
+	}
+}
+
+// yamlNumber matches the plain scalars that are numbers
+var yamlNumber = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+
+// yamlPlain resolves a plain scalar to null, a boolean, a number or a
+// string, refusing the ones starting with indicators of unsupported features
+func yamlPlain(plain string) (interface{}, error) {
+	switch plain {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	switch plain[0] {
+	case '|', '>':
+		return nil, fmt.Errorf("block scalars are not supported")
+	case '&', '*', '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	case '%', '@', '`':
+		return nil, fmt.Errorf("reserved indicator %q", plain[0])
+	}
+	if yamlNumber.MatchString(plain) {
+		if n, err := strconv.ParseFloat(plain, 64); err == nil {
+			return json.Number(strconv.FormatFloat(n, 'f', -1, 64)), nil
+		}
+	}
+	return plain, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteYAML(t *testing.T) {
+	v := map[string]interface{}{
+		"openapi": "3.1.0",
+		"paths": map[string]interface{}{
+			"/vms/{vm_id}":       map[string]interface{}{},
+			"/operations/1:wait": []interface{}{1, "two", nil, map[string]interface{}{"a": true, "b": []interface{}{}}},
+		},
+		"200": 1.5,
+	}
+	want := strings.Join([]string{
+		`"200": 1.5`,
+		`openapi: "3.1.0"`,
+		`paths:`,
+		`  "/operations/1:wait":`,
+		`    - 1`,
+		`    - "two"`,
+		`    - null`,
+		`    - a: true`,
+		`      b: []`,
+		`  /vms/{vm_id}: {}`,
+		``,
+	}, "\n")
+	var got bytes.Buffer
+	if err := writeYAML(&got, v); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got.String(), want)
+	}
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	for _, tc := range []struct {
+		yaml string
+		want string
+	}{
+		{yaml: "a: 1\nb: two # comment\n", want: `{"a":1,"b":"two"}`},
+		{yaml: "---\n# only comments\nempty:\nnull: ~\n...\n", want: `{"empty":null,"null":null}`},
+		{yaml: "", want: `null`},
+		{yaml: "plain words\n", want: `"plain words"`},
+		{yaml: "list:\n- 1.5\n- true\n-\n  - x\n", want: `{"list":[1.5,true,["x"]]}`},
+		{yaml: "- - 1\n  - 2\n- -3\n", want: `[[1,2],-3]`},
+		{yaml: "- a: 1\n  b:\n    c: [1, \"2\", '3''s']\n- {d: {e: []}, f: \"#x\"}\n", want: `[{"a":1,"b":{"c":[1,"2","3's"]}},{"d":{"e":[]},"f":"#x"}]`},
+		{yaml: "\"/operations/1:wait\": 'it''s: fine'\n/vms/{vm_id}: {}\n", want: `{"/operations/1:wait":"it's: fine","/vms/{vm_id}":{}}`},
+		{yaml: "'quoted key': \"tab\\tand \\u00e9\"\n", want: `{"quoted key":"tab\tand é"}`},
+		{yaml: "version: 1.0.0\nhex: 0x10\nexp: 1e3\nhalf: .5\nyes: True\nno: FALSE\n", want: `{"exp":1000,"half":0.5,"hex":"0x10","no":false,"version":"1.0.0","yes":true}`},
+		{yaml: "url: http://host:8080/path#anchor\n", want: `{"url":"http://host:8080/path#anchor"}`},
+		{yaml: "flow: [[], {}, [a, [b]], {k: [1]}]\n", want: `{"flow":[[],{},["a",["b"]],{"k":[1]}]}`},
+		{yaml: "key:\n  - deeper\nnext: 1\n", want: `{"key":["deeper"],"next":1}`},
+	} {
+		got, err := yamlToJSON([]byte(tc.yaml))
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%q: got: %s (%v), want: %s", tc.yaml, got, err, tc.want)
+		}
+	}
+}
+
+func TestYAMLToJSONErrors(t *testing.T) {
+	for _, tc := range []struct {
+		yaml string
+		want string
+	}{
+		{yaml: "a: 1\n  b: 2\n", want: "line 2: bad indentation"},
+		{yaml: "a:\n  - 1\n  b: 2\n", want: "line 3: bad indentation"},
+		{yaml: "- a\nb: 1\n", want: "line 2: bad indentation"},
+		{yaml: "a: multi\n  line\n", want: "line 2: bad indentation"},
+		{yaml: "a: 1\njust text\n", want: `line 2: want a key: value mapping entry, got "just text"`},
+		{yaml: "a: 1\na: 2\n", want: `line 2: duplicate key "a"`},
+		{yaml: "a: {b: 1, b: 2}\n", want: `line 1: duplicate key "b"`},
+		{yaml: "a: {: 1}\n", want: "line 1: missing key in flow mapping"},
+		{yaml: "a: {b}\n", want: "line 1: want a colon after key b"},
+		{yaml: "a: [1, 2\n", want: `line 1: missing closing ']'`},
+		{yaml: "a: [1 2] x\n", want: `line 1: unexpected "x" after value`},
+		{yaml: "a: {b: 1] \n", want: `line 1: unexpected ']', want a comma or '}'`},
+		{yaml: "a: 'x' y\n", want: `line 1: unexpected "y" after value`},
+		{yaml: "a: |\n  text\n", want: "line 1: block scalars are not supported"},
+		{yaml: "a: >\n  text\n", want: "line 1: block scalars are not supported"},
+		{yaml: "a: &ref 1\n", want: "line 1: anchors, aliases and tags are not supported"},
+		{yaml: "a: [*ref]\n", want: "line 1: anchors, aliases and tags are not supported"},
+		{yaml: "a: !!str 1\n", want: "line 1: anchors, aliases and tags are not supported"},
+		{yaml: "%YAML 1.2\n", want: "line 1: reserved indicator '%'"},
+		{yaml: "a: \"open\n", want: `line 1: unterminated quoted string "open`},
+		{yaml: "a: 'open\n", want: "line 1: unterminated quoted string 'open"},
+		{yaml: "a: \"\\q\"\n", want: `line 1: bad double quoted string "\q": `},
+		{yaml: "\tb: 1\n", want: "line 1: tabs are not allowed for indentation"},
+	} {
+		if _, err := yamlToJSON([]byte(tc.yaml)); err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("%q: got: %v, want: %s", tc.yaml, err, tc.want)
+		}
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	// Values the reader would resolve differently if written plain
+	tricky := []interface{}{"true", "null", "~", "1.5", "", "#x", "a: b", "- x", "[x]", "{x}", "it's", "line\nbreak", "&a", "|", "é", 1.5, -2, true, nil,
+		map[string]interface{}{"true": 1, "200": 2, "": 3, "a b": 4, "#k": 5, "-k": 6, "/vms/{vm_id}": []interface{}{}, "k:": map[string]interface{}{}},
+		[]interface{}{[]interface{}{1, []interface{}{2}}, map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": nil}}}},
+	}
+	for _, v := range []interface{}{tricky, DefaultLifecycle} {
+		var doc bytes.Buffer
+		if err := writeYAML(&doc, v); err != nil {
+			t.Fatal(err)
+		}
+		got, err := yamlToJSON(doc.Bytes())
+		if err != nil {
+			t.Fatalf("got: %v, reading:\n%s", err, &doc)
+		}
+		vJSON, _ := json.Marshal(v)
+		var gotValue, want interface{}
+		json.Unmarshal(got, &gotValue)
+		json.Unmarshal(vJSON, &want)
+		if !reflect.DeepEqual(gotValue, want) {
+			t.Errorf("got: %s, want: %s, reading:\n%s", got, vJSON, &doc)
+		}
+	}
+}